@@ -2,22 +2,45 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"sync"
+	"time"
 
 	jsoniter "github.com/json-iterator/go"
 )
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+// ErrServerError is returned when Discord responds with a 5xx status
+// after the request has been retried
+var ErrServerError = errors.New("discord responded with a server error")
+
+// ErrUnexpectedStatus is returned by FetchJSON when Discord responds with
+// a status that is not 2xx, such as a 404 when the object does not exist
+var ErrUnexpectedStatus = errors.New("discord responded with an unexpected status")
+
+// retryBackoff is how long to wait before the first retry of a failed
+// request which doubles every retry
+const retryBackoff = 250 * time.Millisecond
+
+// ErrRatelimited is returned when a request is still ratelimited after
+// being retried
+var ErrRatelimited = errors.New("request is still ratelimited after retrying")
+
 // Client represents the REST client
 type Client struct {
 	Token string
 
-	HTTP    *http.Client
+	HTTP *http.Client
+
+	// Buckets stores the *Bucket of each route
 	Buckets *sync.Map
 
+	globalMu      sync.RWMutex
+	globalResetAt time.Time
+
 	// We will manually add the API version
 	APIVersion string
 
@@ -25,6 +48,10 @@ type Client struct {
 	URLHost   string
 	URLScheme string
 	UserAgent string
+
+	// MaxRetries is how many times a request that failed from a network
+	// error or a 5xx status will be retried. Defaults to 3.
+	MaxRetries int
 }
 
 // NewClient makes a new client
@@ -32,24 +59,35 @@ func NewClient(token string) *Client {
 	return &Client{
 		Token:      token,
 		HTTP:       http.DefaultClient,
+		Buckets:    &sync.Map{},
 		APIVersion: "6",
 		URLHost:    "discord.com",
 		URLScheme:  "https",
+		MaxRetries: 3,
 	}
 }
 
-// FetchJSON attempts to convert the response into a JSON structure
+// FetchJSON attempts to convert the response into a JSON structure. If
+// Discord responds with a status that is not 2xx, ErrUnexpectedStatus is
+// returned and the structure is left as is. Ratelimited requests are
+// retried after the Retry-After Discord sends.
 func (c *Client) FetchJSON(method string, url string, body io.Reader, structure interface{}) (err error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return
 	}
 
+	// HandleRequest never returns a response with an error so the body
+	// must only be closed once we know the request succeeded.
 	res, err := c.HandleRequest(req)
-	defer res.Body.Close()
 	if err != nil {
 		return
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", ErrUnexpectedStatus, res.Status)
+	}
 
 	err = json.NewDecoder(res.Body).Decode(structure)
 	if err != nil {
@@ -59,9 +97,20 @@ func (c *Client) FetchJSON(method string, url string, body io.Reader, structure
 	return
 }
 
-// HandleRequest makes a request to the Discord API
-// TODO: Buckets and handle ratelimiting
+// HandleRequest makes a request to the Discord API. Requests wait for
+// the ratelimit of their route and the global ratelimit and are retried
+// if Discord still ratelimits them. Requests that fail from a network
+// error or a 5xx status are retried MaxRetries times with a backoff and
+// the last error is returned if they still fail. If an error is
+// returned, res is always nil.
 func (c *Client) HandleRequest(req *http.Request) (res *http.Response, err error) {
+	defer func() {
+		if err != nil && res != nil {
+			res.Body.Close()
+			res = nil
+		}
+	}()
+
 	req.URL.Path = "/api/v" + c.APIVersion + req.URL.Path
 
 	// Fill out Host and Scheme if it is empty
@@ -78,15 +127,58 @@ func (c *Client) HandleRequest(req *http.Request) (res *http.Response, err error
 		req.Header.Set("Authorization", "Bot "+c.Token)
 	}
 
-	res, err = c.HTTP.Do(req)
-	if err != nil {
-		return
+	bucket := c.bucket(req)
+	ratelimits, retries := 0, 0
+
+	for {
+		c.waitForGlobal()
+		bucket.wait()
+
+		res, err = c.HTTP.Do(req)
+		if err == nil {
+			bucket.update(res.Header)
+
+			if res.StatusCode >= http.StatusInternalServerError {
+				err = fmt.Errorf("%w: %s", ErrServerError, res.Status)
+			}
+		}
+
+		switch {
+		case err != nil:
+			if retries >= c.MaxRetries {
+				return
+			}
+
+			if res != nil {
+				res.Body.Close()
+			}
+			time.Sleep(retryBackoff << retries)
+			retries++
+		case res.StatusCode == http.StatusTooManyRequests:
+			if ratelimits >= maxRatelimitRetries {
+				return res, ErrRatelimited
+			}
+
+			after := retryAfter(res.Header)
+			if res.Header.Get("X-RateLimit-Global") == "true" {
+				c.setGlobal(after)
+			} else {
+				time.Sleep(after)
+			}
+			res.Body.Close()
+			ratelimits++
+		default:
+			if res.StatusCode == http.StatusUnauthorized {
+				err = errors.New("Invalid token passed")
+			}
+			return
+		}
+
+		// The body has been read so it has to be recreated to retry
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
 	}
-
-	if res.StatusCode == http.StatusUnauthorized {
-		err = errors.New("Invalid token passed")
-		return
-	}
-
-	return
 }
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClient returns a Client that makes requests to the server
+func testClient(t *testing.T, server *httptest.Server) *Client {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient("token")
+	c.HTTP = server.Client()
+	c.URLHost = u.Host
+	c.URLScheme = u.Scheme
+	c.MaxRetries = 1
+	return c
+}
+
+type testObject struct {
+	ID string `json:"id"`
+}
+
+func TestFetchJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v6/users/1" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bot token" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer server.Close()
+
+	object := testObject{}
+	if err := testClient(t, server).FetchJSON("GET", "/users/1", nil, &object); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	if object.ID != "1" {
+		t.Errorf("expected the response to be decoded, got %+v", object)
+	}
+}
+
+func TestFetchJSONUnexpectedStatus(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message":"Unknown Member","code":10007}`))
+		}))
+
+		object := testObject{}
+		err := testClient(t, server).FetchJSON("GET", "/guilds/1/members/2", nil, &object)
+		if err == nil {
+			t.Errorf("expected an error for status %d", status)
+		} else if status != http.StatusUnauthorized && !errors.Is(err, ErrUnexpectedStatus) {
+			t.Errorf("expected ErrUnexpectedStatus for status %d, got %v", status, err)
+		}
+		if object.ID != "" {
+			t.Errorf("expected the error body to not be decoded, got %+v", object)
+		}
+
+		server.Close()
+	}
+}
+
+func TestFetchJSONRetryAfter(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "0.1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	object := testObject{}
+	if err := testClient(t, server).FetchJSON("GET", "/users/1", nil, &object); err != nil {
+		t.Fatalf("expected the ratelimited request to be retried: %v", err)
+	}
+
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("expected to wait for the Retry-After, waited %s", waited)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	if object.ID != "1" {
+		t.Errorf("expected the retried response to be decoded, got %+v", object)
+	}
+}
+
+func TestFetchJSONStillRatelimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	err := testClient(t, server).FetchJSON("GET", "/users/1", nil, &testObject{})
+	if !errors.Is(err, ErrRatelimited) {
+		t.Errorf("expected ErrRatelimited, got %v", err)
+	}
+}
+
+func TestFetchJSONServerError(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	err := testClient(t, server).FetchJSON("GET", "/users/1", nil, &testObject{})
+	if !errors.Is(err, ErrServerError) {
+		t.Errorf("expected ErrServerError, got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected the request and 1 retry, got %d requests", n)
+	}
+}
+
+func TestFetchJSONConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c := testClient(t, server)
+	c.MaxRetries = 0
+
+	// Once closed, the server refuses connections so there is no
+	// response to close.
+	server.Close()
+
+	if err := c.FetchJSON("GET", "/gateway/bot", nil, &testObject{}); err == nil {
+		t.Fatal("expected an error when the connection is refused")
+	}
+}
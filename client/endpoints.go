@@ -0,0 +1,52 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+)
+
+// GetGuild fetches a guild. This does not include the objects only sent
+// in GUILD_CREATE such as channels and members.
+func (c *Client) GetGuild(guildID snowflake.ID) (guild *events.Guild, err error) {
+	guild = &events.Guild{}
+	err = c.FetchJSON("GET", fmt.Sprintf("/guilds/%s", guildID), nil, guild)
+	return
+}
+
+// GetChannel fetches a channel
+func (c *Client) GetChannel(channelID snowflake.ID) (channel *events.Channel, err error) {
+	channel = &events.Channel{}
+	err = c.FetchJSON("GET", fmt.Sprintf("/channels/%s", channelID), nil, channel)
+	return
+}
+
+// GetGuildMembers fetches at most limit members of a guild whose user id
+// is greater than after. This requires the GUILD_MEMBERS intent. Discord
+// allows at most 1000 members per request.
+func (c *Client) GetGuildMembers(guildID snowflake.ID, after snowflake.ID, limit int) (members []*events.GuildMember, err error) {
+	query := url.Values{}
+	query.Set("after", after.String())
+	query.Set("limit", strconv.Itoa(limit))
+
+	members = make([]*events.GuildMember, 0)
+	err = c.FetchJSON("GET", fmt.Sprintf("/guilds/%s/members?%s", guildID, query.Encode()), nil, &members)
+	return
+}
+
+// GetGuildMember fetches a single member of a guild
+func (c *Client) GetGuildMember(guildID snowflake.ID, userID snowflake.ID) (member *events.GuildMember, err error) {
+	member = &events.GuildMember{}
+	err = c.FetchJSON("GET", fmt.Sprintf("/guilds/%s/members/%s", guildID, userID), nil, member)
+	return
+}
+
+// GetUser fetches a user
+func (c *Client) GetUser(userID snowflake.ID) (user *events.User, err error) {
+	user = &events.User{}
+	err = c.FetchJSON("GET", fmt.Sprintf("/users/%s", userID), nil, user)
+	return
+}
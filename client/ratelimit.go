@@ -0,0 +1,93 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRatelimitRetries is how many times a request that was ratelimited
+// will be retried before giving up
+const maxRatelimitRetries = 5
+
+// Bucket represents the ratelimit of a route. Requests will wait until
+// the bucket has reset if there are none remaining.
+type Bucket struct {
+	mu sync.Mutex
+
+	// Hash is the X-RateLimit-Bucket Discord sent for the route
+	Hash      string
+	Remaining int
+	ResetAt   time.Time
+}
+
+// wait blocks until a request can be made in the bucket and takes it
+func (b *Bucket) wait() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.Remaining <= 0 {
+		if wait := time.Until(b.ResetAt); wait > 0 {
+			time.Sleep(wait)
+		}
+		// Until Discord tells us otherwise, we can make one request after
+		// the bucket resets
+		b.Remaining = 1
+	}
+	b.Remaining--
+}
+
+// update updates the bucket from the ratelimit headers of a response
+func (b *Bucket) update(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	resetAfter, err := strconv.ParseFloat(header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Hash = header.Get("X-RateLimit-Bucket")
+	b.Remaining = remaining
+	b.ResetAt = time.Now().Add(time.Duration(resetAfter * float64(time.Second)))
+}
+
+// bucket returns the Bucket for a request creating it if it does not exist
+func (c *Client) bucket(req *http.Request) *Bucket {
+	bucket, _ := c.Buckets.LoadOrStore(req.Method+" "+req.URL.Path, &Bucket{Remaining: 1})
+	return bucket.(*Bucket)
+}
+
+// waitForGlobal blocks until the global ratelimit has reset
+func (c *Client) waitForGlobal() {
+	c.globalMu.RLock()
+	wait := time.Until(c.globalResetAt)
+	c.globalMu.RUnlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// setGlobal blocks every request until after has passed
+func (c *Client) setGlobal(after time.Duration) {
+	c.globalMu.Lock()
+	c.globalResetAt = time.Now().Add(after)
+	c.globalMu.Unlock()
+}
+
+// retryAfter returns how long to wait after a 429 from the Retry-After
+// header. If it is missing, we will wait a second.
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.ParseFloat(header.Get("Retry-After"), 64)
+	if err != nil {
+		return time.Second
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
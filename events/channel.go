@@ -40,8 +40,8 @@ type Channel struct {
 type Overwrite struct {
 	ID    snowflake.ID `json:"id"`
 	Type  string       `json:"type"`
-	Allow int          `json:"allow"`
-	Deny  int          `json:"deny"`
+	Allow Permissions  `json:"allow"`
+	Deny  Permissions  `json:"deny"`
 }
 
 // ChannelCreate represents a channel create packet
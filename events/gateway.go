@@ -76,6 +76,9 @@ const (
 	CloseSessionTimeout
 	CloseInvalidShard
 	CloseShardingRequired
+	CloseInvalidAPIVersion
+	CloseInvalidIntents
+	CloseDisallowedIntents
 )
 
 // ReceivedPayload is the base of a JSON packet received from discord
@@ -99,9 +102,9 @@ type Identify struct {
 	Compress           bool                `json:"compress,omitempty"`
 	LargeThreshold     int                 `json:"large_threshold,omitempty"`
 	Shard              [2]int              `json:"shard,omitempty"`
-	Presence           *Activity           `json:"presence,omitempty"`
+	Presence           *UpdateStatus       `json:"presence,omitempty"`
 	GuildSubscriptions bool                `json:"guild_subscriptions,omitempty"`
-	Intents            int                 `json:"intent,omitempty"`
+	Intents            int                 `json:"intents,omitempty"`
 }
 
 // IdentifyProperties is the properties sent in the identify packet
@@ -118,19 +121,22 @@ type Resume struct {
 	Seq       int64  `json:"seq"`
 }
 
-// RequestGuildMembers represents a request guild members packet
+// RequestGuildMembers represents a request guild members packet.
+// Presences requires the GUILD_PRESENCES intent.
 type RequestGuildMembers struct {
-	GuildID snowflake.ID `json:"guild_id"`
-	Query   string       `json:"query"`
-	Limit   int          `json:"limit"`
+	GuildID   snowflake.ID `json:"guild_id"`
+	Query     string       `json:"query"`
+	Limit     int          `json:"limit"`
+	Presences bool         `json:"presences,omitempty"`
+	Nonce     string       `json:"nonce,omitempty"`
 }
 
 // UpdateVoiceState represents an update voice state packet
 type UpdateVoiceState struct {
-	GuildID   snowflake.ID `json:"guild_id"`
-	ChannelID snowflake.ID `json:"channel_id"`
-	SelfMute  bool         `json:"self_mute"`
-	SelfDeaf  bool         `json:"self_deaf"`
+	GuildID   snowflake.ID  `json:"guild_id"`
+	ChannelID *snowflake.ID `json:"channel_id"`
+	SelfMute  bool          `json:"self_mute"`
+	SelfDeaf  bool          `json:"self_deaf"`
 }
 
 // Available statuses
@@ -161,6 +167,30 @@ type Ready struct {
 	User      *User    `json:"user"`
 	Guilds    []*Guild `json:"guilds"`
 	SessionID string   `json:"session_id"`
+	Shard     [2]int   `json:"shard,omitempty"`
+
+	// Newer gateway versions send a few supplemental fields along with
+	// READY. ResumeGatewayURL should be used instead of the /gateway/bot
+	// URL when resuming the session, the rest are mostly informational.
+	ResumeGatewayURL     string   `json:"resume_gateway_url,omitempty"`
+	SessionType          string   `json:"session_type,omitempty"`
+	GeoOrderedRTCRegions []string `json:"geo_ordered_rtc_regions,omitempty"`
+}
+
+// GuildHashes represents the hashes of the different sections of a guild
+// sent in READY and GUILD_CREATE. If the hashes match a previously seen
+// guild, that section of the guild has not changed.
+type GuildHashes struct {
+	Version  int       `json:"version"`
+	Roles    GuildHash `json:"roles"`
+	Metadata GuildHash `json:"metadata"`
+	Channels GuildHash `json:"channels"`
+}
+
+// GuildHash represents a single hash in GuildHashes
+type GuildHash struct {
+	Hash    string `json:"hash"`
+	Omitted bool   `json:"omitted,omitempty"`
 }
 
 // Resumed represents a resumed packet
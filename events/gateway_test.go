@@ -0,0 +1,79 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestReadySupplementalFields(t *testing.T) {
+	payload := []byte(`{
+		"v": 8,
+		"user": {"id": "1", "username": "sandwich", "discriminator": "0001", "avatar": ""},
+		"guilds": [{
+			"id": "2",
+			"unavailable": true,
+			"guild_hashes": {
+				"version": 1,
+				"roles": {"hash": "r"},
+				"metadata": {"hash": "m"},
+				"channels": {"hash": "c", "omitted": true}
+			}
+		}],
+		"session_id": "abc",
+		"shard": [1, 4],
+		"resume_gateway_url": "wss://gateway-us-east1-b.discord.gg",
+		"session_type": "normal",
+		"geo_ordered_rtc_regions": ["us-east", "us-central"],
+		"unknown_field": {"ignored": true}
+	}`)
+
+	var ready Ready
+	if err := json.Unmarshal(payload, &ready); err != nil {
+		t.Fatalf("failed to unmarshal ready: %v", err)
+	}
+
+	if ready.Version != 8 || ready.SessionID != "abc" {
+		t.Errorf("expected version 8 and session abc, got %d and %q", ready.Version, ready.SessionID)
+	}
+	if ready.Shard != [2]int{1, 4} {
+		t.Errorf("expected shard [1 4], got %v", ready.Shard)
+	}
+	if ready.ResumeGatewayURL != "wss://gateway-us-east1-b.discord.gg" {
+		t.Errorf("unexpected resume gateway url %q", ready.ResumeGatewayURL)
+	}
+	if ready.SessionType != "normal" {
+		t.Errorf("unexpected session type %q", ready.SessionType)
+	}
+	if expected := []string{"us-east", "us-central"}; !reflect.DeepEqual(ready.GeoOrderedRTCRegions, expected) {
+		t.Errorf("expected regions %v, got %v", expected, ready.GeoOrderedRTCRegions)
+	}
+
+	if len(ready.Guilds) != 1 {
+		t.Fatalf("expected 1 guild, got %d", len(ready.Guilds))
+	}
+
+	expected := &GuildHashes{
+		Version:  1,
+		Roles:    GuildHash{Hash: "r"},
+		Metadata: GuildHash{Hash: "m"},
+		Channels: GuildHash{Hash: "c", Omitted: true},
+	}
+	if hashes := ready.Guilds[0].GuildHashes; !reflect.DeepEqual(hashes, expected) {
+		t.Errorf("expected guild hashes %+v, got %+v", expected, hashes)
+	}
+}
+
+func TestReadyWithoutSupplementalFields(t *testing.T) {
+	var ready Ready
+	if err := json.Unmarshal([]byte(`{"v":6,"guilds":[{"id":"2","unavailable":true}],"session_id":"abc"}`), &ready); err != nil {
+		t.Fatalf("failed to unmarshal ready: %v", err)
+	}
+
+	if ready.ResumeGatewayURL != "" || ready.GeoOrderedRTCRegions != nil {
+		t.Errorf("expected no supplemental fields, got %+v", ready)
+	}
+	if ready.Guilds[0].GuildHashes != nil {
+		t.Errorf("expected no guild hashes, got %+v", ready.Guilds[0].GuildHashes)
+	}
+}
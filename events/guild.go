@@ -10,7 +10,7 @@ type Guild struct {
 	Splash                      string                     `json:"splash"`
 	Owner                       bool                       `json:"owner,omitempty"`
 	OwnerID                     string                     `json:"owner_id"`
-	Permissions                 int                        `json:"permissions,omitempty"`
+	Permissions                 Permissions                `json:"permissions,omitempty"`
 	Region                      string                     `json:"region"`
 	AFKChannelID                string                     `json:"afk_channel_id"`
 	AFKTimeout                  int                        `json:"afk_timeout"`
@@ -35,6 +35,7 @@ type Guild struct {
 	Members                     []*GuildMember             `json:"members,omitempty"`      // TODO: type
 	Channels                    []*Channel                 `json:"channels,omitempty"`
 	Presences                   []*Activity                `json:"presences,omitempty"` // TODO: type
+	GuildHashes                 *GuildHashes               `json:"guild_hashes,omitempty"`
 }
 
 // UnavailableGuild represents an unavailable guild
@@ -137,20 +138,29 @@ type GuildMemberUpdate struct {
 
 // GuildMembersChunk represents a guild members chunk packet
 type GuildMembersChunk struct {
-	GuildID snowflake.ID   `json:"guild_id"`
-	Members []*GuildMember `json:"members"`
+	GuildID    snowflake.ID   `json:"guild_id"`
+	Members    []*GuildMember `json:"members"`
+	ChunkIndex int            `json:"chunk_index"`
+	ChunkCount int            `json:"chunk_count"`
+	Nonce      string         `json:"nonce,omitempty"`
+
+	// NotFound contains the user ids that were requested but are not
+	// members of the guild and Presences is only sent if presences
+	// were requested.
+	NotFound  []snowflake.ID    `json:"not_found,omitempty"`
+	Presences []*PresenceUpdate `json:"presences,omitempty"`
 }
 
 // GuildRoleCreate represents a guild role create packet
 type GuildRoleCreate struct {
 	GuildID snowflake.ID `json:"guild_id"`
-	Role    interface{}  `json:"role"` // TODO: type
+	Role    *Role        `json:"role"`
 }
 
 // GuildRoleUpdate represents a guild role update packet
 type GuildRoleUpdate struct {
 	GuildID snowflake.ID `json:"guild_id"`
-	Role    *Role        `json:"role"` // TODO: type
+	Role    *Role        `json:"role"`
 }
 
 // GuildRoleDelete represents a guild role delete packet
@@ -19,7 +19,7 @@ type Message struct {
 	Attachments     []Attachment       `json:"attachments"`
 	Embeds          []Embed            `json:"embeds"`
 	Reactions       []Reaction         `json:"reactions"`
-	Nonce           snowflake.ID       `json:"nonce,omitempty"`
+	Nonce           interface{}        `json:"nonce,omitempty"` // can be an int or string
 	Pinned          bool               `json:"pinned"`
 	WebhookID       snowflake.ID       `json:"webhook_id,omitempty"`
 	Type            int                `json:"type"`
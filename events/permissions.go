@@ -0,0 +1,96 @@
+package events
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Permissions represents a permission bitset on Discord. Newer API
+// versions send permissions as strings as they no longer fit in 53 bits
+// so both numbers and strings are accepted when unmarshaling.
+type Permissions int64
+
+// Permissions a role or member can have
+const (
+	PermissionCreateInstantInvite Permissions = 1 << iota
+	PermissionKickMembers
+	PermissionBanMembers
+	PermissionAdministrator
+	PermissionManageChannels
+	PermissionManageGuild
+	PermissionAddReactions
+	PermissionViewAuditLog
+	PermissionPrioritySpeaker
+	PermissionStream
+	PermissionViewChannel
+	PermissionSendMessages
+	PermissionSendTTSMessages
+	PermissionManageMessages
+	PermissionEmbedLinks
+	PermissionAttachFiles
+	PermissionReadMessageHistory
+	PermissionMentionEveryone
+	PermissionUseExternalEmojis
+	PermissionViewGuildInsights
+	PermissionConnect
+	PermissionSpeak
+	PermissionMuteMembers
+	PermissionDeafenMembers
+	PermissionMoveMembers
+	PermissionUseVAD
+	PermissionChangeNickname
+	PermissionManageNicknames
+	PermissionManageRoles
+	PermissionManageWebhooks
+	PermissionManageEmojis
+	PermissionUseApplicationCommands
+	PermissionRequestToSpeak
+	PermissionManageEvents
+	PermissionManageThreads
+	PermissionCreatePublicThreads
+	PermissionCreatePrivateThreads
+	PermissionUseExternalStickers
+	PermissionSendMessagesInThreads
+	PermissionUseEmbeddedActivities
+	PermissionModerateMembers
+)
+
+// PermissionAll is every permission. Owners and members with the
+// administrator permission have every permission regardless of
+// overwrites.
+const PermissionAll Permissions = 1<<53 - 1
+
+// Has returns true if every permission in flag is set
+func (p Permissions) Has(flag Permissions) bool {
+	return p&flag == flag
+}
+
+// Add returns the permissions with flag set
+func (p Permissions) Add(flag Permissions) Permissions {
+	return p | flag
+}
+
+// Remove returns the permissions with flag unset
+func (p Permissions) Remove(flag Permissions) Permissions {
+	return p &^ flag
+}
+
+// UnmarshalJSON accepts permissions as either a number or a string
+func (p *Permissions) UnmarshalJSON(data []byte) (err error) {
+	var permissions int64
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err = json.Unmarshal(data, &s); err != nil {
+			return
+		}
+		permissions, err = strconv.ParseInt(s, 10, 64)
+	} else {
+		err = json.Unmarshal(data, &permissions)
+	}
+	if err != nil {
+		return
+	}
+
+	*p = Permissions(permissions)
+	return
+}
@@ -0,0 +1,66 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestPermissionsMsgpackRoundTrip(t *testing.T) {
+	// Roles were cached with permissions as an int before Permissions
+	// was added
+	type legacyRole struct {
+		ID          int64  `json:"id"`
+		Name        string `json:"name"`
+		Permissions int    `json:"permissions"`
+	}
+
+	encode := func(v interface{}) []byte {
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		if err := enc.Encode(v); err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	decode := func(data []byte) (role Role) {
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		if err := dec.Decode(&role); err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+		return
+	}
+
+	expected := PermissionAdministrator | PermissionSendMessages
+	if role := decode(encode(legacyRole{ID: 1, Name: "a", Permissions: int(expected)})); role.Permissions != expected {
+		t.Errorf("expected a role cached with int permissions to decode to %d, got %d", expected, role.Permissions)
+	}
+
+	// Permissions above 32 bits must survive the round trip
+	large := Permissions(1 << 40)
+	if role := decode(encode(Role{ID: 1, Permissions: large})); role.Permissions != large {
+		t.Errorf("expected %d after a round trip, got %d", large, role.Permissions)
+	}
+}
+
+func TestPermissionsUnmarshalJSON(t *testing.T) {
+	for data, expected := range map[string]Permissions{
+		`{"permissions":8}`:               PermissionAdministrator,
+		`{"permissions":"8"}`:             PermissionAdministrator,
+		`{"permissions":"1099511627776"}`: 1 << 40,
+	} {
+		role := Role{}
+		if err := json.Unmarshal([]byte(data), &role); err != nil {
+			t.Errorf("failed to unmarshal %s: %v", data, err)
+			continue
+		}
+		if role.Permissions != expected {
+			t.Errorf("expected %s to unmarshal to %d, got %d", data, expected, role.Permissions)
+		}
+	}
+}
@@ -95,6 +95,7 @@ type TypingStart struct {
 	GuildID   snowflake.ID `json:"guild_id,omitempty"`
 	UserID    snowflake.ID `json:"user_id"`
 	Timestamp int          `json:"timestamp"`
+	Member    *GuildMember `json:"member,omitempty"`
 }
 
 // UserUpdate represents a user update packet
@@ -9,7 +9,7 @@ type Role struct {
 	Color       int          `json:"color"`
 	Hoist       bool         `json:"hoist"`
 	Position    int          `json:"position"`
-	Permissions int          `json:"permissions"`
+	Permissions Permissions  `json:"permissions"`
 	Managed     bool         `json:"managed"`
 	Mentionable bool         `json:"mentionable"`
 }
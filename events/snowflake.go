@@ -1,8 +1,66 @@
 package events
 
-import "github.com/bwmarrin/snowflake"
+import (
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// DiscordEpoch is the first millisecond of 2015 which snowflake
+// timestamps are relative to
+const DiscordEpoch = 1420070400000
 
 // We change the default Epoch of the snowflake to match discord's
 func init() {
-	snowflake.Epoch = 1420070400000
+	snowflake.Epoch = DiscordEpoch
+}
+
+// SnowflakeTimestamp returns when a snowflake was created
+func SnowflakeTimestamp(id string) (t time.Time, err error) {
+	sf, err := snowflake.ParseString(id)
+	if err != nil {
+		return
+	}
+
+	ms := int64(sf)>>22 + DiscordEpoch
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+}
+
+// SnowflakeWorkerID returns the internal worker id of a snowflake
+func SnowflakeWorkerID(id string) (workerID int64, err error) {
+	sf, err := snowflake.ParseString(id)
+	if err != nil {
+		return
+	}
+	return (int64(sf) & 0x3E0000) >> 17, nil
+}
+
+// SnowflakeProcessID returns the internal process id of a snowflake
+func SnowflakeProcessID(id string) (processID int64, err error) {
+	sf, err := snowflake.ParseString(id)
+	if err != nil {
+		return
+	}
+	return (int64(sf) & 0x1F000) >> 12, nil
+}
+
+// SnowflakeIncrement returns the increment of a snowflake which counts
+// the ids generated by the process
+func SnowflakeIncrement(id string) (increment int64, err error) {
+	sf, err := snowflake.ParseString(id)
+	if err != nil {
+		return
+	}
+	return int64(sf) & 0xFFF, nil
+}
+
+// SnowflakeForTimestamp returns the lowest snowflake created at t. This
+// is useful as the before and after bounds when paginating REST
+// requests such as fetching messages.
+func SnowflakeForTimestamp(t time.Time) string {
+	ms := t.UnixNano()/int64(time.Millisecond) - DiscordEpoch
+	if ms < 0 {
+		ms = 0
+	}
+	return snowflake.ID(ms << 22).String()
 }
@@ -44,18 +44,19 @@ const (
 	VoiceCloseUnknownEncryptionMode
 )
 
-// VoiceState represents the voice state on Discord
+// VoiceState represents the voice state on Discord. ChannelID will be
+// nil if the user is not in a voice channel.
 type VoiceState struct {
-	GuildID   snowflake.ID `json:"guild_id,omitempty"`
-	ChannelID snowflake.ID `json:"channel_id"`
-	UserID    snowflake.ID `json:"user_id"`
-	Member    GuildMember  `json:"member,omitempty"`
-	SessionID string       `json:"session_id"`
-	Deaf      bool         `json:"deaf"`
-	Mute      bool         `json:"mute"`
-	SelfDeaf  bool         `json:"self_deaf"`
-	SelfMute  bool         `json:"self_mute"`
-	Suppress  bool         `json:"suppress"`
+	GuildID   snowflake.ID  `json:"guild_id,omitempty"`
+	ChannelID *snowflake.ID `json:"channel_id"`
+	UserID    snowflake.ID  `json:"user_id"`
+	Member    GuildMember   `json:"member,omitempty"`
+	SessionID string        `json:"session_id"`
+	Deaf      bool          `json:"deaf"`
+	Mute      bool          `json:"mute"`
+	SelfDeaf  bool          `json:"self_deaf"`
+	SelfMute  bool          `json:"self_mute"`
+	Suppress  bool          `json:"suppress"`
 }
 
 // VoiceStateUpdate represents the VOICE_STATE_UPDATE packet
@@ -25,17 +25,21 @@ func NewBucketStore() (bs *BucketStore) {
 }
 
 // CreateBucket will create a new bucket or overwrite
-func (bs *BucketStore) CreateBucket(name string, limit int32, duration time.Duration) DurationLimiter {
+func (bs *BucketStore) CreateBucket(name string, limit int32, duration time.Duration) (bucket DurationLimiter) {
+	bucket = NewDurationLimiter(limit, duration)
+
 	bs.BucketsMu.Lock()
-	bs.Buckets[name] = NewDurationLimiter(limit, duration)
+	bs.Buckets[name] = bucket
 	bs.BucketsMu.Unlock()
 
-	return bs.Buckets[name]
+	return
 }
 
 // WaitForBucket will wait for a bucket to be ready
 func (bs *BucketStore) WaitForBucket(name string) (err error) {
+	bs.BucketsMu.RLock()
 	bucket, exists := bs.Buckets[name]
+	bs.BucketsMu.RUnlock()
 
 	if !exists {
 		return ErrNoSuchBucket
@@ -45,14 +49,23 @@ func (bs *BucketStore) WaitForBucket(name string) (err error) {
 }
 
 // CreateWaitForBucket will create a bucket if it does not exist and then will wait
-// for it.
+// for it. Only limit callers are let through every duration and the rest
+// will block until a slot is free.
 func (bs *BucketStore) CreateWaitForBucket(name string, limit int32, duration time.Duration) (err error) {
 	bs.BucketsMu.RLock()
 	bucket, exists := bs.Buckets[name]
 	bs.BucketsMu.RUnlock()
 
 	if !exists {
-		bucket = bs.CreateBucket(name, limit, duration)
+		// Another caller may have created the bucket whilst we were
+		// waiting for the lock so we must check again.
+		bs.BucketsMu.Lock()
+		bucket, exists = bs.Buckets[name]
+		if !exists {
+			bucket = NewDurationLimiter(limit, duration)
+			bs.Buckets[name] = bucket
+		}
+		bs.BucketsMu.Unlock()
 	}
 	bucket.Lock()
 	return
@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// chunkTimeout is how long ChunkGuild waits for every chunk to be
+// received
+const chunkTimeout = 2 * time.Minute
+
+// ErrChunkTimeout is returned when the members of a guild were not
+// received within the timeout
+var ErrChunkTimeout = errors.New("timed out waiting for guild members")
+
+// ErrNoShard is returned when there is no running Shard for a guild or
+// shard id
+var ErrNoShard = errors.New("no shard is running for this guild or shard id")
+
+// ChunkGuild requests every member of a guild and blocks until the last
+// GUILD_MEMBERS_CHUNK has been received. The members are cached if
+// CacheMembers is enabled. This requires the GUILD_MEMBERS intent and
+// GUILD_MEMBERS_CHUNK must not be in the EventBlacklist. If presences is
+// true, the presences of the members are also requested and are cached
+// if CachePresences is enabled.
+func (m *Manager) ChunkGuild(guildID snowflake.ID, presences bool) (err error) {
+	shard, err := m.guildShard(guildID)
+	if err != nil {
+		return
+	}
+
+	nonce := strconv.FormatInt(atomic.AddInt64(m.chunkNonce, 1), 10)
+	done := make(chan void)
+
+	m.chunksMu.Lock()
+	m.chunks[nonce] = done
+	m.chunksMu.Unlock()
+
+	defer func() {
+		m.chunksMu.Lock()
+		delete(m.chunks, nonce)
+		m.chunksMu.Unlock()
+	}()
+
+	if err = shard.RequestGuildMembers(guildID, "", 0, presences, nonce); err != nil {
+		return
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(chunkTimeout):
+		return ErrChunkTimeout
+	}
+}
+
+// completeChunk signals the ChunkGuild request with the nonce that its
+// last chunk has been received
+func (m *Manager) completeChunk(nonce string) {
+	m.chunksMu.Lock()
+	defer m.chunksMu.Unlock()
+
+	if done, ok := m.chunks[nonce]; ok {
+		close(done)
+		delete(m.chunks, nonce)
+	}
+}
+
+// ShardForGuild returns the Shard of the current ShardGroup that
+// receives the events of a guild. Gateway commands for a guild, such as
+// requesting members or updating voice states, must be sent with it.
+func (m *Manager) ShardForGuild(guildID string) (shard *Shard, err error) {
+	id, err := snowflake.ParseString(guildID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid guild id %q: %w", guildID, err)
+	}
+
+	return m.guildShard(id)
+}
+
+// guildShard returns the Shard of the current ShardGroup that receives
+// the events of a guild
+func (m *Manager) guildShard(guildID snowflake.ID) (shard *Shard, err error) {
+	m.ShardGroupsMu.Lock()
+	sg, ok := m.ShardGroups[int(atomic.LoadInt64(m.ShardGroupsCounter))%m.MaxShardGroups]
+	m.ShardGroupsMu.Unlock()
+	if !ok || sg.ShardCount == 0 {
+		return nil, ErrNoShard
+	}
+
+	return sg.shard(guildShardID(guildID, sg.ShardCount))
+}
+
+// currentShard returns the Shard of the current ShardGroup with the id
+func (m *Manager) currentShard(shardID int) (shard *Shard, err error) {
+	m.ShardGroupsMu.Lock()
+	sg, ok := m.ShardGroups[int(atomic.LoadInt64(m.ShardGroupsCounter))%m.MaxShardGroups]
+	m.ShardGroupsMu.Unlock()
+	if !ok {
+		return nil, ErrNoShard
+	}
+
+	return sg.shard(shardID)
+}
+
+// shard returns the Shard of the ShardGroup with the id
+func (sg *ShardGroup) shard(shardID int) (shard *Shard, err error) {
+	sg.ShardsMu.Lock()
+	shard, ok := sg.Shards[shardID]
+	sg.ShardsMu.Unlock()
+	if !ok {
+		return nil, ErrNoShard
+	}
+	return
+}
+
+// guildShardID returns the id of the Shard that receives the events of
+// a guild with the given shard count
+func guildShardID(guildID snowflake.ID, shardCount int) int {
+	return int((int64(guildID) >> 22) % int64(shardCount))
+}
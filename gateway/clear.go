@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"sync/atomic"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+	"github.com/go-redis/redis/v8"
+)
+
+// clearScanCount is how many fields are requested each HSCAN when
+// clearing the state
+const clearScanCount = 1000
+
+// clearGuildScript removes a guild and everything stored for it at once
+// so consumers never see a partially cleared guild. KEYS are the guilds,
+// membercounts, channels and emojis hashes followed by the members,
+// roles, voicestates and presences of the guild. ARGV is the guild id,
+// the number of channels then the channel ids and emoji ids.
+var clearGuildScript = redis.NewScript(`
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+local channels = tonumber(ARGV[2])
+for i = 3, 2 + channels do redis.call("HDEL", KEYS[3], ARGV[i]) end
+for i = 3 + channels, #ARGV do redis.call("HDEL", KEYS[4], ARGV[i]) end
+redis.call("DEL", KEYS[5], KEYS[6], KEYS[7], KEYS[8])
+return 1`)
+
+// removeMutualsScript removes a guild from the mutuals of users and
+// removes the users that no longer share a guild with the bot. KEYS are
+// the users hash followed by the mutuals of each user. ARGV is the guild
+// id followed by the user id of each mutuals key.
+var removeMutualsScript = redis.NewScript(`
+for i = 2, #KEYS do
+	redis.call("SREM", KEYS[i], ARGV[1])
+	if redis.call("SCARD", KEYS[i]) == 0 then redis.call("HDEL", KEYS[1], ARGV[i]) end
+end
+return #KEYS - 1`)
+
+// ClearOwnedCache removes the guilds that belong to the Shards of the
+// current ShardGroup from the state along with their channels, emojis,
+// members, roles, voice states and presences. Unlike ClearKeys, guilds
+// of other clusters sharing the same prefix are left alone. If
+// StoreMutuals is enabled, the guilds are removed from the mutuals of
+// their members and users without any mutuals left are removed.
+func (m *Manager) ClearOwnedCache() (guilds int, err error) {
+	m.ShardGroupsMu.Lock()
+	sg, ok := m.ShardGroups[int(atomic.LoadInt64(m.ShardGroupsCounter))%m.MaxShardGroups]
+	m.ShardGroupsMu.Unlock()
+	if !ok || sg.ShardCount == 0 {
+		return 0, ErrNoShard
+	}
+
+	return m.clearShards(sg.ShardIDs, sg.ShardCount)
+}
+
+// bootClear clears the state of the Shards this cluster will run before
+// they are started so guilds the bot was removed from whilst offline do
+// not linger. The whole Prefix is only cleared if ClearAllOnStart is
+// enabled. Failing to clear is logged as the Shards will still correct
+// the state as guilds are received.
+func (m *Manager) bootClear(shardCount int) {
+	if m.Configuration.Redis.ClearAllOnStart {
+		removed, err := rediScripts.ClearKeys(m.keys().key("*"), m)
+		if err != nil {
+			m.log.Warn().Err(err).Msg("Failed to clear the cache")
+			return
+		}
+
+		m.log.Info().Int64("keys", removed).Msg("Cleared the cache")
+		return
+	}
+
+	if _, err := m.clearShards(m.CreateShardIDs(shardCount), shardCount); err != nil {
+		m.log.Warn().Err(err).Msg("Failed to clear the cache of owned guilds")
+	}
+}
+
+// clearShards removes the guilds that belong to shardIDs from the state
+// and returns how many were removed
+func (m *Manager) clearShards(shardIDs []int, shardCount int) (guilds int, err error) {
+	owned := make(map[int]bool, len(shardIDs))
+	for _, shardID := range shardIDs {
+		owned[shardID] = true
+	}
+
+	var cursor uint64
+	var fields []string
+	for {
+		fields, cursor, err = m.RedisClient.HScan(m.ctx, m.keys().Guilds(), cursor, "", clearScanCount).Result()
+		if err != nil {
+			return
+		}
+
+		// HSCAN returns the fields and values one after the other
+		for i := 0; i+1 < len(fields); i += 2 {
+			guildID, err := snowflake.ParseString(fields[i])
+			if err != nil || !owned[guildShardID(guildID, shardCount)] {
+				continue
+			}
+
+			guild := &events.Guild{}
+			if err = json.UnmarshalFromString(fields[i+1], guild); err != nil {
+				return guilds, err
+			}
+
+			if err = m.clearGuild(guildID, guild); err != nil {
+				return guilds, err
+			}
+			guilds++
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	m.log.Info().Int("guilds", guilds).Ints("shards", shardIDs).Msg("Cleared cache of owned guilds")
+	return
+}
+
+// clearGuild removes a guild and everything stored for it from the state
+func (m *Manager) clearGuild(guildID snowflake.ID, guild *events.Guild) (err error) {
+	keys := m.keys()
+
+	if m.Features.StoreMutuals {
+		if err = m.clearMutuals(guildID); err != nil {
+			return
+		}
+	}
+
+	args := make([]interface{}, 0, 2+len(guild.Channels)+len(guild.Emojis))
+	args = append(args, guildID.String(), len(guild.Channels))
+	for _, channel := range guild.Channels {
+		args = append(args, channel.ID.String())
+	}
+	for _, emoji := range guild.Emojis {
+		args = append(args, emoji.ID.String())
+	}
+
+	return clearGuildScript.Run(m.ctx, m.RedisClient, []string{
+		keys.Guilds(),
+		keys.MemberCounts(),
+		keys.Channels(),
+		keys.Emojis(),
+		keys.Members(guildID),
+		keys.Roles(guildID),
+		keys.VoiceStates(guildID),
+		keys.Presences(guildID),
+	}, args...).Err()
+}
+
+// clearMutuals removes a guild from the mutuals of each of its cached
+// members in batches of clearScanCount
+func (m *Manager) clearMutuals(guildID snowflake.ID) (err error) {
+	keys := m.keys()
+
+	var cursor uint64
+	var userIDs []string
+	for {
+		userIDs, cursor, err = m.RedisClient.HScan(m.ctx, keys.Members(guildID), cursor, "", clearScanCount).Result()
+		if err != nil {
+			return
+		}
+
+		mutuals := []string{keys.Users()}
+		args := []interface{}{guildID.String()}
+		for i := 0; i < len(userIDs); i += 2 {
+			userID, err := snowflake.ParseString(userIDs[i])
+			if err != nil {
+				continue
+			}
+
+			mutuals = append(mutuals, keys.UserMutual(userID))
+			args = append(args, userIDs[i])
+		}
+
+		if len(mutuals) > 1 {
+			if err = removeMutualsScript.Run(m.ctx, m.RedisClient, mutuals, args...).Err(); err != nil {
+				return
+			}
+		}
+
+		if cursor == 0 {
+			return
+		}
+	}
+}
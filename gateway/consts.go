@@ -7,5 +7,15 @@ import (
 // VERSION of Sandwich-Producer, following Semantic Versioning.
 const VERSION = "0.1"
 
+// eventChannelSize is how many events can be waiting to be marshaled or
+// produced before Shards start to block.
+const eventChannelSize = 1024
+
+// The range of large_threshold Discord accepts when identifying
+const (
+	minLargeThreshold = 50
+	maxLargeThreshold = 250
+)
+
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 var rediScripts = RediScripts{}
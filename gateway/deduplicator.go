@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Deduplicator remembers events that have been seen within a window so
+// events Discord replays after a resume are not produced twice. Events
+// are identified by their type, the Shard and sequence they were
+// received with and the id of the object they are for. Replayed events
+// keep their sequence so events that are sent again, such as a reaction
+// being added after it was removed, are still produced.
+type Deduplicator struct {
+	window time.Duration
+	limit  int
+
+	mu    sync.Mutex
+	seen  map[uint64]time.Time
+	queue []uint64
+}
+
+// NewDeduplicator creates a Deduplicator. Events are remembered for the
+// window duration and at most limit events will be remembered at once,
+// forgetting the oldest first.
+func NewDeduplicator(window time.Duration, limit int) *Deduplicator {
+	return &Deduplicator{
+		window: window,
+		limit:  limit,
+		mu:     sync.Mutex{},
+		seen:   make(map[uint64]time.Time),
+		queue:  make([]uint64, 0, limit),
+	}
+}
+
+// Seen returns true if the event has already been seen within the
+// window. If it has not, it is remembered.
+func (d *Deduplicator) Seen(e Event) bool {
+	key := hashEvent(e)
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+
+	if len(d.queue) >= d.limit {
+		delete(d.seen, d.queue[0])
+		d.queue = d.queue[1:]
+	}
+
+	d.seen[key] = now
+	d.queue = append(d.queue, key)
+	return false
+}
+
+// Len returns how many events are currently remembered
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.queue)
+}
+
+// expire forgets any events that are older than the window. As the queue
+// is in order of when events were seen, we only need to check the front.
+func (d *Deduplicator) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.queue); i++ {
+		if now.Sub(d.seen[d.queue[i]]) < d.window {
+			break
+		}
+		delete(d.seen, d.queue[i])
+	}
+	d.queue = d.queue[i:]
+}
+
+// hashEvent returns the key of an event from its type, shard, sequence
+// and the id of the object it is for, if it has one
+func hashEvent(e Event) uint64 {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], uint64(e.ShardID))
+	binary.LittleEndian.PutUint64(b[8:], uint64(e.Sequence))
+
+	h := fnv.New64a()
+	h.Write([]byte(e.Type))
+	h.Write(b[:])
+	h.Write([]byte(json.Get(e.Data, "id").ToString()))
+	return h.Sum64()
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestDeduplicatorWithinWindow(t *testing.T) {
+	d := NewDeduplicator(time.Minute, 10)
+	e := Event{ShardID: 1, Sequence: 5, Type: "MESSAGE_CREATE", Data: jsoniter.RawMessage(`{"id":"1"}`)}
+
+	if d.Seen(e) {
+		t.Fatal("expected the first event to not be seen")
+	}
+	if !d.Seen(e) {
+		t.Fatal("expected a replayed event within the window to be seen")
+	}
+}
+
+func TestDeduplicatorOutsideWindow(t *testing.T) {
+	d := NewDeduplicator(10*time.Millisecond, 10)
+	e := Event{ShardID: 1, Sequence: 5, Type: "MESSAGE_CREATE", Data: jsoniter.RawMessage(`{"id":"1"}`)}
+
+	d.Seen(e)
+	time.Sleep(20 * time.Millisecond)
+
+	if d.Seen(e) {
+		t.Fatal("expected an event outside of the window to not be seen")
+	}
+	if d.Len() != 1 {
+		t.Fatalf("expected expired events to be forgotten, remembering %d", d.Len())
+	}
+}
+
+func TestDeduplicatorRepeatedEvents(t *testing.T) {
+	d := NewDeduplicator(time.Minute, 10)
+
+	// A reaction that is added, removed and added again has the same
+	// payload each time it is added but a different sequence.
+	reaction := jsoniter.RawMessage(`{"user_id":"1","message_id":"2","emoji":{"name":"a"}}`)
+	events := []Event{
+		{ShardID: 0, Sequence: 1, Type: "MESSAGE_REACTION_ADD", Data: reaction},
+		{ShardID: 0, Sequence: 2, Type: "MESSAGE_REACTION_REMOVE", Data: reaction},
+		{ShardID: 0, Sequence: 3, Type: "MESSAGE_REACTION_ADD", Data: reaction},
+		{ShardID: 1, Sequence: 3, Type: "MESSAGE_REACTION_ADD", Data: reaction},
+	}
+
+	for _, e := range events {
+		if d.Seen(e) {
+			t.Errorf("expected %s with sequence %d on shard %d to not be seen", e.Type, e.Sequence, e.ShardID)
+		}
+	}
+}
+
+func TestDeduplicatorLimit(t *testing.T) {
+	d := NewDeduplicator(time.Minute, 2)
+
+	for seq := int64(1); seq <= 3; seq++ {
+		d.Seen(Event{Sequence: seq, Type: "TYPING_START"})
+	}
+
+	if d.Len() != 2 {
+		t.Fatalf("expected 2 events to be remembered, remembering %d", d.Len())
+	}
+	if d.Seen(Event{Sequence: 1, Type: "TYPING_START"}) {
+		t.Error("expected the oldest event to have been forgotten")
+	}
+}
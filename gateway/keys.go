@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// RedisKeys builds the keys of the state in redis. Every read and write
+// to redis goes through it so the layout is only defined here and
+// consumers sharing the cache can use it to find the same keys. Every
+// key starts with the Prefix.
+//
+//	{PREFIX}:guilds                          hash of guild id to guild
+//	{PREFIX}:channels                        hash of channel id to channel
+//	{PREFIX}:users                           hash of user id to user
+//	{PREFIX}:emojis                          hash of emoji id to emoji
+//	{PREFIX}:membercounts                    hash of guild id to member count
+//	{PREFIX}:prefix                          hash of guild id to prefixes
+//	{PREFIX}:deadletter                      list of unpublished events
+//	{PREFIX}:memberlru                       sorted set of members by last use
+//	{PREFIX}:guild:{GUILD_ID}:members        hash of user id to member
+//	{PREFIX}:guild:{GUILD_ID}:roles          hash of role id to role
+//	{PREFIX}:guild:{GUILD_ID}:voicestates    hash of user id to voice state
+//	{PREFIX}:guild:{GUILD_ID}:presences      hash of user id to presence
+//	{PREFIX}:user:{USER_ID}:mutuals          set of guild ids
+type RedisKeys struct {
+	Prefix string
+}
+
+// keys returns the RedisKeys of the configured Redis.Prefix
+func (m *Manager) keys() RedisKeys {
+	return RedisKeys{Prefix: m.Configuration.Redis.Prefix}
+}
+
+func (rk RedisKeys) key(name string) string {
+	return fmt.Sprintf("%s:%s", rk.Prefix, name)
+}
+
+func (rk RedisKeys) guild(guildID snowflake.ID, name string) string {
+	return fmt.Sprintf("%s:guild:%s:%s", rk.Prefix, guildID, name)
+}
+
+// Guilds is the hash of every guild
+func (rk RedisKeys) Guilds() string {
+	return rk.key("guilds")
+}
+
+// Channels is the hash of every channel
+func (rk RedisKeys) Channels() string {
+	return rk.key("channels")
+}
+
+// Users is the hash of every user
+func (rk RedisKeys) Users() string {
+	return rk.key("users")
+}
+
+// Emojis is the hash of every emoji
+func (rk RedisKeys) Emojis() string {
+	return rk.key("emojis")
+}
+
+// MemberCounts is the hash storing the MemberCount of every guild with
+// the key being the guild id
+func (rk RedisKeys) MemberCounts() string {
+	return rk.key("membercounts")
+}
+
+// Prefixes is the hash of the comma separated prefixes of every guild
+func (rk RedisKeys) Prefixes() string {
+	return rk.key("prefix")
+}
+
+// DeadLetter is the list of events that failed to publish
+func (rk RedisKeys) DeadLetter() string {
+	return rk.key("deadletter")
+}
+
+// MemberLRU is the sorted set of cached members by when they were last
+// used when MemberLRUSize is set
+func (rk RedisKeys) MemberLRU() string {
+	return rk.key("memberlru")
+}
+
+// Members is the hash of the members of a guild
+func (rk RedisKeys) Members(guildID snowflake.ID) string {
+	return rk.guild(guildID, "members")
+}
+
+// Roles is the hash of the roles of a guild
+func (rk RedisKeys) Roles(guildID snowflake.ID) string {
+	return rk.guild(guildID, "roles")
+}
+
+// VoiceStates is the hash of the voice states of a guild
+func (rk RedisKeys) VoiceStates(guildID snowflake.ID) string {
+	return rk.guild(guildID, "voicestates")
+}
+
+// Presences is the hash of the presences of a guild
+func (rk RedisKeys) Presences(guildID snowflake.ID) string {
+	return rk.guild(guildID, "presences")
+}
+
+// UserMutual is the set of guilds a user shares with the bot
+func (rk RedisKeys) UserMutual(userID snowflake.ID) string {
+	return fmt.Sprintf("%s:user:%s:mutuals", rk.Prefix, userID)
+}
@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/bwmarrin/snowflake"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestRedisKeys(t *testing.T) {
+	rk := RedisKeys{Prefix: "welcomer"}
+
+	for key, expected := range map[string]string{
+		rk.Guilds():                     "welcomer:guilds",
+		rk.Channels():                   "welcomer:channels",
+		rk.Users():                      "welcomer:users",
+		rk.Emojis():                     "welcomer:emojis",
+		rk.MemberCounts():               "welcomer:membercounts",
+		rk.Prefixes():                   "welcomer:prefix",
+		rk.DeadLetter():                 "welcomer:deadletter",
+		rk.MemberLRU():                  "welcomer:memberlru",
+		rk.Members(snowflake.ID(1)):     "welcomer:guild:1:members",
+		rk.Roles(snowflake.ID(1)):       "welcomer:guild:1:roles",
+		rk.VoiceStates(snowflake.ID(1)): "welcomer:guild:1:voicestates",
+		rk.Presences(snowflake.ID(1)):   "welcomer:guild:1:presences",
+		rk.UserMutual(snowflake.ID(2)):  "welcomer:user:2:mutuals",
+	} {
+		if key != expected {
+			t.Errorf("expected %s, got %s", expected, key)
+		}
+	}
+}
+
+func TestRedisKeysRoundTrip(t *testing.T) {
+	m, mr := testRedisManager(t)
+	m.Features.CacheMembers = true
+	m.Features.StoreMutuals = true
+
+	_, _, err := guildCreateMarshaler(m, Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{
+		"id":"1","name":"a","member_count":1,
+		"channels":[{"id":"2","type":0,"name":"general"}],
+		"emojis":[{"id":"3","name":"b"}],
+		"roles":[{"id":"1","name":"@everyone"}],
+		"members":[{"user":{"id":"4","username":"c","discriminator":"0001","avatar":""},"roles":[]}]
+	}`)})
+	if err != nil {
+		t.Fatalf("failed to create guild: %v", err)
+	}
+
+	// Everything the marshaler saved is under the documented keys
+	keys := m.keys()
+	expected := []string{
+		keys.Guilds(),
+		keys.Channels(),
+		keys.Users(),
+		keys.Emojis(),
+		keys.MemberCounts(),
+		keys.Members(snowflake.ID(1)),
+		keys.Roles(snowflake.ID(1)),
+		keys.UserMutual(snowflake.ID(4)),
+	}
+	sort.Strings(expected)
+
+	saved := mr.Keys()
+	if len(saved) != len(expected) {
+		t.Fatalf("expected the keys %v, got %v", expected, saved)
+	}
+	for i := range expected {
+		if saved[i] != expected[i] {
+			t.Fatalf("expected the keys %v, got %v", expected, saved)
+		}
+	}
+
+	// and can be read back by the Manager
+	if guild, err := m.getGuild(snowflake.ID(1)); err != nil || guild.Name != "a" || guild.MemberCount != 1 {
+		t.Errorf("failed to get guild: %+v %v", guild, err)
+	}
+	if channel, err := m.getChannel(snowflake.ID(2)); err != nil || channel.Name != "general" {
+		t.Errorf("failed to get channel: %+v %v", channel, err)
+	}
+	if emoji, err := m.getEmoji(snowflake.ID(3)); err != nil || emoji.Name != "b" {
+		t.Errorf("failed to get emoji: %+v %v", emoji, err)
+	}
+	if role, err := m.getRole(snowflake.ID(1), snowflake.ID(1)); err != nil || role.Name != "@everyone" {
+		t.Errorf("failed to get role: %+v %v", role, err)
+	}
+	if user, err := m.getUser(snowflake.ID(4)); err != nil || user.Username != "c" {
+		t.Errorf("failed to get user: %+v %v", user, err)
+	}
+	if _, err := m.lookupMember(snowflake.ID(1), snowflake.ID(4)); err != nil {
+		t.Errorf("failed to get member: %v", err)
+	}
+}
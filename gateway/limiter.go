@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -54,47 +55,50 @@ type DurationLimiter interface {
 
 // DefaultLimiter is the default limiter object
 type DefaultLimiter struct {
-	limit    *int32
-	duration *int64
+	mu sync.Mutex
 
-	resetsAt  *int64
-	available *int32
+	limit    int32
+	duration time.Duration
+
+	resetsAt  time.Time
+	available int32
 }
 
 // NewDurationLimiter creates a DurationLimiter. This is useful for allowing
 // a specific operation to run only X ammount of times in a duration of Y.
 func NewDurationLimiter(limit int32, duration time.Duration) (bs DurationLimiter) {
-	nanos := duration.Nanoseconds()
 	bs = &DefaultLimiter{
-		limit:    &limit,
-		duration: &nanos,
-
-		resetsAt:  new(int64),
-		available: new(int32),
+		mu:       sync.Mutex{},
+		limit:    limit,
+		duration: duration,
 	}
 	return bs
 }
 
-// Lock waits until there is an available slot in the Limiter
+// Lock waits until there is an available slot in the Limiter. Callers
+// are let through one at a time so if more than limit callers are
+// waiting, the rest will wait for the next duration.
 func (l *DefaultLimiter) Lock() {
-	now := time.Now().UnixNano()
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	// If we have surpassed the resetAt, then make a new resetAt and free
-	// up available
-	if atomic.LoadInt64(l.resetsAt) <= now {
-		atomic.StoreInt64(l.resetsAt, now+atomic.LoadInt64(l.duration))
-		atomic.StoreInt32(l.available, atomic.LoadInt32(l.limit))
-	}
+	for {
+		now := time.Now()
 
-	if atomic.LoadInt32(l.available) <= 0 {
-		// This on its own can create a race condition if 2 routines are
-		// waiting simultaneously. In order to not make this occur, we
-		// must call the lock again to make sure.
-		time.Sleep(time.Duration(atomic.LoadInt64(l.resetsAt) - now))
-		l.Lock()
-		return
-	}
+		// If we have surpassed the resetAt, then make a new resetAt and
+		// free up available
+		if !now.Before(l.resetsAt) {
+			l.resetsAt = now.Add(l.duration)
+			l.available = l.limit
+		}
 
-	atomic.AddInt32(l.available, -1)
-	return
+		if l.available > 0 {
+			l.available--
+			return
+		}
+
+		// As we hold the lock whilst sleeping, no other caller can take
+		// the slot that frees up once we wake up.
+		time.Sleep(l.resetsAt.Sub(now))
+	}
 }
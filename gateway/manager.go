@@ -5,7 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TheRockettek/Sandwich-Producer/client"
@@ -26,8 +31,45 @@ var ErrInvalidTokenPassed = errors.New("invalid token was passed")
 // is smaller than the Shards reminaining to be deployed. This is provided for safety.
 var ErrNotEnoughSessions = errors.New("not enough sesssions remaining to start manager")
 
+// ErrInvalidGateway is returned when /gateway/bot returns a response
+// that cannot be used
+var ErrInvalidGateway = errors.New("invalid /gateway/bot response")
+
+// ErrInvalidConfiguration is returned by Configuration.Validate along with
+// every problem found
+var ErrInvalidConfiguration = errors.New("invalid configuration")
+
+// ErrAlreadyScaling is returned when scaling whilst a previous scale has
+// not finished.
+var ErrAlreadyScaling = errors.New("manager is already scaling")
+
 type void struct{}
 
+// The ways events in direct messages can be handled
+const (
+	DirectMessagesProduce = "produce"
+	DirectMessagesCache   = "cache"
+	DirectMessagesIgnore  = "ignore"
+)
+
+// The orders Shards can be spawned in
+const (
+	// SpawnOrderSequential spawns Shards in order of their ids
+	SpawnOrderSequential = "sequential"
+
+	// SpawnOrderBucket spawns one Shard from each identify bucket at a
+	// time which can reduce startup time when max_concurrency is above 1
+	SpawnOrderBucket = "bucket"
+)
+
+// The transport compressions Shards can use
+const (
+	TransportCompressionZlib = "zlib-stream"
+	TransportCompressionZstd = "zstd-stream"
+)
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
 // Manager is used to handle all shards
 type Manager struct {
 	Token string
@@ -39,16 +81,83 @@ type Manager struct {
 	ShardGroupsCounter *int64
 	MaxShardGroups     int
 
+	// scaling is 1 whilst a ShardGroup is being started
+	scaling *int32
+
+	autoScalerMu   sync.Mutex
+	autoScalerStop chan void
+
+	reconcilerMu   sync.Mutex
+	reconcilerStop chan void
+
+	ttlRefresherMu   sync.Mutex
+	ttlRefresherStop chan void
+
+	// chunks stores a channel for each ChunkGuild request by its nonce
+	// which is closed once the last chunk has been received
+	chunksMu   sync.Mutex
+	chunks     map[string]chan void
+	chunkNonce *int64
+
+	// abnormalClosures is how many times Shards have been disconnected
+	// without a close frame
+	abnormalClosures *int64
+
+	// received and produced are how many events have been received from
+	// Shards and produced to NATS Streaming
+	received *int64
+	produced *int64
+	rate     metricsRate
+	metrics  *prometheusMetrics
+
+	// pending is how many events have been received by Shards but have
+	// not yet been produced or dropped
+	pending *int64
+
+	// droppedOversized is how many messages have been dropped for being
+	// larger than MaxEventSize
+	droppedOversized *int64
+
 	// Limiter for Identify ratelimits and ConcurrentClients ratelimit
 	ReadyLimiter *ConcurrencyLimiter
 
 	// The HTTP client used for REST requests
 	Client *client.Client
 
-	RedisClient *redis.Client
+	RedisClient *RedisClient
 	NatsClient  *nats.Conn
-	StanClient  stan.Conn
-	ctx         context.Context
+
+	// ctx is cancelled once the Manager has closed
+	ctx    context.Context
+	cancel func()
+
+	// Producer is what events are published to, either redis streams,
+	// NATS Streaming or JetStream depending on Configuration.Producer
+	// and Configuration.Nats.Mode
+	Producer Producer
+
+	// StanClient is replaced when NATS reconnects so should be accessed
+	// with Stan()
+	StanClient stan.Conn
+	stanMu     sync.RWMutex
+
+	// stanHealthy is 1 whilst the STAN connection is usable and
+	// stanReconnecting is 1 whilst it is being recreated
+	stanHealthy      *int32
+	stanReconnecting *int32
+	natsReconnects   *int64
+
+	// presence is the last presence passed to UpdatePresence and
+	// shardPresences are the presences passed to UpdateShardPresence
+	// since, which Shards will identify with
+	presence       *events.UpdateStatus
+	shardPresences map[int]events.UpdateStatus
+	presenceMu     sync.RWMutex
+
+	// BotUser is the bot's user which is set once a Shard has received
+	// READY. Use Self to read it.
+	BotUser   *events.User
+	BotUserMu sync.RWMutex
 
 	Features      Features
 	Configuration Configuration
@@ -58,6 +167,25 @@ type Manager struct {
 
 	// Buckets will store a map that stores the different limiters
 	Buckets *BucketStore
+
+	// identifyLocks stores a limiter for each identify bucket
+	identifyLocks   map[int]*ConcurrencyLimiter
+	identifyLocksMu sync.Mutex
+
+	// eventChannel receives dispatches from Shards which are then
+	// marshaled and passed onto produceChannel to be produced.
+	eventChannel   chan Event
+	produceChannel chan StreamEvent
+
+	// Deduplicator is nil if events are not being deduplicated
+	Deduplicator *Deduplicator
+
+	cacheStats cacheStats
+
+	// ready is closed once every Shard of the first ShardGroup has
+	// produced SHARD_READY
+	ready     chan void
+	readyOnce sync.Once
 }
 
 // Features allows for tweaking extra features normally not available
@@ -67,26 +195,91 @@ type Features struct {
 	//recommended to be enabled but not necessary.
 	CacheMembers bool `json:"cache_members"`
 
+	// MemberLRUSize will cache members on demand instead of caching every
+	// member. When a member that is not cached is needed, it is fetched
+	// from the API and cached. Once more than MemberLRUSize members are
+	// cached, the least recently used are removed. Use is tracked in the
+	// sorted set {REDIS_PREFIX}:memberlru. If 0, members are only cached
+	// with CacheMembers.
+	MemberLRUSize int `json:"member_lru_size"`
+
 	// StoreMutuals will create a set within the state to store all guilds
 	//the member can currently be seen on. This is useful for specific
 	//circumstances but it is recommended to still use the oauth flow to
 	//request guilds on a web dashboard, for instance. Mutuals will not be
-	// stored for bots.
+	// stored for bots. Mutuals are stored in the set
+	// {REDIS_PREFIX}:user:{USER_ID}:mutuals.
 	StoreMutuals bool `json:"store_mutuals"`
 
 	// IgnoreBots will not pass events that belong to bots so you do not
 	//have to deal with events that are likely to be ignored anyway.
+	// This enables IgnoreBotMessages, IgnoreBotMembers and
+	// IgnoreBotPresences which can instead be enabled individually.
 	IgnoreBots bool `json:"ignore_bots"`
 
+	// IgnoreBotMessages will not pass MESSAGE_CREATE and TYPING_START
+	// from bots.
+	IgnoreBotMessages bool `json:"ignore_bot_messages"`
+
+	// IgnoreBotMembers will not pass GUILD_MEMBER_ADD and
+	// GUILD_MEMBER_REMOVE for bots. The member is still cached.
+	IgnoreBotMembers bool `json:"ignore_bot_members"`
+
+	// IgnoreBotPresences will not pass PRESENCE_UPDATE for bots.
+	IgnoreBotPresences bool `json:"ignore_bot_presences"`
+
 	// CheckPrefix allows to ignore events that do not have a specific
 	// prefix. When MESSAGE_CREATE is seen, the hashset
 	// {REDIS_PREFIX}:prefix with the key being the guild id and if there
 	// is an element present, if the message does not start with the
-	// prefix, the message will not be forwarded. If CheckPrefixMention
-	// is true, it will also pass messages if they mention the bot instead
-	// of the prefix.
+	// prefix, the message will not be forwarded. A guild can have several
+	// prefixes by separating them with commas such as !,?. If
+	// CheckPrefixMention is true, it will also pass messages if they
+	// mention the bot instead of the prefix.
 	CheckPrefix        bool `json:"check_prefix"`
 	CheckPrefixMention bool `json:"check_prefix_mention"`
+
+	// DefaultPrefix is used by CheckPrefix for guilds that do not have a
+	// prefix in {REDIS_PREFIX}:prefix. This can also be several prefixes
+	// separated by commas. If empty, messages in guilds without a prefix
+	// are always passed.
+	DefaultPrefix string `json:"default_prefix"`
+
+	// CheckPrefixCaseInsensitive will ignore case when checking the
+	// prefix so a prefix of !help would also match !Help.
+	CheckPrefixCaseInsensitive bool `json:"check_prefix_case_insensitive"`
+
+	// DirectMessages is how MESSAGE_CREATE and CHANNEL_CREATE events in
+	// direct messages are handled. DirectMessagesProduce will cache and
+	// produce them, DirectMessagesCache will only cache the channel and
+	// DirectMessagesIgnore will ignore them entirely which is useful for
+	// bots that only work in guilds. Defaults to DirectMessagesProduce.
+	DirectMessages string `json:"direct_messages"`
+
+	// CachePresences will store the presences included in
+	// GUILD_MEMBERS_CHUNK and PRESENCE_UPDATE in the hash
+	// {REDIS_PREFIX}:guild:{GUILD_ID}:presences with the key being the
+	// user id. Presences are removed once users go offline. Both require
+	// the GUILD_PRESENCES intent and chunks only include presences if
+	// they were requested.
+	CachePresences bool `json:"cache_presences"`
+
+	// RefreshMembersOnAvailable will request every member of a guild when
+	// it becomes available again after an outage as member updates
+	// during the outage are missed. This requires CacheMembers and the
+	// GUILD_MEMBERS intent.
+	RefreshMembersOnAvailable bool `json:"refresh_members_on_available"`
+
+	// IgnoreShardEvents will not produce SHARD_READY, SHARD_RESUMED,
+	// SHARD_CONNECT and SHARD_DISCONNECT. These are useful for monitoring
+	// but can be noise for consumers that only handle Discord events.
+	IgnoreShardEvents bool `json:"ignore_shard_events"`
+
+	// CacheVoiceStates will store the voice states of users in the hash
+	// {REDIS_PREFIX}:guild:{GUILD_ID}:voicestates with the key being the
+	// user id. This also allows VOICE_STATE_UPDATE to include the
+	// previous voice state of the user.
+	CacheVoiceStates bool `json:"cache_voice_states"`
 }
 
 // Configuration stores the clients and any other configurations that is
@@ -109,21 +302,146 @@ type Configuration struct {
 	AutoSharded bool `json:"autoshard"`
 	ShardCount  int  `json:"shard_count"`
 
+	// SpawnOrder is either SpawnOrderSequential or SpawnOrderBucket.
+	// Defaults to SpawnOrderSequential.
+	SpawnOrder string `json:"spawn_order"`
+
 	ClusterCount int `json:"cluster_count"`
 	ClusterID    int `json:"cluster_id"`
 
+	// ShardIDs pins the shards this process will run instead of splitting
+	// the shards between ClusterCount clusters. Shard ids that are not
+	// below the shard count are ignored.
+	ShardIDs []int `json:"shard_ids"`
+
 	Redis struct {
 		Address  string `json:"address"`
 		Password string `json:"password"`
 		Database int    `json:"database"`
 		Prefix   string `json:"prefix"`
+
+		// MaxBufferedWrites is the ammount of critical writes that will
+		// be held whilst redis is unavailable. Defaults to 1000.
+		MaxBufferedWrites int `json:"max_buffered_writes"`
+
+		// StreamMaxLen is roughly how many events each stream keeps when
+		// using the redis Producer. If 0, streams are not trimmed.
+		StreamMaxLen int64 `json:"stream_max_len"`
+
+		// CacheTTL is how many seconds the members, roles, voice states
+		// and presences of a guild are kept after they were last written.
+		// The TTLs of guilds the Shards have are renewed every half of
+		// CacheTTL so only guilds the bot was removed from without a
+		// GUILD_DELETE expire. Guilds, channels, users and emojis share a
+		// hash between guilds so they do not expire. If 0, nothing expires.
+		CacheTTL int `json:"cache_ttl"`
+
+		// ClearAllOnStart will remove every key under the Prefix when the
+		// Manager is opened. By default only the guilds of the Shards this
+		// cluster will run are cleared as other clusters sharing the
+		// Prefix still rely on theirs.
+		ClearAllOnStart bool `json:"clear_all_on_start"`
 	} `json:"redis"`
 
+	// Encoding is how events are encoded when produced. This can be
+	// "msgpack" or "json" which is easier to consume from languages
+	// without a msgpack library. Both encode StreamEvent as {"t": type,
+	// "d": data} using the json field names. The encoding is stamped in
+	// the Encoding header with JetStream and the Encoding field with
+	// redis. Defaults to msgpack.
+	Encoding string `json:"encoding"`
+
+	// Producer is where events are produced to. This can be "nats" to
+	// publish to NATS using Nats.Mode or "redis" to add events to redis
+	// streams. When using redis, events are added to a stream with the
+	// key of the subject they would have been published to and NATS is
+	// not used. Defaults to nats.
+	Producer string `json:"producer"`
+
 	Nats struct {
 		Address   string `json:"address"`
 		Channel   string `json:"channel"`
 		ClusterID string `json:"cluster"`
 		ClientID  string `json:"client"`
+
+		// Mode is the backend events are produced to. This can be "stan"
+		// to use NATS Streaming or "jetstream" to publish to the JetStream
+		// Stream. NATS Streaming is deprecated so new deployments should
+		// use jetstream. Defaults to stan. ClusterID and ClientID are only
+		// used by stan and Stream is only used by jetstream. Stream
+		// defaults to the uppercased Channel and is created if missing.
+		Mode   string `json:"mode"`
+		Stream string `json:"stream"`
+
+		// STAN requires client ids to be unique so a random suffix is
+		// added to the ClientID. ClientIDRetries is how many times a new
+		// suffix will be tried if the client id is already registered.
+		// Defaults to 3.
+		ClientIDRetries int `json:"client_id_retries"`
+
+		// SubjectPerType publishes events to a subject for each event type
+		// in the form of channel.TYPE, such as welcomer.MESSAGE_CREATE,
+		// instead of just the channel. This allows consumers to only
+		// subscribe to the events they need or use wildcards such as
+		// welcomer.>.
+		SubjectPerType bool `json:"subject_per_type"`
+
+		// NATS Streaming only preserves order within a subject and
+		// asynchronous publishes may complete out of order. StrictOrdering
+		// forces a single subject and waits for every publish to be
+		// acknowledged before producing the next event. This greatly
+		// reduces throughput so should only be used if consumers rely on
+		// the order of events across event types.
+		StrictOrdering bool `json:"strict_ordering"`
+
+		// AckMode is how publishes are acknowledged. "sync" waits for
+		// every publish to be acknowledged before producing the next
+		// event, "async" publishes without waiting and dead letters events
+		// that fail once acknowledged and "none" publishes with core NATS
+		// without any acknowledgement so events that fail to be stored
+		// are lost. Failed acknowledgements of async are counted in
+		// sandwich_publish_ack_failures_total. Defaults to sync as the
+		// asynchronous modes trade ordering and delivery for throughput.
+		AckMode string `json:"ack_mode"`
+
+		// PublishRetries is how many times a failed publish is retried
+		// before the event is added to the {REDIS_PREFIX}:deadletter list.
+		// The first retry waits PublishBackoff milliseconds which doubles
+		// every retry. Defaults to 3 retries and 100 milliseconds.
+		PublishRetries int `json:"publish_retries"`
+		PublishBackoff int `json:"publish_backoff"`
+
+		// PublishAckWait is how many milliseconds to wait for a publish to
+		// be acknowledged before it has failed and MaxPublishesInflight is
+		// how many asynchronous publishes can be waiting for an
+		// acknowledgement before publishing blocks. If 0, the defaults of
+		// the NATS Streaming or JetStream client are used.
+		PublishAckWait       int `json:"publish_ack_wait"`
+		MaxPublishesInflight int `json:"max_publishes_inflight"`
+
+		// Credentials used to connect to secured NATS servers. Only one
+		// of Username and Password, Token, NKeySeedFile or
+		// CredentialsFile should be set. CredentialsFile is a .creds file
+		// containing a user JWT and nkey seed.
+		Username        string `json:"username"`
+		Password        string `json:"password"`
+		Token           string `json:"token"`
+		NKeySeedFile    string `json:"nkey_seed_file"`
+		CredentialsFile string `json:"credentials_file"`
+
+		// TLS is used if any of the files are set. RootCAFile verifies the
+		// server and CertFile and KeyFile are used as the client
+		// certificate.
+		TLS struct {
+			RootCAFile string `json:"root_ca_file"`
+			CertFile   string `json:"cert_file"`
+			KeyFile    string `json:"key_file"`
+		} `json:"tls"`
+
+		// MaxReconnects is how many times NATS will try to reconnect
+		// before giving up. The STAN connection is recreated once NATS
+		// has reconnected. If 0 or less, NATS will reconnect forever.
+		MaxReconnects int `json:"max_reconnects"`
 	} `json:"nats"`
 
 	// We will be using EventBlacklist for Sessions but we retrieve from
@@ -151,10 +469,64 @@ type Configuration struct {
 	EventBlacklist       map[string]void
 	EventBlacklistValues []string `json:"event_blacklist"`
 
+	// ProduceBlacklist events are still marshaled and cached but are not
+	// produced, unlike EventBlacklist events which are ignored entirely.
+	// High traffic events that most bots have no use for, such as
+	// TYPING_START and PRESENCE_UPDATE, are good candidates.
 	ProduceBlacklist       map[string]void
 	ProduceBlacklistValues []string `json:"produce_blacklist"`
 
-	// Global Shard Identify Options
+	// GuildAllowlist will only allow events from the guilds specified to
+	// be handled. Unlike the ProduceBlacklist, events from other guilds
+	// are ignored before they are marshaled so they will not be cached
+	// either. This is useful for debugging or partial deployments. Events
+	// that do not belong to a guild, such as READY, are always handled.
+	// If empty, events from all guilds are handled.
+	GuildAllowlist       map[string]void
+	GuildAllowlistValues []string `json:"guild_allowlist"`
+
+	// DeduplicationWindow is how many seconds events are remembered for
+	// in order to not produce events Discord replays after a resume more
+	// than once. At most DeduplicationLimit events are remembered at a
+	// time which defaults to 10000. If 0, events are not deduplicated.
+	DeduplicationWindow int `json:"deduplication_window"`
+	DeduplicationLimit  int `json:"deduplication_limit"`
+
+	// ResumeWindow is how many seconds after a Shard resumes that
+	// GUILD_UPDATE, CHANNEL_UPDATE and GUILD_ROLE_UPDATE events which do
+	// not change the cached object are not produced. Discord can replay
+	// full objects after a resume which would otherwise flood consumers
+	// with updates that changed nothing. If 0, these are always produced.
+	ResumeWindow int `json:"resume_window"`
+
+	// ShutdownTimeout is how many seconds Close will wait for Shards to
+	// produce the events they have received before closing them anyway.
+	// Defaults to 10.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+
+	// MaxEventSize is the maximum size in bytes a message received from
+	// Discord can be once decompressed. Larger messages are dropped and
+	// logged. If 0, there is no limit.
+	MaxEventSize int `json:"max_event_size"`
+
+	// GuildLoadTimeout is how many seconds a Shard will wait to receive
+	// another guild sent in READY before producing SHARD_READY without
+	// the guilds that are still unavailable. Defaults to 30.
+	GuildLoadTimeout int `json:"guild_load_timeout"`
+
+	// ReconcileInterval is how many seconds between fetching every
+	// available guild from the API and correcting the cache if it has
+	// drifted, such as from missed events. Corrections are produced as
+	// GUILD_RECONCILE. If 0, the cache is not reconciled.
+	ReconcileInterval int `json:"reconcile_interval"`
+
+	// TransportCompression is either TransportCompressionZlib or
+	// TransportCompressionZstd. If empty, the transport is only compressed
+	// with zlib-stream when Compression is enabled.
+	TransportCompression string `json:"transport_compression"`
+
+	// Global Shard Identify Options. Compression enables the zlib-stream
+	// transport compression rather than compressing individual payloads.
 	Compression        bool             `json:"compression"`
 	LargeThreshold     int              `json:"large_threshold"`
 	DefaultPresence    *events.Activity `json:"default_activity"`
@@ -162,14 +534,96 @@ type Configuration struct {
 	Intents            int              `json:"intents"`
 }
 
+// Validate returns an error listing every setting that is missing,
+// unknown, conflicts with another or would stop events from being
+// produced. Settings that have defaults are only checked if they are set.
+func (c Configuration) Validate() (err error) {
+	return c.ValidateWithFeatures(Features{})
+}
+
+// ValidateWithFeatures is Validate but also checks the settings the
+// features rely on.
+func (c Configuration) ValidateWithFeatures(features Features) (err error) {
+	problems := make([]string, 0)
+
+	if c.Token == "" {
+		problems = append(problems, ErrNoTokenProvided.Error())
+	}
+
+	if c.ShardCount < 0 {
+		problems = append(problems, "shard_count must not be negative")
+	}
+
+	if c.AutoSharded && c.ShardCount > 0 {
+		problems = append(problems, "shard_count must be 0 when autoshard is enabled")
+	}
+
+	if c.ClusterCount < 0 {
+		problems = append(problems, "cluster_count must not be negative")
+	} else if c.ClusterID < 0 || c.ClusterID >= maxInt(c.ClusterCount, 1) {
+		problems = append(problems, fmt.Sprintf("cluster_id %d must be below cluster_count %d", c.ClusterID, maxInt(c.ClusterCount, 1)))
+	}
+
+	switch c.Producer {
+	case "", ProducerNats, ProducerRedis:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown producer %q", c.Producer))
+	}
+
+	switch c.Encoding {
+	case "", EncodingMsgpack, EncodingJSON:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown encoding %q", c.Encoding))
+	}
+
+	switch c.TransportCompression {
+	case "", TransportCompressionZlib, TransportCompressionZstd:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown transport_compression %q", c.TransportCompression))
+	}
+
+	switch c.Nats.Mode {
+	case "", NatsModeStan, NatsModeJetStream:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown nats mode %q", c.Nats.Mode))
+	}
+
+	switch c.Nats.AckMode {
+	case "", AckModeSync, AckModeAsync, AckModeNone:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown nats ack_mode %q", c.Nats.AckMode))
+	}
+
+	if (c.Producer == "" || c.Producer == ProducerNats) && c.Nats.Address == "" {
+		problems = append(problems, "nats address is required when producing to nats")
+	}
+
+	if c.Nats.Channel == "" {
+		problems = append(problems, "nats channel is required as it is the subject events are produced to")
+	}
+
+	if features.CacheMembers && c.Intents == 0 {
+		problems = append(problems, "intents must include GUILD_MEMBERS when caching members")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidConfiguration, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
 // NewManager creates the manager and session
 func NewManager(configuration Configuration,
 	features Features, logger zerolog.Logger) (m *Manager, err error) {
 
-	if configuration.Token == "" {
-		err = ErrNoTokenProvided
+	if err = configuration.ValidateWithFeatures(features); err != nil {
 		return
 	}
+
+	if configuration.ClusterCount <= 0 {
+		configuration.ClusterCount = 1
+	}
+
 	if configuration.MaxConcurrentIdentifies <= 0 {
 		configuration.MaxConcurrentIdentifies = 1
 	}
@@ -178,67 +632,274 @@ func NewManager(configuration Configuration,
 		configuration.MaxHeartbeatFailures = 5
 	}
 
+	if configuration.Redis.MaxBufferedWrites <= 0 {
+		configuration.Redis.MaxBufferedWrites = 1000
+	}
+
+	if configuration.Nats.ClientIDRetries <= 0 {
+		configuration.Nats.ClientIDRetries = 3
+	}
+
+	if configuration.TransportCompression == "" && configuration.Compression {
+		configuration.TransportCompression = TransportCompressionZlib
+	}
+
+	if features.IgnoreBots {
+		features.IgnoreBotMessages = true
+		features.IgnoreBotMembers = true
+		features.IgnoreBotPresences = true
+	}
+
+	if configuration.Encoding == "" {
+		configuration.Encoding = EncodingMsgpack
+	}
+
+	if configuration.Producer == "" {
+		configuration.Producer = ProducerNats
+	}
+
+	if configuration.Nats.Mode == "" {
+		configuration.Nats.Mode = NatsModeStan
+	}
+
+	if configuration.Nats.Mode == NatsModeJetStream && configuration.Nats.Stream == "" {
+		configuration.Nats.Stream = subjectToken(configuration.Nats.Channel)
+	}
+
+	if configuration.Nats.MaxReconnects <= 0 {
+		configuration.Nats.MaxReconnects = -1
+	}
+
+	if configuration.Nats.PublishRetries <= 0 {
+		configuration.Nats.PublishRetries = 3
+	}
+
+	if configuration.Nats.PublishBackoff <= 0 {
+		configuration.Nats.PublishBackoff = 100
+	}
+
+	if configuration.Nats.AckMode == "" {
+		configuration.Nats.AckMode = AckModeSync
+	}
+
+	if configuration.Nats.StrictOrdering && configuration.Nats.AckMode != AckModeSync {
+		logger.Warn().Msg("Nats AckMode is sync as StrictOrdering requires publishes to be acknowledged in order")
+		configuration.Nats.AckMode = AckModeSync
+	}
+
+	if configuration.Nats.StrictOrdering && configuration.Nats.SubjectPerType {
+		logger.Warn().Msg("Nats SubjectPerType is ignored as StrictOrdering requires a single subject")
+		configuration.Nats.SubjectPerType = false
+	}
+
+	if configuration.DeduplicationLimit <= 0 {
+		configuration.DeduplicationLimit = 10000
+	}
+
+	if configuration.GuildLoadTimeout <= 0 {
+		configuration.GuildLoadTimeout = 30
+	}
+
+	// A LargeThreshold of 0 is left out of the identify so Discord uses its
+	// own default.
+	if configuration.LargeThreshold != 0 {
+		largeThreshold := configuration.LargeThreshold
+		if largeThreshold < minLargeThreshold {
+			largeThreshold = minLargeThreshold
+		} else if largeThreshold > maxLargeThreshold {
+			largeThreshold = maxLargeThreshold
+		}
+
+		if largeThreshold != configuration.LargeThreshold {
+			logger.Warn().Int("threshold", configuration.LargeThreshold).Int("using", largeThreshold).
+				Msg("LargeThreshold must be between 50 and 250")
+			configuration.LargeThreshold = largeThreshold
+		}
+	}
+
+	if configuration.ShutdownTimeout <= 0 {
+		configuration.ShutdownTimeout = 10
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	m = &Manager{
 		Token:              configuration.Token,
 		ShardGroups:        make(map[int]*ShardGroup),
 		ShardGroupsMu:      sync.Mutex{},
 		ShardGroupsCounter: new(int64),
 		MaxShardGroups:     2,
+		scaling:            new(int32),
+		abnormalClosures:   new(int64),
+		droppedOversized:   new(int64),
+		pending:            new(int64),
+		received:           new(int64),
+		stanHealthy:        new(int32),
+		stanReconnecting:   new(int32),
+		natsReconnects:     new(int64),
+		shardPresences:     make(map[int]events.UpdateStatus),
+		chunks:             make(map[string]chan void),
+		chunkNonce:         new(int64),
+		produced:           new(int64),
+		metrics:            newPrometheusMetrics(),
 		ReadyLimiter: NewConcurrencyLimiter(
 			configuration.MaxConcurrentIdentifies,
 		),
-		Buckets:       NewBucketStore(),
-		Client:        client.NewClient(configuration.Token),
-		Features:      features,
-		Configuration: configuration,
-		log:           logger,
-		ctx:           context.Background(),
+		Buckets:         NewBucketStore(),
+		identifyLocks:   make(map[int]*ConcurrencyLimiter),
+		identifyLocksMu: sync.Mutex{},
+		Client:          client.NewClient(configuration.Token),
+		Features:        features,
+		Configuration:   configuration,
+		log:             logger,
+		ctx:             ctx,
+		cancel:          cancel,
+
+		eventChannel:   make(chan Event, eventChannelSize),
+		produceChannel: make(chan StreamEvent, eventChannelSize),
+
+		cacheStats: newCacheStats(),
+
+		ready: make(chan void),
 	}
 
-	// Construct maps for both blacklists
+	// Construct maps for both blacklists and the allowlist
+	m.Configuration.EventBlacklist = make(map[string]void)
 	for _, i := range m.Configuration.EventBlacklistValues {
 		m.Configuration.EventBlacklist[i] = void{}
 	}
+	m.Configuration.ProduceBlacklist = make(map[string]void)
 	for _, i := range m.Configuration.ProduceBlacklistValues {
 		m.Configuration.ProduceBlacklist[i] = void{}
 	}
+	m.Configuration.GuildAllowlist = make(map[string]void)
+	for _, i := range m.Configuration.GuildAllowlistValues {
+		m.Configuration.GuildAllowlist[i] = void{}
+	}
 
-	m.RedisClient = redis.NewClient(&redis.Options{
+	m.validateIntents()
+
+	if m.Configuration.DeduplicationWindow > 0 {
+		m.Deduplicator = NewDeduplicator(
+			time.Duration(m.Configuration.DeduplicationWindow)*time.Second,
+			m.Configuration.DeduplicationLimit,
+		)
+	}
+
+	m.RedisClient = NewRedisClient(&redis.Options{
 		Addr:     m.Configuration.Redis.Address,
 		Password: m.Configuration.Redis.Password,
 		DB:       m.Configuration.Redis.Database,
-	})
+	}, m.Configuration.Redis.MaxBufferedWrites, m.log)
+
+	// If we fail to connect to anything, we will clean up the
+	// connections that did succeed so the embedder is free to retry.
+	defer func() {
+		if err != nil {
+			m.cancel()
+			if m.NatsClient != nil {
+				m.NatsClient.Close()
+			}
+			m.RedisClient.Close()
+		}
+	}()
 
 	// Verify that redis has successfully connected
 	err = m.RedisClient.Ping(m.ctx).Err()
 	if err != nil {
+		err = fmt.Errorf("failed to connect to redis: %w", err)
+		return
+	}
+
+	if m.Configuration.Producer == ProducerRedis {
+		m.Producer = &redisStreamProducer{m: m}
 		return
 	}
 
-	m.NatsClient, err = nats.Connect(m.Configuration.Nats.Address)
+	natsOptions, err := m.natsOptions()
 	if err != nil {
+		err = fmt.Errorf("failed to configure nats: %w", err)
 		return
 	}
 
-	m.StanClient, err = stan.Connect(
-		m.Configuration.Nats.ClusterID,
-		m.Configuration.Nats.ClientID,
-		stan.NatsConn(m.NatsClient),
-	)
+	m.NatsClient, err = nats.Connect(m.Configuration.Nats.Address, natsOptions...)
 	if err != nil {
+		err = fmt.Errorf("failed to connect to nats: %w", err)
 		return
 	}
 
-	// res, err := rediScripts.ClearKeys("welcomer:*", m)
-	// println(res, err)
+	if m.Configuration.Nats.Mode == NatsModeJetStream {
+		err = m.connectJetStream()
+		if err != nil {
+			err = fmt.Errorf("failed to connect to jetstream: %w", err)
+			return
+		}
+	} else {
+		err = m.connectStan()
+		if err != nil {
+			err = fmt.Errorf("failed to connect to nats streaming: %w", err)
+			return
+		}
+		m.Producer = &stanProducer{m: m}
+	}
+
+	return
+}
+
+// validateIntents warns if the configured intents are missing any
+// privileged intents that the enabled features rely on. Privileged
+// intents must also be enabled for the application in the developer
+// portal.
+func (m *Manager) validateIntents() {
+	intents := uint(m.Configuration.Intents)
+
+	if m.Features.CacheMembers && intents&events.IntentGuildMembers == 0 {
+		m.log.Warn().Int("intents", m.Configuration.Intents).
+			Msg("CacheMembers is enabled but the GUILD_MEMBERS intent is missing so members will not be received")
+	}
+}
+
+// stanConnect connects to NATS Streaming. It is swapped out in tests as
+// there is no NATS Streaming server to connect to.
+var stanConnect = stan.Connect
+
+// connectStan connects to NATS Streaming using a randomly suffixed client
+// id. If the client id is already registered, such as when two
+// instances share the same configuration, a new suffix will be tried.
+func (m *Manager) connectStan() (err error) {
+	for attempt := 0; attempt <= m.Configuration.Nats.ClientIDRetries; attempt++ {
+		clientID := m.Configuration.Nats.ClientID + "-" + strconv.Itoa(random.Intn(9999))
+
+		var sc stan.Conn
+		sc, err = stanConnect(
+			m.Configuration.Nats.ClusterID,
+			clientID,
+			m.stanOptions()...,
+		)
+		if err == nil {
+			m.log.Info().Msgf("Using client id %s", clientID)
+
+			m.stanMu.Lock()
+			m.StanClient = sc
+			m.stanMu.Unlock()
+			atomic.StoreInt32(m.stanHealthy, 1)
+			return
+		}
+
+		if !strings.Contains(err.Error(), "clientID already registered") {
+			return
+		}
+
+		m.log.Warn().Str("client", clientID).Msg("Client id is already registered, retrying with a new one")
+	}
 
 	return
 }
 
 // Open starts up the Manager and will start up sessions
 func (m *Manager) Open() (err error) {
-	res := new(events.GatewayBot)
-	if err = m.Client.FetchJSON("GET", "/gateway/bot", nil, &res); err != nil {
+	res, err := m.fetchGateway()
+	if err != nil {
 		return
 	}
 	m.Gateway = res
@@ -268,58 +929,210 @@ func (m *Manager) Open() (err error) {
 		shardCount = m.Configuration.ShardCount
 	}
 
-	// We will always round up the Shards to the nearest 16 if it uses more than 63 shards
-	// just in order to support the majority of larger bots as we don't really know when
-	// big bot sharding has occured and usually the determined devision is 16 or a multiple.
-	if shardCount > 63 {
-		shardCount = int(math.Ceil(float64(shardCount)/16)) * 16
-	}
+	shardCount = roundShards(shardCount)
 
 	m.log.Info().Msgf("Using %d shard(s)", shardCount)
 
+	m.bootClear(shardCount)
+
+	go m.ForwardEvents()
+	go m.ForwardProduce()
+
 	err = m.Scale(m.CreateShardIDs(shardCount), shardCount)
+	if err != nil {
+		return
+	}
+
+	if m.Configuration.ReconcileInterval > 0 {
+		m.StartReconciler(time.Duration(m.Configuration.ReconcileInterval) * time.Second)
+	}
+
+	if m.Configuration.Redis.CacheTTL > 0 {
+		m.StartTTLRefresher(time.Duration(m.Configuration.Redis.CacheTTL) * time.Second / 2)
+	}
 	return
 }
 
-// Close stops all running ShardGroups
+// fetchGateway fetches /gateway/bot and makes sure the response can be
+// used to start Shards.
+func (m *Manager) fetchGateway() (res *events.GatewayBot, err error) {
+	res = new(events.GatewayBot)
+	if err = m.Client.FetchJSON("GET", "/gateway/bot", nil, &res); err != nil {
+		return nil, err
+	}
+
+	if err = validateGateway(res); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// validateGateway returns a descriptive error if the /gateway/bot response
+// is missing anything we rely on. max_concurrency was added after the
+// endpoint so it will default to 1 if missing.
+func validateGateway(res *events.GatewayBot) (err error) {
+	if res == nil {
+		return fmt.Errorf("%w: response was empty", ErrInvalidGateway)
+	}
+
+	if res.URL == "" {
+		return fmt.Errorf("%w: url is missing", ErrInvalidGateway)
+	}
+
+	if _, err = url.Parse(res.URL); err != nil {
+		return fmt.Errorf("%w: url %q is not valid: %v", ErrInvalidGateway, res.URL, err)
+	}
+
+	if res.Shards <= 0 {
+		return fmt.Errorf("%w: recommended shards is %d", ErrInvalidGateway, res.Shards)
+	}
+
+	if res.SessionStartLimit.Total <= 0 {
+		return fmt.Errorf("%w: session start limit total is %d", ErrInvalidGateway, res.SessionStartLimit.Total)
+	}
+
+	if res.SessionStartLimit.MaxConcurrency <= 0 {
+		res.SessionStartLimit.MaxConcurrency = 1
+	}
+	return nil
+}
+
+// Self returns the bot's user. It is nil until a Shard has received
+// READY.
+func (m *Manager) Self() *events.User {
+	m.BotUserMu.RLock()
+	defer m.BotUserMu.RUnlock()
+
+	return m.BotUser
+}
+
+func (m *Manager) setSelf(user *events.User) {
+	m.BotUserMu.Lock()
+	defer m.BotUserMu.Unlock()
+
+	m.BotUser = user
+}
+
+// WaitForReady blocks until every Shard has emitted SHARD_READY or the
+// context is done.
+func (m *Manager) WaitForReady(ctx context.Context) (err error) {
+	select {
+	case <-m.ready:
+		return
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops all running ShardGroups. Shards are given ShutdownTimeout
+// to produce the events they have received before they are closed.
+// The producer, NATS and redis are then closed.
 func (m *Manager) Close() {
 	m.log.Info().Msg("Closing manager")
+	m.StopAutoScaler()
+	m.StopReconciler()
+	m.StopTTLRefresher()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(m.Configuration.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	m.ShardGroupsMu.Lock()
+	defer m.ShardGroupsMu.Unlock()
+
 	for _, sg := range m.ShardGroups {
+		if err := sg.Drain(ctx); err != nil {
+			m.log.Warn().Err(err).Msg("Failed to drain ShardGroup, closing anyway")
+		}
 		sg.Stop()
 	}
+
+	// The producer is closed before the connections it publishes on so
+	// pending acknowledgements are not lost.
+	if m.Producer != nil {
+		if err := m.Producer.Close(); err != nil {
+			m.log.Warn().Err(err).Msg("Failed to close producer")
+		}
+	}
+	if m.NatsClient != nil {
+		m.NatsClient.Close()
+	}
+
+	m.cancel()
+	m.RedisClient.Close()
 }
 
 // WaitForIdentifyRatelimit waits for a position to identify a sesssion.
 // This does this whilst respecting the max_concurrency sent in the
-// /gateway/bot request
-func (m *Manager) WaitForIdentifyRatelimit(shardID int) {
+// /gateway/bot request. Only one Shard per bucket can identify at a time
+// so release must be called once the Shard has received READY.
+func (m *Manager) WaitForIdentifyRatelimit(shardID int) (release func()) {
+	bucket := shardID % m.Gateway.SessionStartLimit.MaxConcurrency
+
+	lock := m.identifyLock(bucket)
+	ticket := lock.Wait()
+
 	m.Buckets.CreateWaitForBucket(
-		fmt.Sprintf("/gateway/bot/%d", shardID%m.Gateway.SessionStartLimit.MaxConcurrency),
+		fmt.Sprintf("/gateway/bot/%d", bucket),
 		1,
 		5*time.Second,
 	)
+
+	return func() {
+		lock.FreeTicket(ticket)
+	}
+}
+
+// identifyLock returns the limiter that only allows one Shard in an
+// identify bucket to identify at a time
+func (m *Manager) identifyLock(bucket int) (lock *ConcurrencyLimiter) {
+	m.identifyLocksMu.Lock()
+	defer m.identifyLocksMu.Unlock()
+
+	lock, ok := m.identifyLocks[bucket]
+	if !ok {
+		lock = NewConcurrencyLimiter(1)
+		m.identifyLocks[bucket] = lock
+	}
+	return
 }
 
 // GatewayScale creates a new shard group and stops any existing ones once it has
 // finished starting up. This will also fetch the gateway guilds count and
 // overwrite the Gateway item on the Manager object.
 func (m *Manager) GatewayScale() (err error) {
-	res := new(events.GatewayBot)
-	if err = m.Client.FetchJSON("GET", "/gateway/bot", nil, &res); err != nil {
+	res, err := m.fetchGateway()
+	if err != nil {
 		return
 	}
-	if res.Shards > 63 {
-		res.Shards = int(math.Ceil(float64(res.Shards)/16)) * 16
-	}
+	res.Shards = roundShards(res.Shards)
 	m.Gateway = res
 
 	err = m.Scale(m.CreateShardIDs(m.Gateway.Shards), m.Gateway.Shards)
 	return
 }
 
+// Reshard starts newCount shards and stops the current ones once they
+// are ready. Until then, the new shards only handle READY and GUILD_CREATE
+// so events are not produced twice.
+func (m *Manager) Reshard(newCount int) (err error) {
+	return m.Scale(m.CreateShardIDs(newCount), newCount)
+}
+
+// IsScaling returns true whilst a ShardGroup is being started.
+func (m *Manager) IsScaling() bool {
+	return atomic.LoadInt32(m.scaling) == 1
+}
+
 // Scale creates a new shard group and stops any existing ones once it has
-// finished starting up
+// finished starting up. Only one scale can happen at a time so
+// ErrAlreadyScaling is returned if one is in progress.
 func (m *Manager) Scale(shardIDs []int, shardCount int) (err error) {
+	if !atomic.CompareAndSwapInt32(m.scaling, 0, 1) {
+		return ErrAlreadyScaling
+	}
+	defer atomic.StoreInt32(m.scaling, 0)
+
 	sg, err := NewShardGroup(m, shardIDs, shardCount)
 	if err != nil {
 		return
@@ -329,10 +1142,164 @@ func (m *Manager) Scale(shardIDs []int, shardCount int) (err error) {
 	return
 }
 
-// CreateShardIDs returns a slice of shard ids the bot will use
+// AbnormalClosures returns how many times Shards have been disconnected
+// without a close frame (1006). A rising count usually points to an
+// unreliable network rather than Discord closing connections.
+func (m *Manager) AbnormalClosures() int64 {
+	return atomic.LoadInt64(m.abnormalClosures)
+}
+
+// DroppedOversized returns how many messages have been dropped for being
+// larger than MaxEventSize.
+func (m *Manager) DroppedOversized() int64 {
+	return atomic.LoadInt64(m.droppedOversized)
+}
+
+// ShardCount returns the shard count of the current ShardGroup
+func (m *Manager) ShardCount() (shardCount int) {
+	m.ShardGroupsMu.Lock()
+	defer m.ShardGroupsMu.Unlock()
+
+	sg, ok := m.ShardGroups[int(atomic.LoadInt64(m.ShardGroupsCounter))%m.MaxShardGroups]
+	if ok {
+		shardCount = sg.ShardCount
+	}
+	return
+}
+
+// StartAutoScaler checks the recommended shards every interval and will
+// scale up if the recommended shards is greater than our current shards
+// * maxGuildsPerShard. maxGuildsPerShard is how many guilds you want per
+// shard before it would scale up. Discord recommends ~1000 guilds per
+// shard so if it is 1500, the bot can grow 50% before scaling.
+//
+// If a bot was on 5 shards with 5000 guilds and has grown to 7000,
+// (7 * 1000) > (5 * 1500) will be used to see if it is good to scale up.
+// We can also negative to figure out how many guilds are left until it
+// scales up. For example, (5 * 1500) - (7 * 1000) = 500 meaning 500 more
+// guilds are needed until it will surpass the threshold.
+func (m *Manager) StartAutoScaler(interval time.Duration, maxGuildsPerShard int) {
+	m.autoScalerMu.Lock()
+	defer m.autoScalerMu.Unlock()
+
+	if m.autoScalerStop != nil {
+		return
+	}
+
+	if maxGuildsPerShard <= 0 {
+		maxGuildsPerShard = 1000
+	}
+
+	stop := make(chan void)
+	m.autoScalerStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				m.autoScale(maxGuildsPerShard)
+			}
+		}
+	}()
+}
+
+// StopAutoScaler stops the auto scaler if it is running
+func (m *Manager) StopAutoScaler() {
+	m.autoScalerMu.Lock()
+	defer m.autoScalerMu.Unlock()
+
+	if m.autoScalerStop != nil {
+		close(m.autoScalerStop)
+		m.autoScalerStop = nil
+	}
+}
+
+// autoScale scales up if the recommended shards exceed the
+// maxGuildsPerShard threshold of the current shards.
+func (m *Manager) autoScale(maxGuildsPerShard int) {
+	if m.IsScaling() {
+		m.log.Debug().Msg("Skipping auto scale as the manager is already scaling")
+		return
+	}
+
+	res, err := m.fetchGateway()
+	if err != nil {
+		m.log.Warn().Err(err).Msg("Failed to fetch the recommended shards")
+		return
+	}
+
+	currentShards := m.ShardCount()
+	remaining := currentShards*maxGuildsPerShard - res.Shards*1000
+	if remaining >= 0 {
+		m.log.Debug().Int("shards", currentShards).Int("recommended", res.Shards).
+			Msgf("%d guilds remaining until the next scale", remaining)
+		return
+	}
+
+	m.log.Info().Int("shards", currentShards).Int("recommended", res.Shards).Msg("Scaling up shards")
+	if err := m.GatewayScale(); err != nil {
+		m.log.Error().Err(err).Msg("Failed to scale up shards")
+	}
+}
+
+// guildsPerShard is how many guilds Discord recommends per shard. Shards
+// can have at most 2500 guilds.
+const guildsPerShard = 1000
+
+// RecommendedShards returns the shards a bot with guildCount guilds should
+// use, following the same recommendation as /gateway/bot of a shard per
+// 1000 guilds. This allows planning capacity without calling the API.
+func RecommendedShards(guildCount int) int {
+	shardCount := int(math.Ceil(float64(guildCount) / guildsPerShard))
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	return roundShards(shardCount)
+}
+
+// roundShards will always round up the Shards to the nearest 16 if it uses
+// more than 63 shards just in order to support the majority of larger bots
+// as we don't really know when big bot sharding has occured and usually
+// the determined devision is 16 or a multiple.
+func roundShards(shardCount int) int {
+	if shardCount > 63 {
+		shardCount = int(math.Ceil(float64(shardCount)/16)) * 16
+	}
+	return shardCount
+}
+
+// CreateShardIDs returns a slice of shard ids the bot will use. Unless
+// ShardIDs is set, the shards are split between the clusters with any
+// leftover shards going to the earlier clusters, so 10 shards across 3
+// clusters are split 4, 3 and 3.
 func (m *Manager) CreateShardIDs(shardCount int) (shardIDs []int) {
+	if len(m.Configuration.ShardIDs) > 0 {
+		for _, shardID := range m.Configuration.ShardIDs {
+			if shardID < 0 || shardID >= shardCount {
+				m.log.Warn().Int("shard", shardID).Int("shardcount", shardCount).
+					Msg("Ignoring shard id that is not below the shard count")
+				continue
+			}
+			shardIDs = append(shardIDs, shardID)
+		}
+		return
+	}
+
+	clusterID := m.Configuration.ClusterID
 	deployedShards := shardCount / m.Configuration.ClusterCount
-	for i := (deployedShards * m.Configuration.ClusterID); i < (deployedShards * (m.Configuration.ClusterID + 1)); i++ {
+	leftover := shardCount % m.Configuration.ClusterCount
+
+	start := deployedShards*clusterID + minInt(clusterID, leftover)
+	if clusterID < leftover {
+		deployedShards++
+	}
+
+	for i := start; i < start+deployedShards; i++ {
 		shardIDs = append(shardIDs, i)
 	}
 	return
@@ -359,21 +1326,6 @@ func (m *Manager) CreateShardIDs(shardCount int) (shardIDs []int) {
 // are necessary scaling is a boolean operator in the session
 // which will define this behaviour if it should only handle events like GUILD_CREATE
 
-// We could add a FEATURE that checks the recommended shards every 4 hours and if
-// the recommended shards is greater than our current shards * MAX_GUILDS_PER_SHARD,
-// then we can scale up. MAX_GUILDS_PER_SHARD simply is how many guilds do you want per shard
-// before it would scale up, so by default this is ~1000 from discord so if the bot grows 50%,
-// each shard will have ~1500 guilds.
-
-// If a bot was on 5 shards with 5000 guilds and has grown to 7000,
-// (7 * 1000) > (5 * 1500) will be used to see if it is good to scale up.
-// This takes the recommended discord count which is arround 1 shard per 1000
-// and if it is accomodates more users than our current shard count and how
-// many we want on a single shard, we should scale up.
-// We can also negative to figure out how many guilds are left until it scales up. For example,
-// (7 * 1000) - (4 * 1500) = 1000 meaning 1000 more guilds are needed until it will surpass the
-// MAX_GUILDS_PER_SHARD threshold
-
 // SessionEvents:
 // readPacket()
 // 	- use a sync pool to store the object we will unmarshal to as it reduces allocs :) with ReceivedPayload
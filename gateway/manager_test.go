@@ -0,0 +1,357 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog"
+)
+
+// testManager returns a Manager that queues events to be produced without
+// connecting to Discord, redis or NATS
+func testManager() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := &Manager{
+		log:              zerolog.Nop(),
+		ctx:              ctx,
+		cancel:           cancel,
+		received:         new(int64),
+		produced:         new(int64),
+		pending:          new(int64),
+		droppedOversized: new(int64),
+		chunks:           make(map[string]chan void),
+		chunkNonce:       new(int64),
+		metrics:          newPrometheusMetrics(),
+		cacheStats:       newCacheStats(),
+		eventChannel:     make(chan Event, 64),
+		produceChannel:   make(chan StreamEvent, 64),
+		ready:            make(chan void),
+	}
+	m.Configuration.GuildLoadTimeout = 30
+	m.Configuration.Redis.Prefix = "test"
+	return m
+}
+
+// testRedisManager returns a testManager with its state stored in an in
+// memory redis
+func testRedisManager(t testing.TB) (*Manager, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start redis: %v", err)
+	}
+
+	m := testManager()
+	m.RedisClient = NewRedisClient(&redis.Options{Addr: mr.Addr()}, 100, m.log)
+
+	t.Cleanup(func() {
+		m.RedisClient.Close()
+		mr.Close()
+	})
+	return m, mr
+}
+
+// validConfiguration returns a Configuration that passes Validate
+func validConfiguration() (c Configuration) {
+	c.Token = "token"
+	c.Nats.Address = "127.0.0.1:4222"
+	c.Nats.Channel = "sandwich"
+	return
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Configuration)
+		valid  bool
+	}{
+		{"valid", func(c *Configuration) {}, true},
+		{"no token", func(c *Configuration) { c.Token = "" }, false},
+		{"autosharded with shard count", func(c *Configuration) { c.AutoSharded, c.ShardCount = true, 2 }, false},
+		{"cluster id too large", func(c *Configuration) { c.ClusterID, c.ClusterCount = 2, 2 }, false},
+		{"no nats address", func(c *Configuration) { c.Nats.Address = "" }, false},
+		{"no nats address with redis", func(c *Configuration) { c.Nats.Address, c.Producer = "", ProducerRedis }, true},
+		{"unknown producer", func(c *Configuration) { c.Producer = "kafka" }, false},
+		{"unknown encoding", func(c *Configuration) { c.Encoding = "etf" }, false},
+		{"unknown transport compression", func(c *Configuration) { c.TransportCompression = "gzip" }, false},
+		{"unknown nats mode", func(c *Configuration) { c.Nats.Mode = "core" }, false},
+		{"unknown ack mode", func(c *Configuration) { c.Nats.AckMode = "later" }, false},
+		{"known values", func(c *Configuration) {
+			c.Producer, c.Encoding, c.TransportCompression = ProducerNats, EncodingJSON, TransportCompressionZstd
+			c.Nats.Mode, c.Nats.AckMode = NatsModeJetStream, AckModeNone
+		}, true},
+	}
+
+	for _, test := range tests {
+		c := validConfiguration()
+		test.modify(&c)
+
+		err := c.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected to be valid, got %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidConfiguration) {
+			t.Errorf("%s: expected ErrInvalidConfiguration, got %v", test.name, err)
+		}
+	}
+}
+
+func TestValidateListsEveryProblem(t *testing.T) {
+	c := validConfiguration()
+	c.Token = ""
+	c.Producer = "kafka"
+
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), ErrNoTokenProvided.Error()) || !strings.Contains(err.Error(), `unknown producer "kafka"`) {
+		t.Errorf("expected every problem to be listed, got %v", err)
+	}
+}
+
+func TestValidateWithFeatures(t *testing.T) {
+	c := validConfiguration()
+	if err := c.ValidateWithFeatures(Features{CacheMembers: true}); !errors.Is(err, ErrInvalidConfiguration) {
+		t.Errorf("expected caching members without intents to be invalid, got %v", err)
+	}
+
+	c.Intents = int(events.IntentGuilds | events.IntentGuildMembers)
+	if err := c.ValidateWithFeatures(Features{CacheMembers: true}); err != nil {
+		t.Errorf("expected caching members with intents to be valid, got %v", err)
+	}
+}
+
+func TestNewManagerValidates(t *testing.T) {
+	c := validConfiguration()
+	c.Encoding = "etf"
+
+	if _, err := NewManager(c, Features{}, zerolog.Nop()); !errors.Is(err, ErrInvalidConfiguration) {
+		t.Errorf("expected NewManager to reject the configuration, got %v", err)
+	}
+}
+
+// closedAddress returns an address that refuses connections
+func closedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func TestNewManagerConnectFailures(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start redis: %v", err)
+	}
+	defer mr.Close()
+
+	natsAddress, _ := testNatsServer(t)
+	stanFailure := errors.New("stan: connect request timeout")
+	fakeStanConnect(t, stanFailure)
+
+	tests := []struct {
+		name     string
+		redis    string
+		nats     string
+		expected string
+	}{
+		{"redis", closedAddress(t), natsAddress, "failed to connect to redis"},
+		{"nats", mr.Addr(), closedAddress(t), "failed to connect to nats:"},
+		{"nats streaming", mr.Addr(), natsAddress, "failed to connect to nats streaming"},
+	}
+
+	for _, test := range tests {
+		c := validConfiguration()
+		c.Redis.Address = test.redis
+		c.Nats.Address = test.nats
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: expected an error, NewManager panicked with %v", test.name, r)
+				}
+			}()
+
+			_, err := NewManager(c, Features{}, zerolog.Nop())
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("%s: expected %q, got %v", test.name, test.expected, err)
+			}
+		}()
+	}
+}
+
+func TestWaitForIdentifyRatelimitBuckets(t *testing.T) {
+	const shardCount, maxConcurrency = 32, 16
+
+	m := testManager()
+	m.Gateway = &events.GatewayBot{}
+	m.Gateway.SessionStartLimit.MaxConcurrency = maxConcurrency
+	m.Buckets = NewBucketStore()
+	m.identifyLocks = make(map[int]*ConcurrencyLimiter)
+
+	// Discord allows a bucket to identify every 5 seconds which is too
+	// slow to test with
+	for bucket := 0; bucket < maxConcurrency; bucket++ {
+		m.Buckets.CreateBucket(fmt.Sprintf("/gateway/bot/%d", bucket), 1, 10*time.Millisecond)
+	}
+
+	var identifying [maxConcurrency]int32
+	var concurrent, maxConcurrent int32
+
+	wg := sync.WaitGroup{}
+	for shardID := 0; shardID < shardCount; shardID++ {
+		wg.Add(1)
+		go func(shardID int) {
+			defer wg.Done()
+
+			release := m.WaitForIdentifyRatelimit(shardID)
+			bucket := shardID % maxConcurrency
+
+			if n := atomic.AddInt32(&identifying[bucket], 1); n > 1 {
+				t.Errorf("shard %d identified whilst %d shards in bucket %d were not ready", shardID, n-1, bucket)
+			}
+			n := atomic.AddInt32(&concurrent, 1)
+			for {
+				max := atomic.LoadInt32(&maxConcurrent)
+				if n <= max || atomic.CompareAndSwapInt32(&maxConcurrent, max, n) {
+					break
+				}
+			}
+
+			// Wait for READY before releasing the bucket
+			time.Sleep(20 * time.Millisecond)
+
+			atomic.AddInt32(&concurrent, -1)
+			atomic.AddInt32(&identifying[bucket], -1)
+			release()
+		}(shardID)
+	}
+
+	done := make(chan void)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for every shard to identify")
+	}
+
+	if maxConcurrent < 2 {
+		t.Errorf("expected shards in different buckets to identify concurrently, at most %d did", maxConcurrent)
+	}
+}
+
+func TestFetchGatewayInvalid(t *testing.T) {
+	for _, response := range []string{
+		`null`,
+		`{}`,
+		`{"shards":1,"session_start_limit":{"total":1000,"remaining":1000}}`,
+		`{"url":"wss://gateway.discord.gg","shards":0,"session_start_limit":{"total":1000,"remaining":1000}}`,
+		`{"url":"wss://gateway.discord.gg","shards":1}`,
+		`{"url":"://gateway","shards":1,"session_start_limit":{"total":1000,"remaining":1000}}`,
+	} {
+		m := testManager()
+		testAPI(t, m, map[string]string{"/api/v6/gateway/bot": response})
+
+		if _, err := m.fetchGateway(); !errors.Is(err, ErrInvalidGateway) {
+			t.Errorf("expected ErrInvalidGateway for %s, got %v", response, err)
+		}
+	}
+}
+
+func TestFetchGatewayDefaultsMaxConcurrency(t *testing.T) {
+	m := testManager()
+	testAPI(t, m, map[string]string{
+		"/api/v6/gateway/bot": `{"url":"wss://gateway.discord.gg","shards":2,"session_start_limit":{"total":1000,"remaining":999}}`,
+	})
+
+	res, err := m.fetchGateway()
+	if err != nil {
+		t.Fatalf("failed to fetch gateway: %v", err)
+	}
+	if res.URL != "wss://gateway.discord.gg" || res.Shards != 2 {
+		t.Errorf("unexpected response %+v", res)
+	}
+	if res.SessionStartLimit.MaxConcurrency != 1 {
+		t.Errorf("expected max concurrency to default to 1, got %d", res.SessionStartLimit.MaxConcurrency)
+	}
+}
+
+func TestRecommendedShards(t *testing.T) {
+	tests := []struct {
+		guildCount int
+		expected   int
+	}{
+		{0, 1},
+		{1, 1},
+		{1000, 1},
+		{1001, 2},
+		{25000, 25},
+		{63000, 63},
+		// Large bots are rounded up to a multiple of 16
+		{63001, 64},
+		{64001, 80},
+		{150000, 160},
+	}
+
+	for _, test := range tests {
+		if shards := RecommendedShards(test.guildCount); shards != test.expected {
+			t.Errorf("expected %d guilds to need %d shards, got %d", test.guildCount, test.expected, shards)
+		}
+	}
+}
+
+func TestCreateShardIDsAcrossClusters(t *testing.T) {
+	expected := [][]int{
+		{0, 1, 2, 3},
+		{4, 5, 6},
+		{7, 8, 9},
+	}
+
+	seen := make(map[int]bool)
+	for clusterID := range expected {
+		m := testManager()
+		m.Configuration.ClusterCount = 3
+		m.Configuration.ClusterID = clusterID
+
+		shardIDs := m.CreateShardIDs(10)
+		if fmt.Sprint(shardIDs) != fmt.Sprint(expected[clusterID]) {
+			t.Errorf("expected cluster %d to have shards %v, got %v", clusterID, expected[clusterID], shardIDs)
+		}
+		for _, shardID := range shardIDs {
+			if seen[shardID] {
+				t.Errorf("shard %d was given to more than one cluster", shardID)
+			}
+			seen[shardID] = true
+		}
+	}
+
+	if len(seen) != 10 {
+		t.Errorf("expected every shard to be given to a cluster, %d were", len(seen))
+	}
+}
+
+func TestCreateShardIDsPinned(t *testing.T) {
+	m := testManager()
+	m.Configuration.ClusterCount = 3
+	m.Configuration.ShardIDs = []int{9, 2, 10, -1, 5}
+
+	// Shard ids that are not below the shard count are ignored and the
+	// clusters are not used
+	if shardIDs := m.CreateShardIDs(10); fmt.Sprint(shardIDs) != fmt.Sprint([]int{9, 2, 5}) {
+		t.Errorf("expected the pinned shards [9 2 5], got %v", shardIDs)
+	}
+}
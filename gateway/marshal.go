@@ -0,0 +1,1343 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+	"github.com/go-redis/redis/v8"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Event represents a dispatch received by a Shard that is waiting to
+// be marshaled.
+type Event struct {
+	ShardID  int
+	Sequence int64
+	Type     string
+	Data     jsoniter.RawMessage
+
+	// Logger includes the shard id, event type and guild id, if the event
+	// belongs to a guild, so marshalers should use it over the Manager's.
+	Logger zerolog.Logger
+
+	// shard is the Shard that received the event
+	shard *Shard
+
+	// created is why a GUILD_CREATE was received and loaded is true if
+	// the event was the last guild sent in READY to be received
+	created guildCreateType
+	loaded  bool
+}
+
+// StreamEvent represents an event that will be produced to consumers.
+// Consumers rely on the field names t and d in both msgpack and json so
+// they must not be changed.
+type StreamEvent struct {
+	Type string      `msgpack:"t" json:"t"`
+	Data interface{} `msgpack:"d" json:"d"`
+
+	// after are produced once the event has been queued so consumers
+	// receive the event first, such as GUILD_MEMBERS_CHUNKED after the
+	// last GUILD_MEMBERS_CHUNK of a request.
+	after []StreamEvent
+}
+
+// Marshaler converts an Event into a StreamEvent. If ok is false, the
+// StreamEvent will not be produced.
+type Marshaler func(m *Manager, e Event) (ok bool, se StreamEvent, err error)
+
+// ErrMarshalerExists is returned when registering a marshaler for an
+// event that already has one.
+var ErrMarshalerExists = errors.New("a marshaler has already been registered for this event")
+
+var marshalers = make(map[string]Marshaler)
+var marshalersMu sync.RWMutex
+
+// addMarshaler registers a built-in marshaler for an event. As these are
+// added during init, trying to add the same event twice is a mistake in
+// the source so we will panic.
+func addMarshaler(event string, marshaler Marshaler) {
+	if err := RegisterMarshaler(event, marshaler); err != nil {
+		panic(fmt.Sprintf("marshaler for %s has already been added", event))
+	}
+}
+
+// RegisterMarshaler adds a marshaler for an event that does not have one
+// built-in. This allows for handling new Discord events without having
+// to fork. Marshalers cannot be overwritten so ErrMarshalerExists is
+// returned if the event is already handled. For example:
+//
+//	gateway.RegisterMarshaler("GUILD_SCHEDULED_EVENT_CREATE",
+//		func(m *gateway.Manager, e gateway.Event) (bool, gateway.StreamEvent, error) {
+//			scheduledEvent := make(map[string]interface{})
+//			if err := jsoniter.Unmarshal(e.Data, &scheduledEvent); err != nil {
+//				return false, gateway.StreamEvent{}, err
+//			}
+//
+//			return true, gateway.StreamEvent{
+//				Type: "GUILD_SCHEDULED_EVENT_CREATE",
+//				Data: scheduledEvent,
+//			}, nil
+//		},
+//	)
+func RegisterMarshaler(event string, marshaler Marshaler) (err error) {
+	marshalersMu.Lock()
+	defer marshalersMu.Unlock()
+
+	if _, ok := marshalers[event]; ok {
+		return ErrMarshalerExists
+	}
+	marshalers[event] = marshaler
+	return
+}
+
+// OnEvent filters and marshals an Event. If ok is false, the event was
+// either ignored or failed to marshal and should not be produced.
+func (m *Manager) OnEvent(e Event) (ok bool, se StreamEvent) {
+	if _, blacklisted := m.Configuration.EventBlacklist[e.Type]; blacklisted {
+		m.metrics.dropped(DropReasonBlacklisted)
+		return
+	}
+
+	guildID := eventGuildID(e)
+	if guildID != "" && len(m.Configuration.GuildAllowlist) > 0 {
+		if _, allowed := m.Configuration.GuildAllowlist[guildID]; !allowed {
+			m.metrics.dropped(DropReasonNotAllowed)
+			return
+		}
+	}
+
+	e.Logger = m.eventLogger(e, guildID)
+
+	marshalersMu.RLock()
+	marshaler, exists := marshalers[e.Type]
+	marshalersMu.RUnlock()
+	if !exists {
+		e.Logger.Trace().Msg("No marshaler for event")
+		m.metrics.dropped(DropReasonNoMarshaler)
+		return
+	}
+
+	ok, se, err := marshaler(m, e)
+	if err != nil {
+		e.Logger.Error().Err(err).Msg("Failed to marshal event")
+		m.metrics.marshalErrors.WithLabelValues(e.Type).Inc()
+		m.metrics.dropped(DropReasonMarshalError)
+		return false, se
+	}
+
+	if !ok {
+		m.metrics.dropped(DropReasonIgnored)
+		return
+	}
+
+	if _, blacklisted := m.Configuration.ProduceBlacklist[se.Type]; blacklisted {
+		m.metrics.dropped(DropReasonBlacklisted)
+		return false, se
+	}
+
+	return
+}
+
+// ForwardEvents marshals the events received by Shards and queues them to
+// be produced.
+func (m *Manager) ForwardEvents() {
+	for e := range m.eventChannel {
+		atomic.AddInt64(m.received, 1)
+		m.metrics.received.WithLabelValues(e.Type).Inc()
+
+		// Every event is remembered but only events received whilst
+		// the Shard is resuming are dropped as the sequence starts again
+		// when a Shard identifies.
+		if m.Deduplicator != nil && m.Deduplicator.Seen(e) && e.shard != nil && e.shard.resumedWithin(m.Deduplicator.window) {
+			m.log.Trace().Int("shard", e.ShardID).Str("type", e.Type).Msg("Ignoring duplicate event")
+			m.metrics.dropped(DropReasonDuplicate)
+			atomic.AddInt64(m.pending, -1)
+			continue
+		}
+
+		ok, se := m.OnEvent(e)
+		if ok {
+			m.produceChannel <- se
+		} else {
+			atomic.AddInt64(m.pending, -1)
+		}
+
+		for _, after := range se.after {
+			m.produceEvent(after.Type, after.Data)
+		}
+
+		// SHARD_READY is produced after the event so consumers receive
+		// every GUILD_CREATE first.
+		if e.loaded && e.shard != nil {
+			e.shard.produceReady(e.shard.readyEvent())
+		}
+	}
+}
+
+// encoder is something that can encode a StreamEvent
+type encoder interface {
+	Encode(v interface{}) error
+}
+
+// newEncoder returns an encoder for the configured Encoding that writes
+// to buf. Both encodings use the json field names.
+func (m *Manager) newEncoder(buf *bytes.Buffer) encoder {
+	if m.Configuration.Encoding == EncodingJSON {
+		return json.NewEncoder(buf)
+	}
+
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	return enc
+}
+
+// ForwardProduce publishes marshaled events to the Producer.
+func (m *Manager) ForwardProduce() {
+	buf := new(bytes.Buffer)
+	enc := m.newEncoder(buf)
+
+	for se := range m.produceChannel {
+		m.produce(buf, enc, se)
+		atomic.AddInt64(m.pending, -1)
+	}
+}
+
+// produce encodes and publishes a single StreamEvent. Events are counted
+// as produced once they have been acknowledged which may be after
+// produce has returned.
+func (m *Manager) produce(buf *bytes.Buffer, enc encoder, se StreamEvent) {
+	buf.Reset()
+	if err := enc.Encode(se); err != nil {
+		m.log.Error().Str("type", se.Type).Err(err).Msg("Failed to encode event")
+		m.metrics.dropped(DropReasonEncodeError)
+		return
+	}
+
+	// The json encoder ends every value with a newline
+	data := buf.Bytes()
+	if m.Configuration.Encoding == EncodingJSON {
+		data = bytes.TrimSuffix(data, []byte("\n"))
+	}
+
+	if err := m.publish(se.Type, data); err != nil {
+		m.log.Error().Str("type", se.Type).Err(err).Msg("Failed to publish event")
+		m.metrics.dropped(DropReasonPublishError)
+	}
+}
+
+// published counts an event as produced
+func (m *Manager) published(eventType string) {
+	atomic.AddInt64(m.produced, 1)
+	m.metrics.produced.WithLabelValues(eventType).Inc()
+}
+
+// waitForPending blocks until every event received by Shards has been
+// produced or dropped, or until ctx is done.
+func (m *Manager) waitForPending(ctx context.Context) (err error) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(m.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return
+}
+
+// publish sends an encoded event to the subject for its type. Unless
+// the AckMode is sync, publishes are asynchronous and errors are only
+// handled once the Producer has responded. Publishes are retried with
+// an exponential backoff and if they still fail, the event is added to
+// the dead letter list.
+func (m *Manager) publish(eventType string, data []byte) (err error) {
+	subject := m.subject(eventType)
+	backoff := time.Duration(m.Configuration.Nats.PublishBackoff) * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		if err = m.publishOnce(subject, eventType, data); err == nil {
+			return
+		}
+
+		if attempt >= m.Configuration.Nats.PublishRetries {
+			break
+		}
+
+		m.log.Warn().Str("type", eventType).Err(err).Int("attempt", attempt+1).Msg("Failed to publish event, retrying")
+
+		// The Manager closing stops the retries so shutting down is not
+		// held up by an unavailable Producer.
+		if !m.sleep(backoff << attempt) {
+			break
+		}
+	}
+
+	m.deadLetter(subject, data)
+	return
+}
+
+// sleep waits for the duration, returning false if the Manager closed
+// before it had passed
+func (m *Manager) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-m.ctx.Done():
+		return false
+	}
+}
+
+func (m *Manager) publishOnce(subject string, eventType string, data []byte) (err error) {
+	mode := m.Configuration.Nats.AckMode
+	switch mode {
+	case AckModeSync:
+		if err = m.Producer.Publish(subject, data); err == nil {
+			m.published(eventType)
+		}
+		return
+	case AckModeNone:
+		if err = m.Producer.PublishNoAck(subject, data); err == nil {
+			m.published(eventType)
+		}
+		return
+	}
+
+	// As the buffer is reused, we have to keep a copy in case the event
+	// has to be dead lettered once the Producer responds.
+	payload := append([]byte(nil), data...)
+	return m.Producer.PublishAsync(subject, payload, func(err error) {
+		if err == nil {
+			m.published(eventType)
+			return
+		}
+
+		m.metrics.ackFailures.WithLabelValues(mode).Inc()
+		m.log.Error().Str("type", eventType).Err(err).Msg("Failed to publish event")
+		m.metrics.dropped(DropReasonPublishError)
+		m.deadLetter(subject, payload)
+	})
+}
+
+// deadLetterEvent is an event that could not be published
+type deadLetterEvent struct {
+	Subject string `json:"subject"`
+	Data    []byte `json:"data"`
+}
+
+// deadLetter adds an event that could not be published to the list
+// {REDIS_PREFIX}:deadletter so it can be replayed with ReplayDeadLetter.
+func (m *Manager) deadLetter(subject string, data []byte) {
+	entry, err := json.Marshal(deadLetterEvent{Subject: subject, Data: data})
+	if err != nil {
+		m.log.Error().Str("subject", subject).Err(err).Msg("Failed to encode dead letter")
+		return
+	}
+
+	// The Manager's context is not used as events are still dead
+	// lettered whilst it is closing.
+	ctx := context.Background()
+	err = m.RedisClient.CriticalWrite(ctx, func(pipe redis.Pipeliner) {
+		pipe.RPush(ctx, m.keys().DeadLetter(), entry)
+	})
+	if err != nil {
+		m.log.Error().Str("subject", subject).Err(err).Msg("Failed to dead letter event, it has been lost")
+		return
+	}
+
+	m.log.Warn().Str("subject", subject).Msg("Added event to the dead letter list")
+}
+
+// ReplayDeadLetter publishes the events in the dead letter list in the
+// order they failed. If an event fails to publish again, it is put back
+// at the front of the list and the error is returned. replayed is how
+// many events were published.
+func (m *Manager) ReplayDeadLetter() (replayed int, err error) {
+	key := m.keys().DeadLetter()
+
+	for {
+		var entry string
+		entry, err = m.RedisClient.LPop(m.ctx, key).Result()
+		if err == redis.Nil {
+			return replayed, nil
+		}
+		if err != nil {
+			return
+		}
+
+		event := deadLetterEvent{}
+		if err = json.UnmarshalFromString(entry, &event); err != nil {
+			m.log.Error().Err(err).Msg("Discarding dead letter that could not be decoded")
+			continue
+		}
+
+		if err = m.Producer.Publish(event.Subject, event.Data); err != nil {
+			if pushErr := m.RedisClient.LPush(m.ctx, key, entry).Err(); pushErr != nil {
+				m.log.Error().Str("subject", event.Subject).Err(pushErr).Msg("Failed to return event to the dead letter list")
+			}
+			return
+		}
+
+		replayed++
+	}
+}
+
+// subject returns the subject an event type is published to
+func (m *Manager) subject(eventType string) string {
+	if m.Configuration.Nats.SubjectPerType {
+		return m.Configuration.Nats.Channel + "." + subjectToken(eventType)
+	}
+	return m.Configuration.Nats.Channel
+}
+
+// subjectToken normalizes an event type into a single NATS subject token.
+// Event types are uppercased so custom marshalers produce the same
+// subjects as Discord's events and any characters NATS treats specially
+// are replaced.
+func subjectToken(eventType string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		default:
+			return r
+		}
+	}, strings.ToUpper(eventType))
+}
+
+// produceShardEvent queues a lifecycle event of a Shard to be produced
+// unless shard events are ignored.
+func (m *Manager) produceShardEvent(eventType string, data interface{}) {
+	if m.Features.IgnoreShardEvents {
+		return
+	}
+
+	m.produceEvent(eventType, data)
+}
+
+// produceEvent queues an event that was not received from Discord to be
+// produced unless it is blacklisted.
+func (m *Manager) produceEvent(eventType string, data interface{}) {
+	if _, blacklisted := m.Configuration.ProduceBlacklist[eventType]; blacklisted {
+		return
+	}
+
+	atomic.AddInt64(m.pending, 1)
+	m.produceChannel <- StreamEvent{
+		Type: eventType,
+		Data: data,
+	}
+}
+
+// replayedUpdate returns true if the Shard that received the event has
+// resumed within the ResumeWindow and unchanged is true, meaning the
+// update does not change the cached object.
+func (m *Manager) replayedUpdate(e Event, unchanged bool) bool {
+	if m.Configuration.ResumeWindow <= 0 || e.shard == nil {
+		return false
+	}
+
+	if !e.shard.resumedWithin(time.Duration(m.Configuration.ResumeWindow) * time.Second) {
+		return false
+	}
+
+	return unchanged
+}
+
+// shouldIgnore returns true if ignore is enabled and the user is a bot.
+// Marshalers should still update the state before ignoring an event so
+// the cache stays complete.
+func shouldIgnore(ignore bool, user *events.User) bool {
+	return ignore && user != nil && user.Bot
+}
+
+// eventLogger returns a logger with the context of an Event
+func (m *Manager) eventLogger(e Event, guildID string) zerolog.Logger {
+	ctx := m.log.With().Int("shard", e.ShardID).Str("type", e.Type)
+	if guildID != "" {
+		ctx = ctx.Str("guild", guildID)
+	}
+	return ctx.Logger()
+}
+
+// eventGuildID returns the guild id of the guild an Event belongs to
+// without unmarshaling the entire event. An empty string is returned if
+// the event does not belong to a guild.
+func eventGuildID(e Event) string {
+	switch e.Type {
+	case "GUILD_CREATE", "GUILD_UPDATE", "GUILD_DELETE":
+		return json.Get(e.Data, "id").ToString()
+	default:
+		return json.Get(e.Data, "guild_id").ToString()
+	}
+}
+
+func init() {
+	addMarshaler("VOICE_STATE_UPDATE", voiceStateUpdateMarshaler)
+	addMarshaler("VOICE_SERVER_UPDATE", voiceServerUpdateMarshaler)
+	addMarshaler("TYPING_START", typingStartMarshaler)
+	addMarshaler("RESUMED", resumedMarshaler)
+	addMarshaler("MESSAGE_CREATE", messageCreateMarshaler)
+	addMarshaler("CHANNEL_CREATE", channelCreateMarshaler)
+	addMarshaler("GUILD_CREATE", guildCreateMarshaler)
+	addMarshaler("GUILD_MEMBERS_CHUNK", guildMembersChunkMarshaler)
+	addMarshaler("GUILD_MEMBER_ADD", guildMemberAddMarshaler)
+	addMarshaler("GUILD_MEMBER_REMOVE", guildMemberRemoveMarshaler)
+	addMarshaler("PRESENCE_UPDATE", presenceUpdateMarshaler)
+	addMarshaler("CHANNEL_UPDATE", channelUpdateMarshaler)
+	addMarshaler("GUILD_ROLE_CREATE", guildRoleCreateMarshaler)
+	addMarshaler("GUILD_ROLE_UPDATE", guildRoleUpdateMarshaler)
+	addMarshaler("GUILD_ROLE_DELETE", guildRoleDeleteMarshaler)
+	addMarshaler("GUILD_UPDATE", guildUpdateMarshaler)
+	addMarshaler("GUILD_DELETE", guildDeleteMarshaler)
+	addMarshaler("GUILD_EMOJIS_UPDATE", guildEmojisUpdateMarshaler)
+}
+
+// VoiceStateUpdateEvent is produced on VOICE_STATE_UPDATE. Before is
+// only present when voice states are being cached and the user was
+// previously in a voice channel.
+type VoiceStateUpdateEvent struct {
+	Before *events.VoiceState `msgpack:"before" json:"before"`
+	After  *events.VoiceState `msgpack:"after" json:"after"`
+}
+
+func voiceStateUpdateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	voiceState := &events.VoiceState{}
+	if err = json.Unmarshal(e.Data, voiceState); err != nil {
+		return
+	}
+
+	payload := VoiceStateUpdateEvent{After: voiceState}
+
+	if m.Features.CacheVoiceStates && voiceState.GuildID != 0 {
+		key := m.keys().VoiceStates(voiceState.GuildID)
+		userID := voiceState.UserID.String()
+
+		if payload.Before, err = m.getVoiceState(voiceState.GuildID, voiceState.UserID); err == ErrStateNotFound {
+			payload.Before, err = nil, nil
+		} else if err != nil {
+			return
+		}
+
+		// A missing ChannelID means the user has left voice
+		if voiceState.ChannelID == nil {
+			err = m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+				pipe.HDel(m.ctx, key, userID)
+			})
+		} else {
+			var data []byte
+			if data, err = json.Marshal(voiceState); err != nil {
+				return
+			}
+			err = m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+				pipe.HSet(m.ctx, key, userID, data)
+				m.expire(pipe, key)
+			})
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return true, StreamEvent{
+		Type: "VOICE_STATE_UPDATE",
+		Data: payload,
+	}, nil
+}
+
+// voiceServerUpdateMarshaler produces the token and endpoint needed to
+// connect to voice after JoinVoice. The session id is in the
+// VOICE_STATE_UPDATE of the bot's user.
+func voiceServerUpdateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	voiceServer := &events.VoiceServerUpdate{}
+	if err = json.Unmarshal(e.Data, voiceServer); err != nil {
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "VOICE_SERVER_UPDATE",
+		Data: voiceServer,
+	}, nil
+}
+
+func typingStartMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	typingStart := &events.TypingStart{}
+	if err = json.Unmarshal(e.Data, typingStart); err != nil {
+		return
+	}
+
+	// Discord includes the member when typing in a guild however we will
+	// fall back to the state if it is not present. If the member is not
+	// cached either we will still produce the event without it rather
+	// than holding up every other event to fetch them.
+	if typingStart.GuildID != 0 && typingStart.Member == nil {
+		typingStart.Member, err = m.lookupMember(typingStart.GuildID, typingStart.UserID)
+		if err != nil && err != ErrStateNotFound {
+			return
+		}
+		if err == ErrStateNotFound {
+			e.Logger.Debug().Str("user", typingStart.UserID.String()).Msg("Member is not cached")
+		}
+		err = nil
+	}
+
+	if typingStart.Member != nil && shouldIgnore(m.Features.IgnoreBotMessages, typingStart.Member.User) {
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "TYPING_START",
+		Data: typingStart,
+	}, nil
+}
+
+// ShardReadyEvent is produced as SHARD_READY once a Shard has received
+// every guild sent in READY or GuildLoadTimeout has passed without
+// receiving any. Guilds is the ammount of guilds the Shard has and
+// Loaded is how many of the Expected guilds from READY were received.
+type ShardReadyEvent struct {
+	ShardID  int `msgpack:"shard_id" json:"shard_id"`
+	Guilds   int `msgpack:"guilds" json:"guilds"`
+	Expected int `msgpack:"expected" json:"expected"`
+	Loaded   int `msgpack:"loaded" json:"loaded"`
+}
+
+// ShardConnectEvent is produced as SHARD_CONNECT once a Shard has
+// connected to the gateway.
+type ShardConnectEvent struct {
+	ShardID int `msgpack:"shard_id" json:"shard_id"`
+}
+
+// ShardDisconnectEvent is produced as SHARD_DISCONNECT once a Shard's
+// connection has ended. Code is the close code or -1 if the connection
+// did not close cleanly.
+type ShardDisconnectEvent struct {
+	ShardID int    `msgpack:"shard_id" json:"shard_id"`
+	Code    int    `msgpack:"code" json:"code"`
+	Reason  string `msgpack:"reason" json:"reason"`
+}
+
+// ShardResumedEvent is produced as SHARD_RESUMED once a Shard has
+// successfully resumed its session. Replayed is the ammount of events
+// Discord replayed since the Shard disconnected.
+type ShardResumedEvent struct {
+	ShardID   int    `msgpack:"shard_id" json:"shard_id"`
+	SessionID string `msgpack:"session_id" json:"session_id"`
+	Sequence  int64  `msgpack:"sequence" json:"sequence"`
+	Replayed  int64  `msgpack:"replayed" json:"replayed"`
+}
+
+func resumedMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	if m.Features.IgnoreShardEvents {
+		return
+	}
+
+	payload := ShardResumedEvent{
+		ShardID:  e.ShardID,
+		Sequence: e.Sequence,
+	}
+
+	// Replayed events have the sequences between the one we resumed
+	// with and the RESUMED dispatch itself.
+	if e.shard != nil {
+		var resumeSequence int64
+		payload.SessionID, resumeSequence = e.shard.session()
+		if resumeSequence > 0 && e.Sequence > resumeSequence {
+			payload.Replayed = e.Sequence - resumeSequence - 1
+		}
+	}
+
+	return true, StreamEvent{
+		Type: "SHARD_RESUMED",
+		Data: payload,
+	}, nil
+}
+
+func messageCreateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	message := &events.Message{}
+	if err = json.Unmarshal(e.Data, message); err != nil {
+		return
+	}
+
+	if shouldIgnore(m.Features.IgnoreBotMessages, message.Author) {
+		return
+	}
+
+	if message.GuildID == 0 {
+		switch m.Features.DirectMessages {
+		case DirectMessagesIgnore:
+			return
+		case DirectMessagesCache:
+			// As Discord does not send CHANNEL_CREATE for direct
+			// messages, we will create the channel if we do not know it.
+			_, err = m.getChannel(message.ChannelID)
+			if err == ErrStateNotFound && message.Author != nil {
+				err = m.setChannel(&events.Channel{
+					ID:         message.ChannelID,
+					Type:       events.ChannelTypeDM,
+					Recipients: []interface{}{message.Author},
+				})
+			}
+			return false, se, err
+		}
+	}
+
+	if m.Features.CheckPrefix && message.GuildID != 0 {
+		if ok, err = m.hasPrefix(message); !ok || err != nil {
+			return
+		}
+	}
+
+	return true, StreamEvent{
+		Type: "MESSAGE_CREATE",
+		Data: message,
+	}, nil
+}
+
+// hasPrefix returns true if the message starts with any of the prefixes
+// of its guild stored in {REDIS_PREFIX}:prefix or mentions the bot when
+// CheckPrefixMention is enabled. Guilds without a prefix use the
+// DefaultPrefix and if there is none, always pass.
+func (m *Manager) hasPrefix(message *events.Message) (ok bool, err error) {
+	prefixes, err := m.RedisClient.HGet(m.ctx, m.keys().Prefixes(), message.GuildID.String()).Result()
+	if err == redis.Nil {
+		if m.Features.DefaultPrefix == "" {
+			return true, nil
+		}
+		prefixes, err = m.Features.DefaultPrefix, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if m.Features.CheckPrefixMention && m.mentionsUser(message.Content) {
+		return true, nil
+	}
+
+	content := message.Content
+	if m.Features.CheckPrefixCaseInsensitive {
+		content, prefixes = strings.ToLower(content), strings.ToLower(prefixes)
+	}
+
+	for _, prefix := range strings.Split(prefixes, ",") {
+		if prefix != "" && strings.HasPrefix(content, prefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mentionsUser returns true if the content starts with a mention of
+// the bot
+func (m *Manager) mentionsUser(content string) bool {
+	self := m.Self()
+	if self == nil {
+		return false
+	}
+
+	return strings.HasPrefix(content, "<@"+self.ID.String()+">") ||
+		strings.HasPrefix(content, "<@!"+self.ID.String()+">")
+}
+
+func channelCreateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	channel := &events.Channel{}
+	if err = json.Unmarshal(e.Data, channel); err != nil {
+		return
+	}
+
+	isDM := channel.Type == events.ChannelTypeDM || channel.Type == events.ChannelTypeGroupDM
+	if isDM && m.Features.DirectMessages == DirectMessagesIgnore {
+		return
+	}
+
+	if err = m.setChannel(channel); err != nil {
+		return
+	}
+
+	if isDM && m.Features.DirectMessages == DirectMessagesCache {
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "CHANNEL_CREATE",
+		Data: channel,
+	}, nil
+}
+
+func guildMemberAddMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	memberAdd := &events.GuildMemberAdd{}
+	if err = json.Unmarshal(e.Data, memberAdd); err != nil {
+		return
+	}
+
+	if memberAdd.GuildMember == nil || memberAdd.User == nil {
+		return
+	}
+
+	if m.Features.CacheMembers {
+		if err = m.setMember(memberAdd.GuildID, memberAdd.GuildMember); err != nil {
+			return
+		}
+	}
+
+	if err = m.addMemberCount(memberAdd.GuildID, 1); err != nil {
+		return
+	}
+
+	if shouldIgnore(m.Features.IgnoreBotMembers, memberAdd.User) {
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "GUILD_MEMBER_ADD",
+		Data: memberAdd,
+	}, nil
+}
+
+// GuildMemberRemoveEvent is produced as GUILD_MEMBER_REMOVE. Member is
+// the cached member before they left so consumers know the roles they
+// had and is nil if they were not cached.
+type GuildMemberRemoveEvent struct {
+	GuildID snowflake.ID        `msgpack:"guild_id" json:"guild_id"`
+	User    *events.User        `msgpack:"user" json:"user"`
+	Member  *events.GuildMember `msgpack:"member" json:"member"`
+}
+
+func guildMemberRemoveMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	memberRemove := &events.GuildMemberRemove{}
+	if err = json.Unmarshal(e.Data, memberRemove); err != nil {
+		return
+	}
+
+	if memberRemove.User == nil {
+		return
+	}
+
+	payload := GuildMemberRemoveEvent{
+		GuildID: memberRemove.GuildID,
+		User:    memberRemove.User,
+	}
+
+	if m.Features.CacheMembers || m.Features.MemberLRUSize > 0 {
+		payload.Member, err = m.lookupMember(memberRemove.GuildID, memberRemove.User.ID)
+		if err == ErrStateNotFound {
+			payload.Member, err = nil, nil
+		} else if err != nil {
+			return
+		}
+
+		if err = m.deleteMember(memberRemove.GuildID, memberRemove.User); err != nil {
+			return
+		}
+	}
+
+	if err = m.addMemberCount(memberRemove.GuildID, -1); err != nil {
+		return
+	}
+
+	if shouldIgnore(m.Features.IgnoreBotMembers, memberRemove.User) {
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "GUILD_MEMBER_REMOVE",
+		Data: payload,
+	}, nil
+}
+
+// PresenceUpdateEvent is produced on PRESENCE_UPDATE. Before is only
+// present when presences are being cached and the user was not offline.
+type PresenceUpdateEvent struct {
+	Before *events.PresenceUpdate `msgpack:"before" json:"before"`
+	After  *events.PresenceUpdate `msgpack:"after" json:"after"`
+}
+
+func presenceUpdateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	presence := &events.PresenceUpdate{}
+	if err = json.Unmarshal(e.Data, presence); err != nil {
+		return
+	}
+
+	payload := PresenceUpdateEvent{After: presence}
+
+	if m.Features.CachePresences && presence.User != nil && presence.GuildID != 0 {
+		if payload.Before, err = m.getPresence(presence.GuildID, presence.User.ID); err == ErrStateNotFound {
+			payload.Before, err = nil, nil
+		} else if err != nil {
+			return
+		}
+
+		if err = m.setPresence(presence); err != nil {
+			return
+		}
+	}
+
+	// Presences only include the user id so we have to check the state
+	// to know if the user is a bot.
+	if m.Features.IgnoreBotPresences && presence.User != nil {
+		bot := presence.User.Bot
+		if !bot {
+			var user *events.User
+			if user, err = m.getUser(presence.User.ID); err == nil {
+				bot = user.Bot
+			} else if err != ErrStateNotFound {
+				return
+			}
+			err = nil
+		}
+
+		if bot {
+			return
+		}
+	}
+
+	return true, StreamEvent{
+		Type: "PRESENCE_UPDATE",
+		Data: payload,
+	}, nil
+}
+
+// ChannelUpdateEvent is produced on CHANNEL_UPDATE. Before is only
+// present if the channel was cached.
+type ChannelUpdateEvent struct {
+	Before *events.Channel `msgpack:"before" json:"before"`
+	After  *events.Channel `msgpack:"after" json:"after"`
+}
+
+func channelUpdateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	channel := &events.Channel{}
+	if err = json.Unmarshal(e.Data, channel); err != nil {
+		return
+	}
+
+	payload := ChannelUpdateEvent{After: channel}
+	if payload.Before, err = m.getChannel(channel.ID); err == ErrStateNotFound {
+		payload.Before, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	if err = m.setChannel(channel); err != nil {
+		return
+	}
+
+	if payload.Before != nil && m.replayedUpdate(e, channelEqual(payload.Before, channel)) {
+		e.Logger.Debug().Msg("Ignoring replayed update after resume")
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "CHANNEL_UPDATE",
+		Data: payload,
+	}, nil
+}
+
+func guildRoleCreateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	roleCreate := &events.GuildRoleCreate{}
+	if err = json.Unmarshal(e.Data, roleCreate); err != nil {
+		return
+	}
+
+	if roleCreate.Role == nil {
+		return
+	}
+
+	if err = m.setRole(roleCreate.GuildID, roleCreate.Role); err != nil {
+		return
+	}
+
+	err = m.setGuildRoles(roleCreate.GuildID, func(roles []*events.Role) []*events.Role {
+		return replaceRole(roles, roleCreate.Role)
+	})
+	if err != nil {
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "GUILD_ROLE_CREATE",
+		Data: roleCreate,
+	}, nil
+}
+
+// GuildRoleUpdateEvent is produced on GUILD_ROLE_UPDATE. Before is only
+// present if the role was cached.
+type GuildRoleUpdateEvent struct {
+	GuildID snowflake.ID `msgpack:"guild_id" json:"guild_id"`
+	Before  *events.Role `msgpack:"before" json:"before"`
+	After   *events.Role `msgpack:"after" json:"after"`
+}
+
+func guildRoleUpdateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	roleUpdate := &events.GuildRoleUpdate{}
+	if err = json.Unmarshal(e.Data, roleUpdate); err != nil {
+		return
+	}
+
+	if roleUpdate.Role == nil {
+		return
+	}
+
+	payload := GuildRoleUpdateEvent{GuildID: roleUpdate.GuildID, After: roleUpdate.Role}
+	if payload.Before, err = m.getRole(roleUpdate.GuildID, roleUpdate.Role.ID); err == ErrStateNotFound {
+		payload.Before, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	if err = m.setRole(roleUpdate.GuildID, roleUpdate.Role); err != nil {
+		return
+	}
+
+	err = m.setGuildRoles(roleUpdate.GuildID, func(roles []*events.Role) []*events.Role {
+		return replaceRole(roles, roleUpdate.Role)
+	})
+	if err != nil {
+		return
+	}
+
+	if payload.Before != nil && m.replayedUpdate(e, roleEqual(payload.Before, roleUpdate.Role)) {
+		e.Logger.Debug().Msg("Ignoring replayed update after resume")
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "GUILD_ROLE_UPDATE",
+		Data: payload,
+	}, nil
+}
+
+// GuildRoleDeleteEvent is produced on GUILD_ROLE_DELETE. Role is only
+// present if the role was cached.
+type GuildRoleDeleteEvent struct {
+	GuildID snowflake.ID `msgpack:"guild_id" json:"guild_id"`
+	RoleID  snowflake.ID `msgpack:"role_id" json:"role_id"`
+	Role    *events.Role `msgpack:"role" json:"role"`
+}
+
+func guildRoleDeleteMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	roleDelete := &events.GuildRoleDelete{}
+	if err = json.Unmarshal(e.Data, roleDelete); err != nil {
+		return
+	}
+
+	payload := GuildRoleDeleteEvent{GuildID: roleDelete.GuildID, RoleID: roleDelete.RoleID}
+	if payload.Role, err = m.getRole(roleDelete.GuildID, roleDelete.RoleID); err == ErrStateNotFound {
+		payload.Role, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	if err = m.deleteRole(roleDelete.GuildID, roleDelete.RoleID); err != nil {
+		return
+	}
+
+	err = m.setGuildRoles(roleDelete.GuildID, func(roles []*events.Role) []*events.Role {
+		for i, role := range roles {
+			if role.ID == roleDelete.RoleID {
+				return append(roles[:i], roles[i+1:]...)
+			}
+		}
+		return roles
+	})
+	if err != nil {
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "GUILD_ROLE_DELETE",
+		Data: payload,
+	}, nil
+}
+
+// replaceRole replaces the role with the same id in roles or appends it
+// if it is not present
+func replaceRole(roles []*events.Role, role *events.Role) []*events.Role {
+	for i, r := range roles {
+		if r.ID == role.ID {
+			roles[i] = role
+			return roles
+		}
+	}
+	return append(roles, role)
+}
+
+// GuildUpdateEvent is produced on GUILD_UPDATE. Before is only present if
+// the guild was cached.
+type GuildUpdateEvent struct {
+	Before *events.Guild `msgpack:"before" json:"before"`
+	After  *events.Guild `msgpack:"after" json:"after"`
+}
+
+func guildUpdateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	guild := &events.Guild{}
+	if err = json.Unmarshal(e.Data, guild); err != nil {
+		return
+	}
+
+	guildID, err := snowflake.ParseString(guild.ID)
+	if err != nil {
+		return
+	}
+
+	payload := GuildUpdateEvent{After: guild}
+	if payload.Before, err = m.getGuild(guildID); err == ErrStateNotFound {
+		payload.Before, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	// GUILD_UPDATE does not include the objects only sent in GUILD_CREATE
+	// so we keep the ones we already have.
+	if payload.Before != nil {
+		guild.Large = payload.Before.Large
+		guild.JoinedAt = payload.Before.JoinedAt
+		guild.MemberCount = payload.Before.MemberCount
+		guild.VoiceStates = payload.Before.VoiceStates
+		guild.Members = payload.Before.Members
+		guild.Channels = payload.Before.Channels
+		guild.Presences = payload.Before.Presences
+	}
+
+	if err = m.setGuild(guild); err != nil {
+		return
+	}
+
+	if payload.Before != nil && m.replayedUpdate(e, DeepEqualExports("json", payload.Before, guild)) {
+		e.Logger.Debug().Msg("Ignoring replayed update after resume")
+		return
+	}
+
+	return true, StreamEvent{
+		Type: "GUILD_UPDATE",
+		Data: payload,
+	}, nil
+}
+
+// GuildDeleteEvent is produced as GUILD_DELETE when the bot is removed
+// from a guild and as GUILD_UNAVAILABLE during an outage. Guild is the
+// cached guild and is nil if it was not cached.
+type GuildDeleteEvent struct {
+	GuildID snowflake.ID  `msgpack:"guild_id" json:"guild_id"`
+	Guild   *events.Guild `msgpack:"guild" json:"guild"`
+}
+
+func guildDeleteMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	guildDelete := &events.GuildDelete{}
+	if err = json.Unmarshal(e.Data, guildDelete); err != nil {
+		return
+	}
+
+	payload := GuildDeleteEvent{GuildID: guildDelete.ID}
+	if payload.Guild, err = m.getGuild(guildDelete.ID); err == ErrStateNotFound {
+		payload.Guild, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	// Unavailable guilds are sent again once the outage is over so they
+	// are kept.
+	if guildDelete.Unavailable {
+		return true, StreamEvent{
+			Type: "GUILD_UNAVAILABLE",
+			Data: payload,
+		}, nil
+	}
+
+	if payload.Guild != nil {
+		if err = m.clearGuild(guildDelete.ID, payload.Guild); err != nil {
+			return
+		}
+	}
+
+	return true, StreamEvent{
+		Type: "GUILD_DELETE",
+		Data: payload,
+	}, nil
+}
+
+func guildCreateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	guild := &events.Guild{}
+	if err = json.Unmarshal(e.Data, guild); err != nil {
+		return
+	}
+
+	guildID, err := snowflake.ParseString(guild.ID)
+	if err != nil {
+		return
+	}
+
+	if err = m.setGuild(guild); err != nil {
+		return
+	}
+
+	if err = m.setMemberCount(guildID, guild.MemberCount); err != nil {
+		return
+	}
+
+	if err = m.setEmojis(guild.Emojis, nil); err != nil {
+		return
+	}
+
+	for _, role := range guild.Roles {
+		if err = m.setRole(guildID, role); err != nil {
+			return
+		}
+	}
+
+	for _, channel := range guild.Channels {
+		channel.GuildID = guildID
+		if err = m.setChannel(channel); err != nil {
+			return
+		}
+	}
+
+	if m.Features.CacheMembers {
+		err = m.setMembersChunk(&events.GuildMembersChunk{
+			GuildID: guildID,
+			Members: guild.Members,
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	switch e.created {
+	case guildCreateJoin:
+		se.Type = "GUILD_JOIN"
+	case guildCreateAvailable:
+		se.Type = "GUILD_AVAILABLE"
+
+		// Member updates sent whilst the guild was unavailable were missed
+		// so the cached members may be outdated.
+		if m.Features.RefreshMembersOnAvailable && m.Features.CacheMembers && e.shard != nil {
+			e.Logger.Debug().Msg("Requesting members of guild that is available again")
+			if err := e.shard.RequestGuildMembers(guildID, "", 0, m.Features.CachePresences, ""); err != nil {
+				e.Logger.Warn().Err(err).Msg("Failed to request guild members")
+			}
+		}
+	default:
+		se.Type = "GUILD_CREATE"
+	}
+
+	se.Data = guild
+	return true, se, nil
+}
+
+// GuildMembersChunkedEvent is produced as GUILD_MEMBERS_CHUNKED once the
+// last GUILD_MEMBERS_CHUNK of a request has been received
+type GuildMembersChunkedEvent struct {
+	GuildID    snowflake.ID `msgpack:"guild_id" json:"guild_id"`
+	ChunkCount int          `msgpack:"chunk_count" json:"chunk_count"`
+	Nonce      string       `msgpack:"nonce" json:"nonce"`
+}
+
+func guildMembersChunkMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	chunk := &events.GuildMembersChunk{}
+	if err = json.Unmarshal(e.Data, chunk); err != nil {
+		return
+	}
+
+	if m.Features.CacheMembers {
+		if err = m.setMembersChunk(chunk); err != nil {
+			return
+		}
+	}
+
+	se = StreamEvent{
+		Type: "GUILD_MEMBERS_CHUNK",
+		Data: chunk,
+	}
+
+	if chunk.ChunkIndex == chunk.ChunkCount-1 {
+		if chunk.Nonce != "" {
+			m.completeChunk(chunk.Nonce)
+		}
+
+		se.after = []StreamEvent{{
+			Type: "GUILD_MEMBERS_CHUNKED",
+			Data: GuildMembersChunkedEvent{
+				GuildID:    chunk.GuildID,
+				ChunkCount: chunk.ChunkCount,
+				Nonce:      chunk.Nonce,
+			},
+		}}
+	}
+
+	return true, se, nil
+}
+
+// GuildEmojisUpdateEvent is produced as GUILD_EMOJIS_UPDATE. Before is
+// the emojis the guild had and is nil if the guild was not cached.
+type GuildEmojisUpdateEvent struct {
+	GuildID snowflake.ID    `msgpack:"guild_id" json:"guild_id"`
+	Before  []*events.Emoji `msgpack:"before" json:"before"`
+	After   []*events.Emoji `msgpack:"after" json:"after"`
+}
+
+func guildEmojisUpdateMarshaler(m *Manager, e Event) (ok bool, se StreamEvent, err error) {
+	emojisUpdate := &events.GuildEmojisUpdate{}
+	if err = json.Unmarshal(e.Data, emojisUpdate); err != nil {
+		return
+	}
+
+	payload := GuildEmojisUpdateEvent{
+		GuildID: emojisUpdate.GuildID,
+		After:   emojisUpdate.Emojis,
+	}
+
+	guild, err := m.getGuild(emojisUpdate.GuildID)
+	if err == ErrStateNotFound {
+		guild, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	// The update contains every emoji the guild has so any we had before
+	// that are missing have been deleted.
+	removed := make([]*events.Emoji, 0)
+	if guild != nil {
+		payload.Before = guild.Emojis
+
+		current := make(map[snowflake.ID]bool, len(emojisUpdate.Emojis))
+		for _, emoji := range emojisUpdate.Emojis {
+			current[emoji.ID] = true
+		}
+
+		for _, emoji := range guild.Emojis {
+			if !current[emoji.ID] {
+				removed = append(removed, emoji)
+			}
+		}
+	}
+
+	if err = m.setEmojis(emojisUpdate.Emojis, removed); err != nil {
+		return
+	}
+
+	if guild != nil {
+		guild.Emojis = emojisUpdate.Emojis
+		if err = m.setGuild(guild); err != nil {
+			return
+		}
+	}
+
+	return true, StreamEvent{
+		Type: "GUILD_EMOJIS_UPDATE",
+		Data: payload,
+	}, nil
+}
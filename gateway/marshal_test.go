@@ -0,0 +1,641 @@
+package gateway
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// forward passes events through ForwardEvents and returns the types of
+// the events that were queued to be produced in order
+func forward(m *Manager, received ...Event) (types []string) {
+	for _, e := range received {
+		m.eventChannel <- e
+	}
+	close(m.eventChannel)
+	m.ForwardEvents()
+
+	for len(m.produceChannel) > 0 {
+		types = append(types, (<-m.produceChannel).Type)
+	}
+	return
+}
+
+func TestGuildMembersChunkedAfterLastChunk(t *testing.T) {
+	m := testManager()
+
+	types := forward(m,
+		Event{Type: "GUILD_MEMBERS_CHUNK", Data: jsoniter.RawMessage(`{"guild_id":"1","members":[],"chunk_index":0,"chunk_count":2}`)},
+		Event{Type: "GUILD_MEMBERS_CHUNK", Data: jsoniter.RawMessage(`{"guild_id":"1","members":[],"chunk_index":1,"chunk_count":2}`)},
+	)
+
+	expected := []string{"GUILD_MEMBERS_CHUNK", "GUILD_MEMBERS_CHUNK", "GUILD_MEMBERS_CHUNKED"}
+	if len(types) != len(expected) {
+		t.Fatalf("expected %v to be produced, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("expected %v to be produced, got %v", expected, types)
+		}
+	}
+}
+
+func TestPresenceUpdateBeforeAndAfter(t *testing.T) {
+	m, _ := testRedisManager(t)
+	m.Features.CachePresences = true
+
+	online := Event{Type: "PRESENCE_UPDATE", Data: jsoniter.RawMessage(`{"user":{"id":"2"},"guild_id":"1","status":"online"}`)}
+	ok, se, err := presenceUpdateMarshaler(m, online)
+	if !ok || err != nil {
+		t.Fatalf("expected the presence to be produced, got %t %v", ok, err)
+	}
+	if payload := se.Data.(PresenceUpdateEvent); payload.Before != nil {
+		t.Errorf("expected no previous presence, got %+v", payload.Before)
+	}
+
+	presence, err := m.getPresence(snowflake.ID(1), snowflake.ID(2))
+	if err != nil {
+		t.Fatalf("expected the presence to be cached: %v", err)
+	}
+	if presence.Status != events.PresenceStatusOnline {
+		t.Errorf("expected the cached presence to be online, got %q", presence.Status)
+	}
+
+	offline := Event{Type: "PRESENCE_UPDATE", Data: jsoniter.RawMessage(`{"user":{"id":"2"},"guild_id":"1","status":"offline"}`)}
+	if _, se, err = presenceUpdateMarshaler(m, offline); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := se.Data.(PresenceUpdateEvent)
+	if payload.Before == nil || payload.Before.Status != events.PresenceStatusOnline {
+		t.Errorf("expected the previous presence to be online, got %+v", payload.Before)
+	}
+	if payload.After.Status != events.PresenceStatusOffline {
+		t.Errorf("expected the presence to be offline, got %q", payload.After.Status)
+	}
+
+	if _, err = m.getPresence(snowflake.ID(1), snowflake.ID(2)); err != ErrStateNotFound {
+		t.Errorf("expected the presence to be removed once offline, got %v", err)
+	}
+}
+
+func TestResumedMarshalerReplayed(t *testing.T) {
+	m := testManager()
+	s := &Shard{ShardID: 3, seq: new(int64)}
+	s.sessionID = "session"
+	s.resumeSequence = 10
+
+	ok, se, err := resumedMarshaler(m, Event{Type: "RESUMED", ShardID: 3, Sequence: 15, shard: s})
+	if !ok || err != nil {
+		t.Fatalf("expected SHARD_RESUMED to be produced, got %t %v", ok, err)
+	}
+
+	payload := se.Data.(ShardResumedEvent)
+	if payload.SessionID != "session" || payload.Replayed != 4 || payload.ShardID != 3 {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+func TestResumedMarshalerWhilstReconnecting(t *testing.T) {
+	m := testManager()
+	s := &Shard{seq: new(int64)}
+
+	// The session is changed by the Shard whilst the Manager marshals
+	// events it has already received.
+	done := make(chan void)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.clearSession()
+			s.sessionMu.Lock()
+			s.sessionID, s.resumeSequence = "session", int64(i)
+			s.sessionMu.Unlock()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		resumedMarshaler(m, Event{Type: "RESUMED", Sequence: 200, shard: s})
+	}
+	<-done
+}
+
+func TestGuildDeleteClearsGuild(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	_, _, err := guildCreateMarshaler(m, Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{
+		"id":"1","name":"a","member_count":2,
+		"channels":[{"id":"2","type":0,"name":"general"}],
+		"emojis":[{"id":"3","name":"b"}],
+		"roles":[{"id":"1","name":"@everyone"}]
+	}`)})
+	if err != nil {
+		t.Fatalf("failed to create guild: %v", err)
+	}
+
+	// An outage keeps everything cached
+	ok, se, err := guildDeleteMarshaler(m, Event{Type: "GUILD_DELETE", Data: jsoniter.RawMessage(`{"id":"1","unavailable":true}`)})
+	if !ok || err != nil || se.Type != "GUILD_UNAVAILABLE" {
+		t.Fatalf("expected GUILD_UNAVAILABLE to be produced, got %t %q %v", ok, se.Type, err)
+	}
+	if _, err = m.getGuild(snowflake.ID(1)); err != nil {
+		t.Fatalf("expected an unavailable guild to stay cached: %v", err)
+	}
+
+	ok, se, err = guildDeleteMarshaler(m, Event{Type: "GUILD_DELETE", Data: jsoniter.RawMessage(`{"id":"1"}`)})
+	if !ok || err != nil || se.Type != "GUILD_DELETE" {
+		t.Fatalf("expected GUILD_DELETE to be produced, got %t %q %v", ok, se.Type, err)
+	}
+	if payload := se.Data.(GuildDeleteEvent); payload.Guild == nil || payload.Guild.Name != "a" {
+		t.Errorf("expected the cached guild to be produced, got %+v", payload.Guild)
+	}
+
+	keys := m.keys()
+	for key, field := range map[string]string{
+		keys.Guilds():       "1",
+		keys.MemberCounts(): "1",
+		keys.Channels():     "2",
+		keys.Emojis():       "3",
+	} {
+		if m.RedisClient.HExists(m.ctx, key, field).Val() {
+			t.Errorf("expected %s to be removed from %s", field, key)
+		}
+	}
+	if m.RedisClient.Exists(m.ctx, keys.Roles(snowflake.ID(1))).Val() != 0 {
+		t.Error("expected the roles of the guild to be removed")
+	}
+}
+
+func TestGuildDeleteUncachedGuild(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	ok, se, err := guildDeleteMarshaler(m, Event{Type: "GUILD_DELETE", Data: jsoniter.RawMessage(`{"id":"1"}`)})
+	if !ok || err != nil {
+		t.Fatalf("expected GUILD_DELETE to be produced, got %t %v", ok, err)
+	}
+	if payload := se.Data.(GuildDeleteEvent); payload.Guild != nil || payload.GuildID != snowflake.ID(1) {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+func TestGuildCreateTypes(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	for created, expected := range map[guildCreateType]string{
+		guildCreateLoad:      "GUILD_CREATE",
+		guildCreateAvailable: "GUILD_AVAILABLE",
+		guildCreateJoin:      "GUILD_JOIN",
+	} {
+		ok, se, err := guildCreateMarshaler(m, Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{"id":"1"}`), created: created})
+		if !ok || err != nil {
+			t.Fatalf("expected %s to be produced, got %t %v", expected, ok, err)
+		}
+		if se.Type != expected {
+			t.Errorf("expected %s, got %s", expected, se.Type)
+		}
+	}
+}
+
+func TestGuildAllowlist(t *testing.T) {
+	m, _ := testRedisManager(t)
+	m.Configuration.GuildAllowlist = map[string]void{"1": {}}
+
+	if ok, _ := m.OnEvent(Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{"id":"2","name":"b"}`)}); ok {
+		t.Error("expected a guild outside the allowlist to be ignored")
+	}
+	if _, err := m.getGuild(snowflake.ID(2)); err == nil {
+		t.Error("expected a guild outside the allowlist to not be cached")
+	}
+
+	if ok, _ := m.OnEvent(Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{"id":"1","name":"a"}`)}); !ok {
+		t.Error("expected a guild in the allowlist to be produced")
+	}
+	if _, err := m.getGuild(snowflake.ID(1)); err != nil {
+		t.Errorf("expected a guild in the allowlist to be cached: %v", err)
+	}
+
+	if ok, _ := m.OnEvent(Event{Type: "CHANNEL_CREATE", Data: jsoniter.RawMessage(`{"id":"3","guild_id":"2","type":0}`)}); ok {
+		t.Error("expected an event from a guild outside the allowlist to be ignored")
+	}
+	if _, err := m.getChannel(snowflake.ID(3)); err == nil {
+		t.Error("expected a channel outside the allowlist to not be cached")
+	}
+}
+
+func TestEventGuildID(t *testing.T) {
+	tests := []struct {
+		event    Event
+		expected string
+	}{
+		{Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{"id":"1"}`)}, "1"},
+		{Event{Type: "GUILD_DELETE", Data: jsoniter.RawMessage(`{"id":"1","unavailable":true}`)}, "1"},
+		{Event{Type: "MESSAGE_CREATE", Data: jsoniter.RawMessage(`{"id":"2","guild_id":"1"}`)}, "1"},
+		{Event{Type: "MESSAGE_CREATE", Data: jsoniter.RawMessage(`{"id":"2"}`)}, ""},
+		{Event{Type: "READY", Data: jsoniter.RawMessage(`{"v":8,"session_id":"abc"}`)}, ""},
+	}
+
+	for _, test := range tests {
+		if guildID := eventGuildID(test.event); guildID != test.expected {
+			t.Errorf("expected %s %s to belong to %q, got %q", test.event.Type, test.event.Data, test.expected, guildID)
+		}
+	}
+}
+
+func TestDirectMessages(t *testing.T) {
+	tests := []struct {
+		policy   string
+		produced bool
+		cached   bool
+	}{
+		{"", true, false},
+		{DirectMessagesProduce, true, false},
+		{DirectMessagesCache, false, true},
+		{DirectMessagesIgnore, false, false},
+	}
+
+	for _, test := range tests {
+		m, _ := testRedisManager(t)
+		m.Features.DirectMessages = test.policy
+
+		ok, _, err := messageCreateMarshaler(m, Event{Type: "MESSAGE_CREATE", Data: jsoniter.RawMessage(`{
+			"id":"1","channel_id":"2","content":"hi",
+			"author":{"id":"3","username":"a","discriminator":"0001","avatar":""}
+		}`)})
+		if err != nil {
+			t.Fatalf("%q: failed to marshal message: %v", test.policy, err)
+		}
+		if ok != test.produced {
+			t.Errorf("%q: expected the message to be produced to be %t, got %t", test.policy, test.produced, ok)
+		}
+
+		channel, err := m.getChannel(snowflake.ID(2))
+		if cached := err == nil; cached != test.cached {
+			t.Errorf("%q: expected the channel to be cached to be %t, got %t", test.policy, test.cached, cached)
+		}
+		if test.cached && channel.Type != events.ChannelTypeDM {
+			t.Errorf("%q: expected a direct message channel, got type %d", test.policy, channel.Type)
+		}
+	}
+}
+
+func TestDirectMessageChannelCreate(t *testing.T) {
+	tests := []struct {
+		policy   string
+		produced bool
+		cached   bool
+	}{
+		{"", true, true},
+		{DirectMessagesProduce, true, true},
+		{DirectMessagesCache, false, true},
+		{DirectMessagesIgnore, false, false},
+	}
+
+	for _, test := range tests {
+		m, _ := testRedisManager(t)
+		m.Features.DirectMessages = test.policy
+
+		ok, _, err := channelCreateMarshaler(m, Event{Type: "CHANNEL_CREATE", Data: jsoniter.RawMessage(`{"id":"2","type":1}`)})
+		if err != nil {
+			t.Fatalf("%q: failed to marshal channel: %v", test.policy, err)
+		}
+		if ok != test.produced {
+			t.Errorf("%q: expected the channel to be produced to be %t, got %t", test.policy, test.produced, ok)
+		}
+
+		_, err = m.getChannel(snowflake.ID(2))
+		if cached := err == nil; cached != test.cached {
+			t.Errorf("%q: expected the channel to be cached to be %t, got %t", test.policy, test.cached, cached)
+		}
+	}
+
+	// Guild channels are always produced
+	m, _ := testRedisManager(t)
+	m.Features.DirectMessages = DirectMessagesIgnore
+	if ok, _, err := channelCreateMarshaler(m, Event{Type: "CHANNEL_CREATE", Data: jsoniter.RawMessage(`{"id":"4","guild_id":"5","type":0}`)}); !ok || err != nil {
+		t.Errorf("expected a guild channel to be produced, got %t %v", ok, err)
+	}
+}
+
+func TestEventLoggerGuildContext(t *testing.T) {
+	var logs bytes.Buffer
+	m := testManager()
+	m.log = zerolog.New(&logs)
+
+	// The id is not a snowflake so the message fails to marshal
+	if ok, _ := m.OnEvent(Event{ShardID: 3, Type: "MESSAGE_CREATE", Data: jsoniter.RawMessage(`{"id":"a","guild_id":"1"}`)}); ok {
+		t.Fatal("expected the message to fail to marshal")
+	}
+
+	line := logs.Bytes()
+	if message := jsoniter.Get(line, "message").ToString(); message != "Failed to marshal event" {
+		t.Fatalf("expected the marshal error to be logged, got %s", line)
+	}
+	if guildID := jsoniter.Get(line, "guild").ToString(); guildID != "1" {
+		t.Errorf("expected the log to include the guild id, got %s", line)
+	}
+	if shardID := jsoniter.Get(line, "shard").ToInt(); shardID != 3 {
+		t.Errorf("expected the log to include the shard id, got %s", line)
+	}
+	if eventType := jsoniter.Get(line, "type").ToString(); eventType != "MESSAGE_CREATE" {
+		t.Errorf("expected the log to include the event type, got %s", line)
+	}
+}
+
+func TestIgnoreBotsGranular(t *testing.T) {
+	botMessage := Event{Type: "MESSAGE_CREATE", Data: jsoniter.RawMessage(`{
+		"id":"1","channel_id":"2","guild_id":"3","content":"hi",
+		"author":{"id":"4","username":"a","discriminator":"0001","avatar":"","bot":true}
+	}`)}
+	botMemberAdd := Event{Type: "GUILD_MEMBER_ADD", Data: jsoniter.RawMessage(`{
+		"guild_id":"3","roles":[],
+		"user":{"id":"4","username":"a","discriminator":"0001","avatar":"","bot":true}
+	}`)}
+
+	tests := []struct {
+		name      string
+		features  Features
+		messages  bool
+		memberAdd bool
+	}{
+		{"none", Features{}, true, true},
+		{"messages", Features{IgnoreBotMessages: true}, false, true},
+		{"members", Features{IgnoreBotMembers: true}, true, false},
+	}
+
+	for _, test := range tests {
+		m, _ := testRedisManager(t)
+		m.Features = test.features
+
+		ok, _, err := messageCreateMarshaler(m, botMessage)
+		if err != nil || ok != test.messages {
+			t.Errorf("%s: expected the bot message to be produced to be %t, got %t %v", test.name, test.messages, ok, err)
+		}
+
+		ok, _, err = guildMemberAddMarshaler(m, botMemberAdd)
+		if err != nil || ok != test.memberAdd {
+			t.Errorf("%s: expected the bot member add to be produced to be %t, got %t %v", test.name, test.memberAdd, ok, err)
+		}
+	}
+}
+
+func TestGuildAvailableRefreshesMembers(t *testing.T) {
+	for _, refresh := range []bool{true, false} {
+		m, _ := testRedisManager(t)
+		m.Features.CacheMembers = true
+		m.Features.RefreshMembersOnAvailable = refresh
+
+		s, received := testShard(t, 0)
+		s.Manager = m
+
+		for _, created := range []guildCreateType{guildCreateLoad, guildCreateAvailable} {
+			_, _, err := guildCreateMarshaler(m, Event{
+				Type:    "GUILD_CREATE",
+				Data:    jsoniter.RawMessage(`{"id":"1","members":[]}`),
+				Logger:  m.log,
+				created: created,
+				shard:   s,
+			})
+			if err != nil {
+				t.Fatalf("failed to marshal guild: %v", err)
+			}
+		}
+
+		select {
+		case payload := <-received:
+			if !refresh {
+				t.Fatalf("expected members to not be requested, got %s", payload)
+			}
+			if op := jsoniter.Get(payload, "op").ToInt(); op != int(events.GatewayOpRequestGuildMembers) {
+				t.Errorf("expected op %d, got %d", events.GatewayOpRequestGuildMembers, op)
+			}
+			if guildID := jsoniter.Get(payload, "d", "guild_id").ToString(); guildID != "1" {
+				t.Errorf("expected the members of guild 1 to be requested, got %s", payload)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if refresh {
+				t.Fatal("expected the members of the available guild to be requested")
+			}
+		}
+
+		// Only becoming available again requests members
+		select {
+		case payload := <-received:
+			t.Errorf("expected a single request, got %s", payload)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestCheckPrefixCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		content         string
+		caseInsensitive bool
+		expected        bool
+	}{
+		{"s!help", false, true},
+		{"S!help", false, false},
+		{"S!Help", true, true},
+		{"s!help", true, true},
+		{"help", true, false},
+	}
+
+	for _, test := range tests {
+		m, mr := testRedisManager(t)
+		m.Features.CheckPrefixCaseInsensitive = test.caseInsensitive
+		mr.HSet(m.keys().Prefixes(), "1", "s!")
+
+		ok, err := m.hasPrefix(&events.Message{GuildID: snowflake.ID(1), Content: test.content})
+		if err != nil {
+			t.Fatalf("failed to check prefix: %v", err)
+		}
+		if ok != test.expected {
+			t.Errorf("expected %q to match with case insensitivity %t to be %t, got %t", test.content, test.caseInsensitive, test.expected, ok)
+		}
+	}
+}
+
+func TestCheckPrefixMultiplePrefixes(t *testing.T) {
+	m, mr := testRedisManager(t)
+	m.Features.CheckPrefix = true
+	mr.HSet(m.keys().Prefixes(), "1", "!,?,s!")
+
+	for content, expected := range map[string]bool{
+		"!help":  true,
+		"?help":  true,
+		"s!help": true,
+		".help":  false,
+		"help !": false,
+	} {
+		ok, _, err := messageCreateMarshaler(m, Event{Type: "MESSAGE_CREATE", Data: jsoniter.RawMessage(`{
+			"id":"2","channel_id":"3","guild_id":"1","content":` + strconv.Quote(content) + `,
+			"author":{"id":"4","username":"a","discriminator":"0001","avatar":""}
+		}`)})
+		if err != nil {
+			t.Fatalf("failed to marshal message: %v", err)
+		}
+		if ok != expected {
+			t.Errorf("expected %q to be produced to be %t, got %t", content, expected, ok)
+		}
+	}
+
+	// Guilds without prefixes use the default prefixes
+	m.Features.DefaultPrefix = "!,?"
+	for content, expected := range map[string]bool{"?help": true, "s!help": false} {
+		ok, err := m.hasPrefix(&events.Message{GuildID: snowflake.ID(5), Content: content})
+		if err != nil || ok != expected {
+			t.Errorf("expected %q to match the default prefixes to be %t, got %t %v", content, expected, ok, err)
+		}
+	}
+}
+
+func TestStreamEventEncodingRoundTrip(t *testing.T) {
+	se := StreamEvent{
+		Type: "MESSAGE_CREATE",
+		Data: &events.Message{
+			ID:        snowflake.ID(1),
+			ChannelID: snowflake.ID(2),
+			GuildID:   snowflake.ID(3),
+			Author:    &events.User{ID: snowflake.ID(4), Username: "a"},
+			Content:   "hello",
+		},
+	}
+
+	// Consumers rely on these names so they must not change
+	type decoded struct {
+		Type string         `msgpack:"t" json:"t"`
+		Data events.Message `msgpack:"d" json:"d"`
+	}
+
+	for _, encoding := range []string{EncodingMsgpack, EncodingJSON} {
+		m := testManager()
+		m.Configuration.Encoding = encoding
+
+		buf := new(bytes.Buffer)
+		if err := m.newEncoder(buf).Encode(se); err != nil {
+			t.Fatalf("%s: failed to encode: %v", encoding, err)
+		}
+
+		var fields map[string]interface{}
+		var event decoded
+		if encoding == EncodingJSON {
+			if err := jsoniter.Unmarshal(buf.Bytes(), &fields); err != nil {
+				t.Fatalf("%s: failed to decode: %v", encoding, err)
+			}
+			jsoniter.Unmarshal(buf.Bytes(), &event)
+		} else {
+			if err := msgpack.Unmarshal(buf.Bytes(), &fields); err != nil {
+				t.Fatalf("%s: failed to decode: %v", encoding, err)
+			}
+			dec := msgpack.NewDecoder(bytes.NewReader(buf.Bytes()))
+			dec.SetCustomStructTag("json")
+			dec.Decode(&event)
+		}
+
+		if len(fields) != 2 || fields["t"] != "MESSAGE_CREATE" || fields["d"] == nil {
+			t.Errorf("%s: expected only the fields t and d, got %v", encoding, fields)
+		}
+		data, _ := fields["d"].(map[string]interface{})
+		for _, name := range []string{"id", "channel_id", "guild_id", "author", "content"} {
+			if _, ok := data[name]; !ok {
+				t.Errorf("%s: expected the data to use the json field name %s, got %v", encoding, name, data)
+			}
+		}
+
+		message := se.Data.(*events.Message)
+		if event.Type != se.Type || event.Data.ID != message.ID || event.Data.GuildID != message.GuildID ||
+			event.Data.Content != message.Content || event.Data.Author == nil || event.Data.Author.Username != "a" {
+			t.Errorf("%s: expected %+v after a round trip, got %+v", encoding, message, event.Data)
+		}
+	}
+}
+
+func TestGuildEmojisUpdateRemovesDeletedEmojis(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	_, _, err := guildCreateMarshaler(m, Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{
+		"id":"1","name":"a",
+		"emojis":[{"id":"2","name":"a"},{"id":"3","name":"b"},{"id":"4","name":"c"}]
+	}`)})
+	if err != nil {
+		t.Fatalf("failed to create guild: %v", err)
+	}
+
+	ok, se, err := guildEmojisUpdateMarshaler(m, Event{Type: "GUILD_EMOJIS_UPDATE", Data: jsoniter.RawMessage(`{
+		"guild_id":"1",
+		"emojis":[{"id":"2","name":"a"},{"id":"4","name":"d"}]
+	}`)})
+	if !ok || err != nil {
+		t.Fatalf("expected GUILD_EMOJIS_UPDATE to be produced, got %t %v", ok, err)
+	}
+
+	payload := se.Data.(GuildEmojisUpdateEvent)
+	if len(payload.Before) != 3 || len(payload.After) != 2 {
+		t.Errorf("expected 3 emojis before and 2 after, got %d and %d", len(payload.Before), len(payload.After))
+	}
+
+	if _, err = m.getEmoji(snowflake.ID(3)); err != ErrStateNotFound {
+		t.Errorf("expected the deleted emoji to be removed, got %v", err)
+	}
+	if emoji, err := m.getEmoji(snowflake.ID(4)); err != nil || emoji.Name != "d" {
+		t.Errorf("expected the renamed emoji to be updated, got %+v %v", emoji, err)
+	}
+
+	guild, err := m.getGuild(snowflake.ID(1))
+	if err != nil {
+		t.Fatalf("failed to get guild: %v", err)
+	}
+	if len(guild.Emojis) != 2 {
+		t.Errorf("expected the cached guild to have 2 emojis, got %d", len(guild.Emojis))
+	}
+}
+
+func TestGuildRoleCreateAndDelete(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	_, _, err := guildCreateMarshaler(m, Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{
+		"id":"1","name":"a","roles":[{"id":"1","name":"@everyone"}]
+	}`)})
+	if err != nil {
+		t.Fatalf("failed to create guild: %v", err)
+	}
+
+	ok, se, err := guildRoleCreateMarshaler(m, Event{Type: "GUILD_ROLE_CREATE", Data: jsoniter.RawMessage(`{
+		"guild_id":"1","role":{"id":"2","name":"moderator","position":1}
+	}`)})
+	if !ok || err != nil {
+		t.Fatalf("expected GUILD_ROLE_CREATE to be produced, got %t %v", ok, err)
+	}
+	if payload := se.Data.(*events.GuildRoleCreate); payload.Role == nil || payload.Role.Name != "moderator" {
+		t.Errorf("expected the created role to be produced, got %+v", payload.Role)
+	}
+
+	if role, err := m.getRole(snowflake.ID(1), snowflake.ID(2)); err != nil || role.Name != "moderator" {
+		t.Errorf("expected the created role to be cached, got %+v %v", role, err)
+	}
+	guild, _ := m.getGuild(snowflake.ID(1))
+	if len(guild.Roles) != 2 || guild.Roles[1].ID != snowflake.ID(2) {
+		t.Errorf("expected the created role to be added to the guild, got %v", guild.Roles)
+	}
+
+	ok, se, err = guildRoleDeleteMarshaler(m, Event{Type: "GUILD_ROLE_DELETE", Data: jsoniter.RawMessage(`{"guild_id":"1","role_id":"2"}`)})
+	if !ok || err != nil {
+		t.Fatalf("expected GUILD_ROLE_DELETE to be produced, got %t %v", ok, err)
+	}
+	if payload := se.Data.(GuildRoleDeleteEvent); payload.Role == nil || payload.Role.Name != "moderator" {
+		t.Errorf("expected the deleted role to be produced, got %+v", payload.Role)
+	}
+
+	if _, err = m.getRole(snowflake.ID(1), snowflake.ID(2)); err != ErrStateNotFound {
+		t.Errorf("expected the deleted role to be removed, got %v", err)
+	}
+	guild, _ = m.getGuild(snowflake.ID(1))
+	if len(guild.Roles) != 1 || guild.Roles[0].ID != snowflake.ID(1) {
+		t.Errorf("expected the deleted role to be removed from the guild, got %v", guild.Roles)
+	}
+}
@@ -0,0 +1,230 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The reasons an event can be dropped
+const (
+	DropReasonBlacklisted  = "blacklisted"
+	DropReasonNotAllowed   = "not_allowed"
+	DropReasonDuplicate    = "duplicate"
+	DropReasonNoMarshaler  = "no_marshaler"
+	DropReasonIgnored      = "ignored"
+	DropReasonMarshalError = "marshal_error"
+	DropReasonEncodeError  = "encode_error"
+	DropReasonPublishError = "publish_error"
+	DropReasonOversized    = "oversized"
+)
+
+// metricsRateInterval is how often the events produced per second is
+// calculated
+const metricsRateInterval = 5 * time.Second
+
+// Metrics is a snapshot of the health of the Manager
+type Metrics struct {
+	Shards      int                 `json:"shards"`
+	ShardStatus map[int]ShardStatus `json:"shard_status"`
+
+	EventsReceived  int64   `json:"events_received"`
+	EventsProduced  int64   `json:"events_produced"`
+	EventsPerSecond float64 `json:"events_per_second"`
+	EventsPending   int64   `json:"events_pending"`
+
+	AbnormalClosures int64 `json:"abnormal_closures"`
+	DroppedOversized int64 `json:"dropped_oversized"`
+
+	RedisHealthy  bool `json:"redis_healthy"`
+	RedisBuffered int  `json:"redis_buffered"`
+	NatsHealthy   bool `json:"nats_healthy"`
+
+	StanHealthy    bool  `json:"stan_healthy"`
+	NatsReconnects int64 `json:"nats_reconnects"`
+
+	CacheStats map[string]CacheStat `json:"cache_stats"`
+}
+
+// prometheusMetrics contains the Prometheus collectors of a Manager. Each
+// Manager has its own registry so multiple Managers can run in the same
+// process.
+type prometheusMetrics struct {
+	registry *prometheus.Registry
+
+	received      *prometheus.CounterVec
+	produced      *prometheus.CounterVec
+	drops         *prometheus.CounterVec
+	marshalErrors *prometheus.CounterVec
+	ackFailures   *prometheus.CounterVec
+
+	identifyWait     prometheus.Histogram
+	identifyWaitLast *prometheus.GaugeVec
+}
+
+func newPrometheusMetrics() (pm *prometheusMetrics) {
+	pm = &prometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sandwich_events_received_total",
+			Help: "Events received from Discord",
+		}, []string{"event"}),
+		produced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sandwich_events_produced_total",
+			Help: "Events produced to consumers",
+		}, []string{"event"}),
+		drops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sandwich_events_dropped_total",
+			Help: "Events that were not produced",
+		}, []string{"reason"}),
+		marshalErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sandwich_marshal_errors_total",
+			Help: "Events that failed to marshal",
+		}, []string{"event"}),
+		ackFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sandwich_publish_ack_failures_total",
+			Help: "Asynchronous publishes that failed once they had been published",
+		}, []string{"mode"}),
+	}
+
+	pm.identifyWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sandwich_identify_wait_seconds",
+		Help:    "Time Shards spent waiting for the identify ratelimits",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	pm.identifyWaitLast = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sandwich_identify_wait_last_seconds",
+		Help: "Time each Shard last spent waiting for the identify ratelimits",
+	}, []string{"shard"})
+
+	pm.registry.MustRegister(pm.received, pm.produced, pm.drops, pm.marshalErrors,
+		pm.ackFailures, pm.identifyWait, pm.identifyWaitLast)
+	return
+}
+
+func (pm *prometheusMetrics) identifyWaited(shardID int, wait time.Duration) {
+	pm.identifyWait.Observe(wait.Seconds())
+	pm.identifyWaitLast.WithLabelValues(strconv.Itoa(shardID)).Set(wait.Seconds())
+}
+
+func (pm *prometheusMetrics) dropped(reason string) {
+	pm.drops.WithLabelValues(reason).Inc()
+}
+
+// MetricsHandler returns a http.Handler that serves the Prometheus metrics
+// of the Manager.
+func (m *Manager) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(m.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// metricsRate calculates the events produced per second
+type metricsRate struct {
+	mu       sync.RWMutex
+	last     int64
+	lastTime time.Time
+	rate     float64
+}
+
+func (mr *metricsRate) sample(produced int64, now time.Time) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if !mr.lastTime.IsZero() {
+		mr.rate = float64(produced-mr.last) / now.Sub(mr.lastTime).Seconds()
+	}
+	mr.last = produced
+	mr.lastTime = now
+}
+
+func (mr *metricsRate) get() float64 {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	return mr.rate
+}
+
+// Metrics returns a snapshot of the health of the Manager
+func (m *Manager) Metrics() Metrics {
+	status := m.Status()
+
+	return Metrics{
+		Shards:      len(status),
+		ShardStatus: status,
+
+		EventsReceived:  atomic.LoadInt64(m.received),
+		EventsProduced:  atomic.LoadInt64(m.produced),
+		EventsPerSecond: m.rate.get(),
+		EventsPending:   atomic.LoadInt64(m.pending),
+
+		AbnormalClosures: m.AbnormalClosures(),
+		DroppedOversized: m.DroppedOversized(),
+
+		RedisHealthy:  m.RedisClient.Healthy(),
+		RedisBuffered: m.RedisClient.Buffered(),
+		NatsHealthy:   m.NatsClient != nil && m.NatsClient.IsConnected(),
+
+		StanHealthy:    m.StanHealthy(),
+		NatsReconnects: m.NatsReconnects(),
+
+		CacheStats: m.CacheStats(),
+	}
+}
+
+// ServeMetrics starts a HTTP server on addr that serves the Metrics as
+// JSON on /metrics and in the Prometheus format on /prometheus. /health
+// responds with 200 if redis and the Producer are healthy and 503 if
+// not. This will block until the server has stopped.
+func (m *Manager) ServeMetrics(addr string) error {
+	stop := make(chan void)
+	defer close(stop)
+	go m.sampleRate(stop)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handleMetrics)
+	mux.Handle("/prometheus", m.MetricsHandler())
+	mux.HandleFunc("/health", m.handleHealth)
+
+	return http.ListenAndServe(addr, mux)
+}
+
+// sampleRate samples the events produced every metricsRateInterval until
+// stop is closed.
+func (m *Manager) sampleRate(stop chan void) {
+	ticker := time.NewTicker(metricsRateInterval)
+	defer ticker.Stop()
+
+	m.rate.sample(atomic.LoadInt64(m.produced), time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			m.rate.sample(atomic.LoadInt64(m.produced), now)
+		}
+	}
+}
+
+func (m *Manager) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(m.Metrics())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (m *Manager) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !m.RedisClient.Healthy() || !m.producerHealthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
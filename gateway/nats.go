@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/stan.go"
+)
+
+// stanReconnectWait is how long to wait between attempts to recreate the
+// STAN connection
+const stanReconnectWait = 2 * time.Second
+
+// natsOptions returns the options to connect to NATS with including any
+// credentials and TLS that are configured
+func (m *Manager) natsOptions() (options []nats.Option, err error) {
+	conf := m.Configuration.Nats
+
+	options = []nats.Option{
+		nats.MaxReconnects(conf.MaxReconnects),
+		nats.DisconnectErrHandler(m.onNatsDisconnect),
+		nats.ReconnectHandler(m.onNatsReconnect),
+		nats.ClosedHandler(m.onNatsClosed),
+	}
+
+	switch {
+	case conf.CredentialsFile != "":
+		options = append(options, nats.UserCredentials(conf.CredentialsFile))
+	case conf.NKeySeedFile != "":
+		var option nats.Option
+		if option, err = nats.NkeyOptionFromSeed(conf.NKeySeedFile); err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+	case conf.Token != "":
+		options = append(options, nats.Token(conf.Token))
+	case conf.Username != "":
+		options = append(options, nats.UserInfo(conf.Username, conf.Password))
+	}
+
+	if conf.TLS.RootCAFile != "" {
+		options = append(options, nats.RootCAs(conf.TLS.RootCAFile))
+	}
+
+	if conf.TLS.CertFile != "" || conf.TLS.KeyFile != "" {
+		options = append(options, nats.ClientCert(conf.TLS.CertFile, conf.TLS.KeyFile))
+	}
+	return
+}
+
+// stanOptions returns the options to connect to NATS Streaming with
+func (m *Manager) stanOptions() (options []stan.Option) {
+	conf := m.Configuration.Nats
+
+	options = []stan.Option{
+		stan.NatsConn(m.NatsClient),
+		stan.SetConnectionLostHandler(m.onStanConnectionLost),
+	}
+
+	if conf.PublishAckWait > 0 {
+		options = append(options, stan.PubAckWait(time.Duration(conf.PublishAckWait)*time.Millisecond))
+	}
+
+	if conf.MaxPublishesInflight > 0 {
+		options = append(options, stan.MaxPubAcksInflight(conf.MaxPublishesInflight))
+	}
+	return
+}
+
+// jetStreamOptions returns the options to create the JetStream context
+// with
+func (m *Manager) jetStreamOptions() (options []nats.JSOpt) {
+	conf := m.Configuration.Nats
+
+	if conf.PublishAckWait > 0 {
+		options = append(options, nats.MaxWait(time.Duration(conf.PublishAckWait)*time.Millisecond))
+	}
+
+	if conf.MaxPublishesInflight > 0 {
+		options = append(options, nats.PublishAsyncMaxPending(conf.MaxPublishesInflight))
+	}
+	return
+}
+
+// Stan returns the current STAN connection. The connection is replaced
+// whenever it has to be recreated so it should not be kept.
+func (m *Manager) Stan() stan.Conn {
+	m.stanMu.RLock()
+	defer m.stanMu.RUnlock()
+
+	return m.StanClient
+}
+
+// StanHealthy returns if the STAN connection is currently usable. When
+// using JetStream, there is no STAN connection so this is always true.
+func (m *Manager) StanHealthy() bool {
+	return m.Configuration.Nats.Mode != NatsModeStan || atomic.LoadInt32(m.stanHealthy) == 1
+}
+
+// producerHealthy returns if the Producer is able to publish events.
+// The redis Producer is healthy whenever redis is.
+func (m *Manager) producerHealthy() bool {
+	if m.Configuration.Producer == ProducerRedis {
+		return true
+	}
+	return m.NatsClient != nil && m.NatsClient.IsConnected() && m.StanHealthy()
+}
+
+// NatsReconnects returns how many times NATS has reconnected
+func (m *Manager) NatsReconnects() int64 {
+	return atomic.LoadInt64(m.natsReconnects)
+}
+
+func (m *Manager) onNatsDisconnect(nc *nats.Conn, err error) {
+	m.log.Warn().Err(err).Msg("Disconnected from NATS, reconnecting")
+}
+
+// onNatsReconnect recreates the STAN connection as it does not survive
+// the NATS connection it uses reconnecting. JetStream uses the NATS
+// connection directly so does not need recreating.
+func (m *Manager) onNatsReconnect(nc *nats.Conn) {
+	atomic.AddInt64(m.natsReconnects, 1)
+	m.log.Info().Str("url", nc.ConnectedUrl()).Msg("Reconnected to NATS")
+
+	if m.Configuration.Nats.Mode == NatsModeStan {
+		go m.reconnectStan()
+	}
+}
+
+func (m *Manager) onNatsClosed(nc *nats.Conn) {
+	atomic.StoreInt32(m.stanHealthy, 0)
+	m.log.Error().Err(nc.LastError()).Msg("NATS connection has closed and will not reconnect")
+}
+
+func (m *Manager) onStanConnectionLost(_ stan.Conn, err error) {
+	atomic.StoreInt32(m.stanHealthy, 0)
+	m.log.Warn().Err(err).Msg("Lost connection to NATS Streaming, reconnecting")
+
+	go m.reconnectStan()
+}
+
+// reconnectStan recreates the STAN connection until it succeeds or the
+// NATS connection has closed. Only one reconnect runs at a time.
+func (m *Manager) reconnectStan() {
+	if !atomic.CompareAndSwapInt32(m.stanReconnecting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(m.stanReconnecting, 0)
+
+	atomic.StoreInt32(m.stanHealthy, 0)
+	if sc := m.Stan(); sc != nil {
+		sc.Close()
+	}
+
+	for attempt := 1; !m.NatsClient.IsClosed(); attempt++ {
+		if !m.NatsClient.IsConnected() {
+			time.Sleep(stanReconnectWait)
+			continue
+		}
+
+		m.log.Info().Int("attempt", attempt).Msg("Reconnecting to NATS Streaming")
+		err := m.connectStan()
+		if err == nil {
+			m.log.Info().Msg("Reconnected to NATS Streaming")
+			return
+		}
+
+		m.log.Warn().Err(err).Int("attempt", attempt).Msg("Failed to reconnect to NATS Streaming")
+		time.Sleep(stanReconnectWait)
+	}
+}
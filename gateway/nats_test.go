@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// applyNatsOptions returns the nats.Options natsOptions would connect
+// with
+func applyNatsOptions(t *testing.T, m *Manager) nats.Options {
+	options, err := m.natsOptions()
+	if err != nil {
+		t.Fatalf("failed to create nats options: %v", err)
+	}
+
+	opts := nats.GetDefaultOptions()
+	for _, option := range options {
+		if err = option(&opts); err != nil {
+			t.Fatalf("failed to apply nats option: %v", err)
+		}
+	}
+	return opts
+}
+
+// writeFile writes data to a file in a temporary directory and returns
+// its path
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// testCertificate returns a self signed certificate and its key encoded
+// as PEM
+func testCertificate(t *testing.T) (certPEM []byte, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sandwich"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return
+}
+
+func TestNatsOptionsUserInfo(t *testing.T) {
+	m := testManager()
+	m.Configuration.Nats.Username = "sandwich"
+	m.Configuration.Nats.Password = "password"
+
+	opts := applyNatsOptions(t, m)
+	if opts.User != "sandwich" || opts.Password != "password" {
+		t.Errorf("expected the username and password to be used, got %q and %q", opts.User, opts.Password)
+	}
+	if opts.Secure {
+		t.Error("expected TLS to not be used")
+	}
+}
+
+func TestNatsOptionsToken(t *testing.T) {
+	m := testManager()
+	m.Configuration.Nats.Token = "token"
+
+	if opts := applyNatsOptions(t, m); opts.Token != "token" || opts.User != "" {
+		t.Errorf("expected only the token to be used, got %q and %q", opts.Token, opts.User)
+	}
+}
+
+func TestNatsOptionsNKey(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatalf("failed to create nkey: %v", err)
+	}
+	seed, _ := user.Seed()
+	publicKey, _ := user.PublicKey()
+
+	m := testManager()
+	m.Configuration.Nats.NKeySeedFile = writeFile(t, "user.nk", seed)
+
+	opts := applyNatsOptions(t, m)
+	if opts.Nkey != publicKey {
+		t.Errorf("expected the nkey %s to be used, got %q", publicKey, opts.Nkey)
+	}
+	if opts.SignatureCB == nil {
+		t.Error("expected nonces to be signed with the seed")
+	}
+
+	m.Configuration.Nats.NKeySeedFile = filepath.Join(t.TempDir(), "missing.nk")
+	if _, err := m.natsOptions(); err == nil {
+		t.Error("expected a missing seed file to return an error")
+	}
+}
+
+func TestNatsOptionsCredentials(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatalf("failed to create nkey: %v", err)
+	}
+	seed, _ := user.Seed()
+
+	jwt := "eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.e30.c2lnbmF0dXJl"
+	creds := "-----BEGIN NATS USER JWT-----\n" + jwt + "\n------END NATS USER JWT------\n\n" +
+		"-----BEGIN USER NKEY SEED-----\n" + string(seed) + "\n------END USER NKEY SEED------\n"
+
+	m := testManager()
+	m.Configuration.Nats.CredentialsFile = writeFile(t, "user.creds", []byte(creds))
+
+	opts := applyNatsOptions(t, m)
+	if opts.UserJWT == nil || opts.SignatureCB == nil {
+		t.Fatal("expected the credentials file to be used")
+	}
+	if userJWT, err := opts.UserJWT(); err != nil || userJWT != jwt {
+		t.Errorf("expected the jwt to be read from the credentials file, got %q %v", userJWT, err)
+	}
+}
+
+func TestNatsOptionsTLS(t *testing.T) {
+	certPEM, keyPEM := testCertificate(t)
+
+	m := testManager()
+	m.Configuration.Nats.TLS.RootCAFile = writeFile(t, "ca.pem", certPEM)
+	m.Configuration.Nats.TLS.CertFile = writeFile(t, "cert.pem", certPEM)
+	m.Configuration.Nats.TLS.KeyFile = writeFile(t, "key.pem", keyPEM)
+
+	if opts := applyNatsOptions(t, m); !opts.Secure {
+		t.Error("expected TLS to be used")
+	}
+}
@@ -0,0 +1,166 @@
+package gateway
+
+import (
+	"sort"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+)
+
+// The types of permission overwrites
+const (
+	overwriteTypeRole   = "role"
+	overwriteTypeMember = "member"
+)
+
+// Roles sorts roles from the highest position to the lowest. Roles with
+// the same position are sorted by id from the highest to the lowest so
+// the order is always the same.
+type Roles []*events.Role
+
+func (r Roles) Len() int {
+	return len(r)
+}
+
+func (r Roles) Less(i, j int) bool {
+	if r[i].Position == r[j].Position {
+		return r[i].ID > r[j].ID
+	}
+	return r[i].Position > r[j].Position
+}
+
+func (r Roles) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+// memberColor returns the color of the highest role of a member that has
+// a color. If none of their roles have a color, 0 is returned.
+func memberColor(guild *events.Guild, member *events.GuildMember) int {
+	roles := make(map[snowflake.ID]bool, len(member.Roles))
+	for _, roleID := range member.Roles {
+		roles[roleID] = true
+	}
+
+	memberRoles := make(Roles, 0, len(member.Roles))
+	for _, role := range guild.Roles {
+		if roles[role.ID] {
+			memberRoles = append(memberRoles, role)
+		}
+	}
+	sort.Sort(memberRoles)
+
+	for _, role := range memberRoles {
+		if role.Color != 0 {
+			return role.Color
+		}
+	}
+	return 0
+}
+
+// memberPermissions returns the permissions of a member in a channel of
+// a guild. If channel is nil, the permissions in the guild are returned.
+// Permissions are applied in the order Discord applies them:
+//
+//	the @everyone role, which has the id of the guild
+//	every role of the member, added together
+//	the @everyone overwrite of the channel
+//	the overwrites of every role of the member, added together
+//	the overwrite of the member
+func memberPermissions(guild *events.Guild, channel *events.Channel, member *events.GuildMember) (permissions events.Permissions) {
+	if member.User != nil && member.User.ID.String() == guild.OwnerID {
+		return events.PermissionAll
+	}
+
+	roles := make(map[snowflake.ID]bool, len(member.Roles))
+	for _, roleID := range member.Roles {
+		roles[roleID] = true
+	}
+
+	for _, role := range guild.Roles {
+		if role.ID.String() == guild.ID || roles[role.ID] {
+			permissions |= role.Permissions
+		}
+	}
+
+	if permissions.Has(events.PermissionAdministrator) {
+		return events.PermissionAll
+	}
+
+	if channel == nil {
+		return
+	}
+
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.ID.String() == guild.ID {
+			permissions &^= overwrite.Deny
+			permissions |= overwrite.Allow
+			break
+		}
+	}
+
+	var allow, deny events.Permissions
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type == overwriteTypeRole && roles[overwrite.ID] {
+			allow |= overwrite.Allow
+			deny |= overwrite.Deny
+		}
+	}
+	permissions &^= deny
+	permissions |= allow
+
+	if member.User == nil {
+		return
+	}
+
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type == overwriteTypeMember && overwrite.ID == member.User.ID {
+			permissions &^= overwrite.Deny
+			permissions |= overwrite.Allow
+			break
+		}
+	}
+	return
+}
+
+// UserChannelPermissions returns the permissions a user has in a channel
+// of a guild using the state. If channelID is 0, the permissions the
+// user has in the guild are returned. ErrStateNotFound is returned if
+// the guild, member or channel is not cached.
+func (m *Manager) UserChannelPermissions(guildID snowflake.ID, userID snowflake.ID, channelID snowflake.ID) (permissions events.Permissions, err error) {
+	guild, err := m.getGuild(guildID)
+	if err != nil {
+		return
+	}
+
+	member, err := m.getMember(guildID, userID)
+	if err != nil {
+		return
+	}
+
+	var channel *events.Channel
+	if channelID != 0 {
+		if channel, err = m.getChannel(channelID); err != nil {
+			return
+		}
+	}
+
+	return memberPermissions(guild, channel, member), nil
+}
+
+// UserColor returns the color of the highest role of a user in a guild
+// that has a color using the state. If none of their roles have a color,
+// 0 is returned. ErrStateNotFound is returned if the guild or member is
+// not cached.
+func (m *Manager) UserColor(guildID snowflake.ID, userID snowflake.ID) (color int, err error) {
+	guild, err := m.getGuild(guildID)
+	if err != nil {
+		return
+	}
+
+	member, err := m.getMember(guildID, userID)
+	if err != nil {
+		return
+	}
+
+	return memberColor(guild, member), nil
+}
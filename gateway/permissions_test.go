@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+)
+
+// The ids used by the permission tests. The @everyone role has the id of
+// the guild.
+const (
+	testGuildID    snowflake.ID = 1
+	testOwnerID    snowflake.ID = 2
+	testUserID     snowflake.ID = 3
+	testModRoleID  snowflake.ID = 4
+	testMuteRoleID snowflake.ID = 5
+	testAdminID    snowflake.ID = 6
+)
+
+// testPermissionsGuild returns a guild where @everyone can view channels
+// and send messages, the mod role can manage messages and the admin
+// role has administrator
+func testPermissionsGuild() *events.Guild {
+	return &events.Guild{
+		ID:      testGuildID.String(),
+		OwnerID: testOwnerID.String(),
+		Roles: []*events.Role{
+			{ID: testGuildID, Permissions: events.PermissionViewChannel | events.PermissionSendMessages},
+			{ID: testModRoleID, Position: 2, Permissions: events.PermissionManageMessages},
+			{ID: testMuteRoleID, Position: 1},
+			{ID: testAdminID, Position: 3, Permissions: events.PermissionAdministrator},
+		},
+	}
+}
+
+func TestMemberPermissions(t *testing.T) {
+	base := events.PermissionViewChannel | events.PermissionSendMessages
+
+	tests := []struct {
+		name       string
+		roles      []snowflake.ID
+		userID     snowflake.ID
+		overwrites []events.Overwrite
+		noChannel  bool
+		expected   events.Permissions
+	}{
+		{
+			name:      "@everyone role",
+			userID:    testUserID,
+			noChannel: true,
+			expected:  base,
+		},
+		{
+			name:      "roles are added together",
+			roles:     []snowflake.ID{testModRoleID, testMuteRoleID},
+			userID:    testUserID,
+			noChannel: true,
+			expected:  base | events.PermissionManageMessages,
+		},
+		{
+			name:   "@everyone overwrite",
+			userID: testUserID,
+			overwrites: []events.Overwrite{
+				{ID: testGuildID, Type: overwriteTypeRole, Deny: events.PermissionSendMessages, Allow: events.PermissionAddReactions},
+			},
+			expected: events.PermissionViewChannel | events.PermissionAddReactions,
+		},
+		{
+			// The allows of every role overwrite are applied after the
+			// denies so an allow wins over a deny from another role.
+			name:   "role overwrites are combined",
+			roles:  []snowflake.ID{testModRoleID, testMuteRoleID},
+			userID: testUserID,
+			overwrites: []events.Overwrite{
+				{ID: testMuteRoleID, Type: overwriteTypeRole, Deny: events.PermissionSendMessages | events.PermissionAddReactions},
+				{ID: testModRoleID, Type: overwriteTypeRole, Allow: events.PermissionSendMessages},
+			},
+			expected: base | events.PermissionManageMessages,
+		},
+		{
+			name:   "role overwrites apply after @everyone",
+			roles:  []snowflake.ID{testModRoleID},
+			userID: testUserID,
+			overwrites: []events.Overwrite{
+				{ID: testGuildID, Type: overwriteTypeRole, Deny: events.PermissionSendMessages},
+				{ID: testModRoleID, Type: overwriteTypeRole, Allow: events.PermissionSendMessages},
+			},
+			expected: base | events.PermissionManageMessages,
+		},
+		{
+			name:   "member overwrite wins",
+			roles:  []snowflake.ID{testModRoleID},
+			userID: testUserID,
+			overwrites: []events.Overwrite{
+				{ID: testModRoleID, Type: overwriteTypeRole, Allow: events.PermissionSendMessages},
+				{ID: testUserID, Type: overwriteTypeMember, Deny: events.PermissionSendMessages},
+			},
+			expected: events.PermissionViewChannel | events.PermissionManageMessages,
+		},
+		{
+			name:   "overwrites of other members are ignored",
+			userID: testUserID,
+			overwrites: []events.Overwrite{
+				{ID: testOwnerID, Type: overwriteTypeMember, Deny: events.PermissionSendMessages},
+			},
+			expected: base,
+		},
+		{
+			name:   "administrator ignores overwrites",
+			roles:  []snowflake.ID{testAdminID},
+			userID: testUserID,
+			overwrites: []events.Overwrite{
+				{ID: testGuildID, Type: overwriteTypeRole, Deny: events.PermissionViewChannel},
+				{ID: testUserID, Type: overwriteTypeMember, Deny: events.PermissionSendMessages},
+			},
+			expected: events.PermissionAll,
+		},
+		{
+			name:   "owner",
+			userID: testOwnerID,
+			overwrites: []events.Overwrite{
+				{ID: testOwnerID, Type: overwriteTypeMember, Deny: events.PermissionViewChannel},
+			},
+			expected: events.PermissionAll,
+		},
+	}
+
+	guild := testPermissionsGuild()
+	for _, test := range tests {
+		member := &events.GuildMember{User: &events.User{ID: test.userID}, Roles: test.roles}
+
+		var channel *events.Channel
+		if !test.noChannel {
+			channel = &events.Channel{PermissionOverwrites: test.overwrites}
+		}
+
+		if permissions := memberPermissions(guild, channel, member); permissions != test.expected {
+			t.Errorf("%s: expected permissions %b, got %b", test.name, test.expected, permissions)
+		}
+	}
+}
+
+func TestRolesWithEqualPositions(t *testing.T) {
+	older := &events.Role{ID: 10, Position: 1, Color: 0xff0000}
+	newer := &events.Role{ID: 20, Position: 1, Color: 0x00ff00}
+	higher := &events.Role{ID: 5, Position: 2}
+
+	// Sorting must not depend on the order the roles are cached in
+	for _, roles := range []Roles{{older, newer, higher}, {newer, higher, older}} {
+		if !roles.Less(indexOf(roles, newer), indexOf(roles, older)) {
+			t.Error("expected the role with the larger id to sort first when positions are equal")
+		}
+		if !roles.Less(indexOf(roles, higher), indexOf(roles, newer)) {
+			t.Error("expected the role with the higher position to sort first")
+		}
+
+		guild := &events.Guild{ID: "1", Roles: roles}
+		member := &events.GuildMember{Roles: []snowflake.ID{older.ID, newer.ID, higher.ID}}
+		if color := memberColor(guild, member); color != newer.Color {
+			t.Errorf("expected the color of the role with the larger id, got %x", color)
+		}
+	}
+
+	// Roles without a color are skipped
+	guild := &events.Guild{ID: "1", Roles: []*events.Role{older, newer, higher}}
+	member := &events.GuildMember{Roles: []snowflake.ID{higher.ID}}
+	if color := memberColor(guild, member); color != 0 {
+		t.Errorf("expected no color, got %x", color)
+	}
+}
+
+// indexOf returns the index of role in roles
+func indexOf(roles Roles, role *events.Role) int {
+	for i := range roles {
+		if roles[i] == role {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,114 @@
+package gateway
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+)
+
+// UpdatePresence changes the presence of every Shard. The name of the
+// game may include {shard} and {total} which are replaced with the id of
+// each Shard and the shard count so large bots can show which Shard a
+// guild is on, such as "Shard {shard}/{total}". The presence is also
+// used when Shards identify afterwards, instead of DefaultPresence, and
+// replaces any presence set with UpdateShardPresence. Every Shard is
+// updated even if some fail and the first error is returned.
+func (m *Manager) UpdatePresence(status events.UpdateStatus) (err error) {
+	m.presenceMu.Lock()
+	m.presence = &status
+	m.shardPresences = make(map[int]events.UpdateStatus)
+	m.presenceMu.Unlock()
+
+	// Sending can block on the websocket so the Shards are sent to once
+	// the locks have been released.
+	for _, shard := range m.shards() {
+		if shardErr := shard.UpdatePresence(status); shardErr != nil {
+			m.log.Warn().Int("shard", shard.ShardID).Err(shardErr).Msg("Failed to update presence")
+			if err == nil {
+				err = shardErr
+			}
+		}
+	}
+	return
+}
+
+// shards returns every Shard of every ShardGroup
+func (m *Manager) shards() (shards []*Shard) {
+	m.ShardGroupsMu.Lock()
+	defer m.ShardGroupsMu.Unlock()
+
+	for _, sg := range m.ShardGroups {
+		sg.ShardsMu.Lock()
+		for _, shard := range sg.Shards {
+			shards = append(shards, shard)
+		}
+		sg.ShardsMu.Unlock()
+	}
+	return
+}
+
+// UpdateShardPresence changes the presence of a single Shard of the
+// current ShardGroup. The presence is kept when the Shard identifies
+// again. {shard} and {total} in the name of the game are replaced.
+func (m *Manager) UpdateShardPresence(shardID int, status events.UpdateStatus) (err error) {
+	shard, err := m.currentShard(shardID)
+	if err != nil {
+		return
+	}
+
+	m.presenceMu.Lock()
+	m.shardPresences[shardID] = status
+	m.presenceMu.Unlock()
+
+	return shard.UpdatePresence(status)
+}
+
+// UpdatePresence changes the presence of the Shard. {shard} and {total}
+// in the name of the game are replaced. Like every payload, it is sent
+// whilst holding the wsMutex.
+func (s *Shard) UpdatePresence(status events.UpdateStatus) (err error) {
+	return s.WSWriteJSON(events.SentPayload{
+		Op:   int(events.GatewayOpStatusUpdate),
+		Data: s.shardPresence(status),
+	})
+}
+
+// presence returns the presence the Shard identifies with. This is the
+// last presence passed to UpdateShardPresence or UpdatePresence or
+// DefaultPresence if there was none. nil is returned if none are set.
+func (s *Shard) presence() *events.UpdateStatus {
+	s.Manager.presenceMu.RLock()
+	presence := s.Manager.presence
+	if status, ok := s.Manager.shardPresences[s.ShardID]; ok {
+		presence = &status
+	}
+	s.Manager.presenceMu.RUnlock()
+
+	if presence == nil {
+		if s.Manager.Configuration.DefaultPresence == nil {
+			return nil
+		}
+
+		presence = &events.UpdateStatus{
+			Game:   s.Manager.Configuration.DefaultPresence,
+			Status: events.StatusOnline,
+		}
+	}
+
+	return s.shardPresence(*presence)
+}
+
+// shardPresence returns a copy of the presence with the placeholders in
+// the name of the game replaced for the Shard
+func (s *Shard) shardPresence(status events.UpdateStatus) *events.UpdateStatus {
+	if status.Game != nil {
+		game := *status.Game
+		game.Name = strings.NewReplacer(
+			"{shard}", strconv.Itoa(s.ShardID),
+			"{total}", strconv.Itoa(s.ShardCount),
+		).Replace(game.Name)
+		status.Game = &game
+	}
+	return &status
+}
@@ -0,0 +1,56 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+)
+
+func TestUpdatePresence(t *testing.T) {
+	m := testManager()
+	s, received := testShard(t, 3)
+	s.Manager = m
+	s.ShardCount = 10
+
+	m.ShardGroups = map[int]*ShardGroup{0: {Shards: map[int]*Shard{3: s}}}
+
+	// Whilst a Shard is blocked sending, the ShardGroups must not be
+	// locked so other Shards can still be managed.
+	s.wsMutex.Lock()
+	done := make(chan error)
+	go func() {
+		done <- m.UpdatePresence(events.UpdateStatus{
+			Status: events.StatusIdle,
+			Game:   &events.Activity{Name: "Shard {shard}/{total}"},
+		})
+	}()
+
+	locked := make(chan void)
+	go func() {
+		m.ShardGroupsMu.Lock()
+		m.ShardGroups[0].ShardsMu.Lock()
+		m.ShardGroups[0].ShardsMu.Unlock()
+		m.ShardGroupsMu.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the ShardGroups to not be locked whilst sending")
+	}
+	s.wsMutex.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("failed to update presence: %v", err)
+	}
+
+	payload := receive(t, received)
+	if op := json.Get(payload, "op").ToInt(); op != int(events.GatewayOpStatusUpdate) {
+		t.Errorf("expected op %d, got %d", events.GatewayOpStatusUpdate, op)
+	}
+	if name := json.Get(payload, "d", "game", "name").ToString(); name != "Shard 3/10" {
+		t.Errorf("expected the placeholders to be replaced, got %q in %s", name, payload)
+	}
+}
@@ -0,0 +1,246 @@
+package gateway
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrPublishAckTimeout is returned when closing a producer whilst
+// publishes are still waiting to be acknowledged after the ack wait.
+var ErrPublishAckTimeout = errors.New("timed out waiting for publishes to be acknowledged")
+
+// defaultJetStreamAckWait is how long JetStream waits for a publish to be
+// acknowledged when PublishAckWait is not set
+const defaultJetStreamAckWait = 5 * time.Second
+
+// The backends events can be produced to
+const (
+	ProducerNats  = "nats"
+	ProducerRedis = "redis"
+)
+
+// The encodings events can be produced with
+const (
+	EncodingMsgpack = "msgpack"
+	EncodingJSON    = "json"
+)
+
+// encodingHeader is the header or field the encoding of an event is
+// stamped in when the backend supports it
+const encodingHeader = "Encoding"
+
+// The ways a publish can be acknowledged
+const (
+	AckModeSync  = "sync"
+	AckModeAsync = "async"
+	AckModeNone  = "none"
+)
+
+// The NATS backends events can be published to
+const (
+	NatsModeStan      = "stan"
+	NatsModeJetStream = "jetstream"
+)
+
+// Producer is something that events can be published to. PublishAsync
+// calls ack once the backend has acknowledged the publish which may be
+// after it has returned. PublishNoAck does not wait for or handle any
+// acknowledgement so only errors sending the publish are returned.
+type Producer interface {
+	Publish(subject string, data []byte) error
+	PublishAsync(subject string, data []byte, ack func(error)) error
+	PublishNoAck(subject string, data []byte) error
+	Close() error
+}
+
+// stanProducer publishes events to NATS Streaming. The connection is
+// looked up on every publish as it is replaced when NATS reconnects.
+// NATS Streaming does not support headers so consumers must be
+// configured with the encoding.
+type stanProducer struct {
+	m *Manager
+}
+
+func (sp *stanProducer) Publish(subject string, data []byte) error {
+	return sp.m.Stan().Publish(subject, data)
+}
+
+func (sp *stanProducer) PublishAsync(subject string, data []byte, ack func(error)) (err error) {
+	_, err = sp.m.Stan().PublishAsync(subject, data, func(_ string, err error) {
+		ack(err)
+	})
+	return
+}
+
+// PublishNoAck publishes without an acknowledgement handler. NATS
+// Streaming only stores messages published through its own protocol so
+// unlike JetStream, a core NATS publish cannot be used.
+func (sp *stanProducer) PublishNoAck(subject string, data []byte) (err error) {
+	_, err = sp.m.Stan().PublishAsync(subject, data, nil)
+	return
+}
+
+// Close closes the NATS Streaming connection, waiting for pending
+// acknowledgements and unregistering the client id from the server.
+func (sp *stanProducer) Close() error {
+	if sc := sp.m.Stan(); sc != nil {
+		return sc.Close()
+	}
+	return nil
+}
+
+// jetStreamProducer publishes events to a NATS JetStream stream. The
+// encoding is stamped in the Encoding header of every message.
+type jetStreamProducer struct {
+	nc       *nats.Conn
+	js       nats.JetStreamContext
+	encoding string
+
+	// acks is the goroutines waiting for async publishes to be
+	// acknowledged
+	acks sync.WaitGroup
+
+	// ackWait is how long Close waits for acknowledgements. If 0,
+	// defaultJetStreamAckWait is used.
+	ackWait time.Duration
+}
+
+func (jp *jetStreamProducer) msg(subject string, data []byte) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(encodingHeader, jp.encoding)
+	msg.Data = data
+	return msg
+}
+
+func (jp *jetStreamProducer) Publish(subject string, data []byte) (err error) {
+	_, err = jp.js.PublishMsg(jp.msg(subject, data))
+	return
+}
+
+func (jp *jetStreamProducer) PublishAsync(subject string, data []byte, ack func(error)) error {
+	future, err := jp.js.PublishMsgAsync(jp.msg(subject, data))
+	if err != nil {
+		return err
+	}
+
+	jp.acks.Add(1)
+	go func() {
+		defer jp.acks.Done()
+
+		select {
+		case <-future.Ok():
+			ack(nil)
+		case err := <-future.Err():
+			ack(err)
+		}
+	}()
+	return nil
+}
+
+// PublishNoAck publishes with core NATS which the stream stores without
+// sending an acknowledgement
+func (jp *jetStreamProducer) PublishNoAck(subject string, data []byte) error {
+	return jp.nc.PublishMsg(jp.msg(subject, data))
+}
+
+// Close waits for every async publish to be acknowledged. As JetStream
+// does not time out async publishes, ErrPublishAckTimeout is returned if
+// they are not acknowledged within the ack wait. The NATS connection is
+// left open as it is owned by the Manager.
+func (jp *jetStreamProducer) Close() error {
+	ackWait := jp.ackWait
+	if ackWait == 0 {
+		ackWait = defaultJetStreamAckWait
+	}
+
+	acked := make(chan void)
+	go func() {
+		jp.acks.Wait()
+		close(acked)
+	}()
+
+	select {
+	case <-acked:
+		return nil
+	case <-time.After(ackWait):
+		return ErrPublishAckTimeout
+	}
+}
+
+// connectJetStream creates the JetStream context and makes sure the
+// configured stream exists. If it does not, it will be created to hold
+// the channel and every subject under it.
+func (m *Manager) connectJetStream() (err error) {
+	js, err := m.NatsClient.JetStream(m.jetStreamOptions()...)
+	if err != nil {
+		return
+	}
+
+	stream := m.Configuration.Nats.Stream
+	_, err = js.StreamInfo(stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		m.log.Info().Str("stream", stream).Msg("Creating JetStream stream")
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name: stream,
+			Subjects: []string{
+				m.Configuration.Nats.Channel,
+				m.Configuration.Nats.Channel + ".>",
+			},
+		})
+	}
+	if err != nil {
+		return
+	}
+
+	m.Producer = &jetStreamProducer{
+		nc:       m.NatsClient,
+		js:       js,
+		encoding: m.Configuration.Encoding,
+		ackWait:  time.Duration(m.Configuration.Nats.PublishAckWait) * time.Millisecond,
+	}
+	return
+}
+
+// redisStreamProducer adds events to redis streams. Each event is added
+// as the field data to the stream with the key of the subject and the
+// encoding as the field Encoding.
+type redisStreamProducer struct {
+	m *Manager
+}
+
+func (rp *redisStreamProducer) Publish(subject string, data []byte) error {
+	return rp.m.RedisClient.XAdd(rp.m.ctx, &redis.XAddArgs{
+		Stream: subject,
+		MaxLen: rp.m.Configuration.Redis.StreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"data":         data,
+			encodingHeader: rp.m.Configuration.Encoding,
+		},
+	}).Err()
+}
+
+// PublishAsync adds the event immediately as redis has already
+// acknowledged it once XADD returns.
+func (rp *redisStreamProducer) PublishAsync(subject string, data []byte, ack func(error)) (err error) {
+	if err = rp.Publish(subject, data); err != nil {
+		return
+	}
+
+	ack(nil)
+	return
+}
+
+// PublishNoAck adds the event the same as Publish as XADD is always
+// acknowledged
+func (rp *redisStreamProducer) PublishNoAck(subject string, data []byte) error {
+	return rp.Publish(subject, data)
+}
+
+func (rp *redisStreamProducer) Close() error {
+	return nil
+}
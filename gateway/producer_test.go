@@ -0,0 +1,518 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/stan.go"
+)
+
+var errFakePublish = errors.New("fake publish failure")
+
+// publish is a publish received by a fakeProducer
+type publish struct {
+	subject string
+	data    string
+	method  string
+}
+
+// fakeProducer records publishes. Publishes fail whilst failures is above
+// 0 and asynchronous publishes are acknowledged with ackErr. onClose is
+// called when the producer is closed.
+type fakeProducer struct {
+	mu        sync.Mutex
+	publishes []publish
+	failures  int
+	ackErr    error
+	onClose   func()
+}
+
+func (fp *fakeProducer) record(subject string, data []byte, method string) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.publishes = append(fp.publishes, publish{subject: subject, data: string(data), method: method})
+	if fp.failures > 0 {
+		fp.failures--
+		return errFakePublish
+	}
+	return nil
+}
+
+func (fp *fakeProducer) Publish(subject string, data []byte) error {
+	return fp.record(subject, data, "sync")
+}
+
+func (fp *fakeProducer) PublishAsync(subject string, data []byte, ack func(error)) error {
+	if err := fp.record(subject, data, "async"); err != nil {
+		return err
+	}
+
+	ack(fp.ackErr)
+	return nil
+}
+
+func (fp *fakeProducer) PublishNoAck(subject string, data []byte) error {
+	return fp.record(subject, data, "none")
+}
+
+func (fp *fakeProducer) Close() error {
+	if fp.onClose != nil {
+		fp.onClose()
+	}
+	return nil
+}
+
+func (fp *fakeProducer) calls() []publish {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	return append([]publish(nil), fp.publishes...)
+}
+
+func TestPublishDefaultsToSync(t *testing.T) {
+	m := testManager()
+	m.Configuration.Nats.Channel = "sandwich"
+	m.Configuration.Nats.AckMode = AckModeSync
+	m.Configuration.Nats.StrictOrdering = true
+
+	fp := &fakeProducer{}
+	m.Producer = fp
+
+	for _, eventType := range []string{"MESSAGE_CREATE", "GUILD_CREATE"} {
+		if err := m.publish(eventType, []byte(eventType)); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	// Every event is published synchronously to the same subject
+	for _, p := range fp.calls() {
+		if p.method != "sync" || p.subject != "sandwich" {
+			t.Errorf("expected a synchronous publish to sandwich, got %+v", p)
+		}
+	}
+}
+
+// testPublishManager returns a Manager with a fakeProducer that retries
+// publishes without waiting long
+func testPublishManager(t *testing.T, mode string) (*Manager, *fakeProducer) {
+	m, _ := testRedisManager(t)
+	m.Configuration.Nats.Channel = "sandwich"
+	m.Configuration.Nats.AckMode = mode
+	m.Configuration.Nats.PublishRetries = 3
+	m.Configuration.Nats.PublishBackoff = 1
+
+	fp := &fakeProducer{}
+	m.Producer = fp
+	return m, fp
+}
+
+// deadLetters returns the subjects of the events in the dead letter list
+func deadLetters(t *testing.T, m *Manager) (subjects []string) {
+	entries, err := m.RedisClient.LRange(context.Background(), m.keys().DeadLetter(), 0, -1).Result()
+	if err != nil {
+		t.Fatalf("failed to read the dead letter list: %v", err)
+	}
+
+	for _, entry := range entries {
+		event := deadLetterEvent{}
+		if err := json.UnmarshalFromString(entry, &event); err != nil {
+			t.Fatalf("failed to decode dead letter: %v", err)
+		}
+		subjects = append(subjects, event.Subject)
+	}
+	return
+}
+
+func TestPublishRetries(t *testing.T) {
+	m, fp := testPublishManager(t, AckModeSync)
+	fp.failures = 2
+
+	if err := m.publish("MESSAGE_CREATE", []byte("a")); err != nil {
+		t.Fatalf("expected the publish to succeed once retried: %v", err)
+	}
+	if calls := len(fp.calls()); calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+	if produced := atomic.LoadInt64(m.produced); produced != 1 {
+		t.Errorf("expected 1 event to be produced, got %d", produced)
+	}
+	if letters := deadLetters(t, m); len(letters) != 0 {
+		t.Errorf("expected nothing to be dead lettered, got %v", letters)
+	}
+}
+
+func TestPublishDeadLetters(t *testing.T) {
+	m, fp := testPublishManager(t, AckModeSync)
+	fp.failures = 10
+
+	if err := m.publish("MESSAGE_CREATE", []byte("a")); err == nil {
+		t.Fatal("expected the publish to fail")
+	}
+	if calls := len(fp.calls()); calls != 4 {
+		t.Errorf("expected the publish and 3 retries, got %d attempts", calls)
+	}
+	if produced := atomic.LoadInt64(m.produced); produced != 0 {
+		t.Errorf("expected no events to be produced, got %d", produced)
+	}
+	if letters := deadLetters(t, m); len(letters) != 1 || letters[0] != "sandwich" {
+		t.Errorf("expected the event to be dead lettered, got %v", letters)
+	}
+}
+
+func TestPublishStopsRetryingOnClose(t *testing.T) {
+	m, fp := testPublishManager(t, AckModeSync)
+	m.Configuration.Nats.PublishBackoff = int(time.Hour / time.Millisecond)
+	fp.failures = 10
+
+	time.AfterFunc(10*time.Millisecond, m.cancel)
+
+	done := make(chan error)
+	go func() {
+		done <- m.publish("MESSAGE_CREATE", []byte("a"))
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the publish to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected closing the Manager to stop the backoff")
+	}
+
+	if letters := deadLetters(t, m); len(letters) != 1 {
+		t.Errorf("expected the event to be dead lettered whilst closing, got %v", letters)
+	}
+}
+
+func TestPublishAsyncAckFailure(t *testing.T) {
+	m, fp := testPublishManager(t, AckModeAsync)
+	fp.ackErr = errFakePublish
+
+	if err := m.publish("MESSAGE_CREATE", []byte("a")); err != nil {
+		t.Fatalf("expected the publish to be sent: %v", err)
+	}
+
+	// The event failed once acknowledged so it was not produced
+	if produced := atomic.LoadInt64(m.produced); produced != 0 {
+		t.Errorf("expected no events to be produced, got %d", produced)
+	}
+	if letters := deadLetters(t, m); len(letters) != 1 {
+		t.Errorf("expected the event to be dead lettered, got %v", letters)
+	}
+}
+
+func TestPublishNoAck(t *testing.T) {
+	m, fp := testPublishManager(t, AckModeNone)
+	fp.ackErr = errFakePublish
+
+	if err := m.publish("MESSAGE_CREATE", []byte("a")); err != nil {
+		t.Fatalf("expected the publish to be sent: %v", err)
+	}
+
+	calls := fp.calls()
+	if len(calls) != 1 || calls[0].method != "none" {
+		t.Fatalf("expected a single publish without an acknowledgement, got %+v", calls)
+	}
+	if produced := atomic.LoadInt64(m.produced); produced != 1 {
+		t.Errorf("expected the event to be produced once sent, got %d", produced)
+	}
+}
+
+func TestPublishNoAckFailure(t *testing.T) {
+	m, fp := testPublishManager(t, AckModeNone)
+	fp.failures = 10
+
+	// Errors sending the publish are still retried and dead lettered
+	if err := m.publish("MESSAGE_CREATE", []byte("a")); err == nil {
+		t.Fatal("expected the publish to fail")
+	}
+	if calls := len(fp.calls()); calls != 4 {
+		t.Errorf("expected the publish and 3 retries, got %d attempts", calls)
+	}
+	if letters := deadLetters(t, m); len(letters) != 1 {
+		t.Errorf("expected the event to be dead lettered, got %v", letters)
+	}
+}
+
+// testNatsServer starts a server that speaks enough of the NATS protocol
+// for a client to connect and publish. The protocol line of every
+// publish is passed to the returned channel.
+func testNatsServer(t *testing.T) (url string, publishes <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	lines := make(chan string, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"version\":\"2.10.0\",\"headers\":true,\"max_payload\":1048576}\r\n")
+
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			args := strings.Fields(line)
+			if len(args) == 0 {
+				continue
+			}
+
+			switch strings.ToUpper(args[0]) {
+			case "PING":
+				fmt.Fprint(conn, "PONG\r\n")
+			case "PUB", "HPUB":
+				size, _ := strconv.Atoi(args[len(args)-1])
+				if _, err := io.CopyN(ioutil.Discard, reader, int64(size)+2); err != nil {
+					return
+				}
+				lines <- line
+			}
+		}
+	}()
+
+	return "nats://" + listener.Addr().String(), lines
+}
+
+func TestJetStreamPublishNoAckUsesCoreNats(t *testing.T) {
+	url, publishes := testNatsServer(t)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer nc.Close()
+
+	jp := &jetStreamProducer{nc: nc, encoding: EncodingJSON}
+	if err = jp.PublishNoAck("sandwich", []byte("{}")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	if err = nc.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	select {
+	case line := <-publishes:
+		// A publish waiting for an acknowledgement includes a reply
+		// subject between the subject and the sizes.
+		if args := strings.Fields(line); len(args) != 4 || args[0] != "HPUB" || args[1] != "sandwich" {
+			t.Errorf("expected a publish without a reply subject, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the publish")
+	}
+}
+
+func TestPublishAckOptions(t *testing.T) {
+	m := testManager()
+	if options := m.jetStreamOptions(); len(options) != 0 {
+		t.Errorf("expected the JetStream defaults to be used, got %d options", len(options))
+	}
+	if options := m.stanOptions(); len(options) != 2 {
+		t.Errorf("expected only the connection options for NATS Streaming, got %d options", len(options))
+	}
+
+	m.Configuration.Nats.PublishAckWait = 50
+	m.Configuration.Nats.MaxPublishesInflight = 10
+	if options := m.jetStreamOptions(); len(options) != 2 {
+		t.Errorf("expected the ack wait and inflight limit for JetStream, got %d options", len(options))
+	}
+	if options := m.stanOptions(); len(options) != 4 {
+		t.Errorf("expected the ack wait and inflight limit for NATS Streaming, got %d options", len(options))
+	}
+}
+
+func TestJetStreamPublishAckWait(t *testing.T) {
+	url, publishes := testNatsServer(t)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer nc.Close()
+
+	m := testManager()
+	m.Configuration.Nats.PublishAckWait = 50
+	js, err := nc.JetStream(m.jetStreamOptions()...)
+	if err != nil {
+		t.Fatalf("failed to create JetStream context: %v", err)
+	}
+
+	// The test server never acknowledges so the publish fails once
+	// PublishAckWait has passed rather than the default of 5 seconds.
+	start := time.Now()
+	jp := &jetStreamProducer{nc: nc, js: js, encoding: EncodingJSON}
+	if err = jp.Publish("sandwich", []byte("{}")); err == nil {
+		t.Fatal("expected the unacknowledged publish to fail")
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("expected to wait for PublishAckWait, waited %s", waited)
+	}
+
+	select {
+	case line := <-publishes:
+		if args := strings.Fields(line); len(args) != 5 || args[0] != "HPUB" || args[1] != "sandwich" {
+			t.Errorf("expected a publish with a reply subject, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the publish")
+	}
+}
+
+func TestJetStreamCloseWaitsForAcks(t *testing.T) {
+	url, publishes := testNatsServer(t)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("failed to create JetStream context: %v", err)
+	}
+
+	jp := &jetStreamProducer{nc: nc, js: js, encoding: EncodingJSON, ackWait: 200 * time.Millisecond}
+	if err = jp.Close(); err != nil {
+		t.Fatalf("expected Close to return with nothing to acknowledge, got %v", err)
+	}
+
+	if err = jp.PublishAsync("sandwich", []byte("{}"), func(error) {}); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	<-publishes
+
+	// The test server never acknowledges so Close waits for the ack wait
+	start := time.Now()
+	if err = jp.Close(); err != ErrPublishAckTimeout {
+		t.Errorf("expected ErrPublishAckTimeout, got %v", err)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("expected Close to wait for the publish, waited %s", waited)
+	}
+}
+
+func TestCloseClosesProducerBeforeNats(t *testing.T) {
+	url, _ := testNatsServer(t)
+
+	m := testManager()
+	m.RedisClient = NewRedisClient(&redis.Options{Addr: closedAddress(t)}, 0, m.log)
+
+	var err error
+	m.NatsClient, err = nats.Connect(url)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	natsClosed := true
+	m.Producer = &fakeProducer{onClose: func() {
+		natsClosed = m.NatsClient.IsClosed()
+	}}
+	m.Close()
+
+	if natsClosed {
+		t.Error("expected the producer to be closed whilst NATS was still connected")
+	}
+	if !m.NatsClient.IsClosed() {
+		t.Error("expected NATS to be closed")
+	}
+}
+
+// fakeStanConnect replaces stanConnect with a function that fails with
+// the errors passed before connecting. The client ids that were tried are
+// returned.
+func fakeStanConnect(t *testing.T, failures ...error) (clientIDs *[]string) {
+	clientIDs = new([]string)
+
+	original := stanConnect
+	t.Cleanup(func() { stanConnect = original })
+
+	stanConnect = func(_, clientID string, _ ...stan.Option) (stan.Conn, error) {
+		*clientIDs = append(*clientIDs, clientID)
+		if len(failures) > 0 {
+			err := failures[0]
+			failures = failures[1:]
+			return nil, err
+		}
+		return nil, nil
+	}
+	return
+}
+
+func testStanManager() *Manager {
+	m := testManager()
+	m.stanHealthy = new(int32)
+	m.Configuration.Nats.ClientID = "sandwich"
+	m.Configuration.Nats.ClientIDRetries = 3
+	return m
+}
+
+func TestConnectStanClientIDConflict(t *testing.T) {
+	m := testStanManager()
+	clientIDs := fakeStanConnect(t, errors.New("stan: clientID already registered"))
+
+	if err := m.connectStan(); err != nil {
+		t.Fatalf("expected to connect after a conflict, got %v", err)
+	}
+	if len(*clientIDs) != 2 {
+		t.Fatalf("expected 2 attempts, got %v", *clientIDs)
+	}
+	for _, clientID := range *clientIDs {
+		if !strings.HasPrefix(clientID, "sandwich-") {
+			t.Errorf("expected client id %q to be suffixed", clientID)
+		}
+	}
+	if atomic.LoadInt32(m.stanHealthy) != 1 {
+		t.Error("expected stan to be healthy once connected")
+	}
+}
+
+func TestConnectStanClientIDRetries(t *testing.T) {
+	m := testStanManager()
+	conflict := errors.New("stan: clientID already registered")
+	clientIDs := fakeStanConnect(t, conflict, conflict, conflict, conflict)
+
+	if err := m.connectStan(); err != conflict {
+		t.Fatalf("expected the conflict to be returned, got %v", err)
+	}
+	if len(*clientIDs) != 4 {
+		t.Errorf("expected 1 attempt and 3 retries, got %v", *clientIDs)
+	}
+}
+
+func TestConnectStanOtherError(t *testing.T) {
+	m := testStanManager()
+	failure := errors.New("stan: connect request timeout")
+	clientIDs := fakeStanConnect(t, failure)
+
+	if err := m.connectStan(); err != failure {
+		t.Fatalf("expected %v, got %v", failure, err)
+	}
+	if len(*clientIDs) != 1 {
+		t.Errorf("expected other errors to not be retried, got %v", *clientIDs)
+	}
+}
@@ -0,0 +1,220 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+)
+
+// reconcileDelay is how long to wait between fetching each guild so
+// reconciling does not exhaust the REST ratelimits
+const reconcileDelay = 250 * time.Millisecond
+
+// ErrGuildMismatch is returned when the API responds with a guild other
+// than the one that was requested
+var ErrGuildMismatch = errors.New("fetched guild does not have the requested id")
+
+// GuildReconcileEvent is produced when a guild in the cache had drifted
+// from the API and has been corrected. Before is the cached guild and
+// After is the corrected guild.
+type GuildReconcileEvent struct {
+	Before *events.Guild `msgpack:"before" json:"before"`
+	After  *events.Guild `msgpack:"after" json:"after"`
+}
+
+// StartReconciler reconciles the cache of every available guild each
+// interval. Guilds are fetched from the API and if they differ from the
+// cache, the cache is corrected and GUILD_RECONCILE is produced.
+func (m *Manager) StartReconciler(interval time.Duration) {
+	m.reconcilerMu.Lock()
+	defer m.reconcilerMu.Unlock()
+
+	if m.reconcilerStop != nil {
+		return
+	}
+
+	stop := make(chan void)
+	m.reconcilerStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				m.reconcile(stop)
+			}
+		}
+	}()
+}
+
+// StopReconciler stops the reconciler if it is running
+func (m *Manager) StopReconciler() {
+	m.reconcilerMu.Lock()
+	defer m.reconcilerMu.Unlock()
+
+	if m.reconcilerStop != nil {
+		close(m.reconcilerStop)
+		m.reconcilerStop = nil
+	}
+}
+
+// reconcile reconciles every available guild unless stop is closed
+func (m *Manager) reconcile(stop chan void) {
+	if m.IsScaling() {
+		m.log.Debug().Msg("Skipping reconcile as the manager is scaling")
+		return
+	}
+
+	guildIDs := m.availableGuilds()
+	m.log.Debug().Int("guilds", len(guildIDs)).Msg("Reconciling cache")
+
+	corrected := 0
+	for _, guildID := range guildIDs {
+		select {
+		case <-stop:
+			return
+		case <-time.After(reconcileDelay):
+		}
+
+		drifted, err := m.reconcileGuild(guildID)
+		if err != nil {
+			m.log.Warn().Str("guild", guildID.String()).Err(err).Msg("Failed to reconcile guild")
+			continue
+		}
+
+		if drifted {
+			corrected++
+		}
+	}
+
+	m.log.Info().Int("guilds", len(guildIDs)).Int("corrected", corrected).Msg("Reconciled cache")
+}
+
+// reconcileGuild fetches a guild from the API and corrects the cached
+// guild and its roles if they differ, removing roles that no longer
+// exist. drifted is true if the cache was corrected.
+func (m *Manager) reconcileGuild(guildID snowflake.ID) (drifted bool, err error) {
+	before, err := m.getGuild(guildID)
+	if err == ErrStateNotFound {
+		before, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	guild, err := m.Client.GetGuild(guildID)
+	if err != nil {
+		return
+	}
+
+	// Writing a guild without an id would add it to the cache under an
+	// empty field so the response has to be for the guild we requested.
+	if guild.ID != guildID.String() {
+		return false, fmt.Errorf("%w: requested %s but received %q", ErrGuildMismatch, guildID, guild.ID)
+	}
+
+	removedRoles, err := m.removedRoles(guildID, guild.Roles)
+	if err != nil {
+		return
+	}
+
+	// The API does not include the objects only sent in GUILD_CREATE so
+	// we keep the ones we already have.
+	if before != nil {
+		guild.Owner = before.Owner
+		guild.Permissions = before.Permissions
+		guild.Large = before.Large
+		guild.Unavailable = before.Unavailable
+		guild.JoinedAt = before.JoinedAt
+		guild.MemberCount = before.MemberCount
+		guild.VoiceStates = before.VoiceStates
+		guild.Members = before.Members
+		guild.Channels = before.Channels
+		guild.Presences = before.Presences
+		guild.GuildHashes = before.GuildHashes
+
+		if len(removedRoles) == 0 && DeepEqualExports("json", before, guild) {
+			return false, nil
+		}
+	}
+
+	if err = m.setGuild(guild); err != nil {
+		return
+	}
+
+	for _, role := range guild.Roles {
+		if err = m.setRole(guildID, role); err != nil {
+			return
+		}
+	}
+
+	for _, roleID := range removedRoles {
+		if err = m.deleteRole(guildID, roleID); err != nil {
+			return
+		}
+	}
+
+	m.log.Info().Str("guild", guildID.String()).Msg("Corrected guild that had drifted from the cache")
+	m.produceEvent("GUILD_RECONCILE", GuildReconcileEvent{
+		Before: before,
+		After:  guild,
+	})
+	return true, nil
+}
+
+// removedRoles returns the ids of the cached roles of a guild that are
+// not in roles
+func (m *Manager) removedRoles(guildID snowflake.ID, roles []*events.Role) (removed []snowflake.ID, err error) {
+	cached, err := m.RedisClient.HKeys(m.ctx, m.keys().Roles(guildID)).Result()
+	if err != nil {
+		return
+	}
+
+	current := make(map[snowflake.ID]bool, len(roles))
+	for _, role := range roles {
+		current[role.ID] = true
+	}
+
+	for _, field := range cached {
+		roleID, err := snowflake.ParseString(field)
+		if err != nil || current[roleID] {
+			continue
+		}
+		removed = append(removed, roleID)
+	}
+	return
+}
+
+// availableGuilds returns the ids of the guilds that are currently
+// available across every Shard
+func (m *Manager) availableGuilds() (guildIDs []snowflake.ID) {
+	return m.guildIDs(true)
+}
+
+// guildIDs returns the ids of the guilds across every Shard. If
+// onlyAvailable is true, unavailable guilds are not included.
+func (m *Manager) guildIDs(onlyAvailable bool) (guildIDs []snowflake.ID) {
+	m.ShardGroupsMu.Lock()
+	defer m.ShardGroupsMu.Unlock()
+
+	for _, sg := range m.ShardGroups {
+		sg.ShardsMu.Lock()
+		for _, shard := range sg.Shards {
+			shard.guildsMu.RLock()
+			for guildID, available := range shard.guilds {
+				if available || !onlyAvailable {
+					guildIDs = append(guildIDs, guildID)
+				}
+			}
+			shard.guildsMu.RUnlock()
+		}
+		sg.ShardsMu.Unlock()
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/TheRockettek/Sandwich-Producer/client"
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+)
+
+// testAPI points the REST client of a Manager at a server that responds
+// to every request with the response for its path
+func testAPI(t *testing.T, m *Manager, responses map[string]string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"Unknown","code":0}`))
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	m.Client = client.NewClient("token")
+	m.Client.HTTP = server.Client()
+	m.Client.URLHost = u.Host
+	m.Client.URLScheme = u.Scheme
+	m.Client.MaxRetries = 0
+}
+
+func TestReconcileRejectsOtherGuilds(t *testing.T) {
+	for _, response := range []string{`{}`, `{"id":"2","name":"b"}`} {
+		m, _ := testRedisManager(t)
+		testAPI(t, m, map[string]string{"/api/v6/guilds/1": response})
+
+		_, err := m.reconcileGuild(snowflake.ID(1))
+		if !errors.Is(err, ErrGuildMismatch) {
+			t.Errorf("expected ErrGuildMismatch for %s, got %v", response, err)
+		}
+
+		if fields, _ := m.RedisClient.HKeys(m.ctx, m.keys().Guilds()).Result(); len(fields) != 0 {
+			t.Errorf("expected nothing to be cached for %s, got %v", response, fields)
+		}
+		if len(m.produceChannel) != 0 {
+			t.Errorf("expected GUILD_RECONCILE to not be produced for %s", response)
+		}
+	}
+}
+
+func TestReconcileRemovesDeletedRoles(t *testing.T) {
+	m, _ := testRedisManager(t)
+	guild := &events.Guild{ID: "1", Name: "a", Roles: []*events.Role{{ID: 1}, {ID: 2}}}
+	if err := m.setGuild(guild); err != nil {
+		t.Fatal(err)
+	}
+	for _, role := range guild.Roles {
+		if err := m.setRole(snowflake.ID(1), role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testAPI(t, m, map[string]string{"/api/v6/guilds/1": `{"id":"1","name":"a","roles":[{"id":"1"}]}`})
+
+	drifted, err := m.reconcileGuild(snowflake.ID(1))
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if !drifted {
+		t.Error("expected the deleted role to be drift")
+	}
+
+	if _, err = m.getRole(snowflake.ID(1), snowflake.ID(2)); err != ErrStateNotFound {
+		t.Errorf("expected the deleted role to be removed, got %v", err)
+	}
+	if _, err = m.getRole(snowflake.ID(1), snowflake.ID(1)); err != nil {
+		t.Errorf("expected the remaining role to be kept, got %v", err)
+	}
+}
+
+func TestReconcileCorrectsDrift(t *testing.T) {
+	m, _ := testRedisManager(t)
+	if err := m.setGuild(&events.Guild{ID: "1", Name: "before", Roles: []*events.Role{{ID: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The guild was renamed whilst an event was missed
+	testAPI(t, m, map[string]string{"/api/v6/guilds/1": `{"id":"1","name":"after","roles":[{"id":"1"}]}`})
+
+	drifted, err := m.reconcileGuild(snowflake.ID(1))
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if !drifted {
+		t.Fatal("expected the renamed guild to have drifted")
+	}
+
+	guild, err := m.getGuild(snowflake.ID(1))
+	if err != nil || guild.Name != "after" {
+		t.Errorf("expected the cached guild to be corrected, got %+v %v", guild, err)
+	}
+
+	reconciled, ok := produced(t, m).Data.(GuildReconcileEvent)
+	if !ok || reconciled.Before.Name != "before" || reconciled.After.Name != "after" {
+		t.Errorf("expected GUILD_RECONCILE with the guild before and after, got %+v", reconciled)
+	}
+}
+
+func TestReconcileWithoutDrift(t *testing.T) {
+	m, _ := testRedisManager(t)
+	if err := m.setGuild(&events.Guild{ID: "1", Name: "a", Roles: []*events.Role{{ID: 1}}, MemberCount: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.setRole(snowflake.ID(1), &events.Role{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The API does not include the member count so it is not drift
+	testAPI(t, m, map[string]string{"/api/v6/guilds/1": `{"id":"1","name":"a","roles":[{"id":"1"}]}`})
+
+	drifted, err := m.reconcileGuild(snowflake.ID(1))
+	if err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+	if drifted || len(m.produceChannel) != 0 {
+		t.Error("expected a guild that matches the API to not be corrected")
+	}
+}
+
+func TestReconcileUncachedGuild(t *testing.T) {
+	m, _ := testRedisManager(t)
+	testAPI(t, m, map[string]string{"/api/v6/guilds/1": `{"id":"1","name":"a"}`})
+
+	drifted, err := m.reconcileGuild(snowflake.ID(1))
+	if err != nil || !drifted {
+		t.Fatalf("expected a guild missing from the cache to be corrected, got %t %v", drifted, err)
+	}
+
+	if reconciled := produced(t, m).Data.(GuildReconcileEvent); reconciled.Before != nil {
+		t.Errorf("expected no guild before, got %+v", reconciled.Before)
+	}
+}
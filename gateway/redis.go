@@ -0,0 +1,222 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog"
+)
+
+// ErrRedisBufferFull is returned when a critical write could not be
+// buffered as redis is unavailable and the buffer has no space left.
+var ErrRedisBufferFull = errors.New("redis is unavailable and the write buffer is full")
+
+// redisHealthInterval is how often the health of redis is checked
+const redisHealthInterval = 5 * time.Second
+
+// redisUnavailableReplies are the prefixes of replies from redis that
+// mean it can not currently run commands, rather than the command
+// itself failing.
+var redisUnavailableReplies = []string{"LOADING ", "READONLY ", "MASTERDOWN ", "CLUSTERDOWN ", "TRYAGAIN "}
+
+// redisUnavailable returns true if err means redis could not be reached
+// or can not currently run commands. Other replies, such as WRONGTYPE or
+// a script error, will fail again if retried so are not an outage.
+func redisUnavailable(err error) bool {
+	var reply redis.Error
+	if !errors.As(err, &reply) {
+		return true
+	}
+
+	for _, prefix := range redisUnavailableReplies {
+		if strings.HasPrefix(reply.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedisClient wraps a redis client, keeping track of if redis is
+// reachable. Whilst redis is unavailable, critical writes are buffered
+// and will be flushed once redis recovers. The underlying client will
+// reconnect by itself as the pool dials new connections on demand.
+type RedisClient struct {
+	*redis.Client
+
+	log zerolog.Logger
+
+	// healthy is 1 when redis is reachable and 0 when it is not
+	healthy *int32
+
+	bufferMu   sync.Mutex
+	buffer     []func(redis.Pipeliner)
+	bufferSize int
+
+	stop chan void
+}
+
+// NewRedisClient creates a RedisClient. bufferSize is the maximum
+// ammount of critical writes that can be buffered whilst redis is
+// unavailable.
+func NewRedisClient(options *redis.Options, bufferSize int, logger zerolog.Logger) (rc *RedisClient) {
+	rc = &RedisClient{
+		Client:     redis.NewClient(options),
+		log:        logger,
+		healthy:    new(int32),
+		bufferMu:   sync.Mutex{},
+		buffer:     make([]func(redis.Pipeliner), 0),
+		bufferSize: bufferSize,
+		stop:       make(chan void),
+	}
+	atomic.StoreInt32(rc.healthy, 1)
+
+	go rc.monitor()
+	return
+}
+
+// Healthy returns if redis was reachable during the last health check
+// or write.
+func (rc *RedisClient) Healthy() bool {
+	return atomic.LoadInt32(rc.healthy) == 1
+}
+
+// Health returns the health of redis as a gauge. 1 is healthy and 0 is
+// unavailable.
+func (rc *RedisClient) Health() int32 {
+	return atomic.LoadInt32(rc.healthy)
+}
+
+// Buffered returns how many critical writes are waiting for redis to
+// recover.
+func (rc *RedisClient) Buffered() int {
+	rc.bufferMu.Lock()
+	defer rc.bufferMu.Unlock()
+
+	return len(rc.buffer)
+}
+
+// CriticalWrite runs the commands queued by fn in a pipeline. If redis
+// is unavailable, the write is buffered and will be ran once redis has
+// recovered. ErrRedisBufferFull is returned if there is no space left
+// to buffer the write. If a command fails with a reply such as
+// WRONGTYPE, its error is returned and the write is not buffered.
+func (rc *RedisClient) CriticalWrite(ctx context.Context, fn func(redis.Pipeliner)) (err error) {
+	if rc.Healthy() {
+		_, err = rc.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			fn(pipe)
+			return nil
+		})
+		if err == nil || err == redis.Nil {
+			return nil
+		}
+		if !redisUnavailable(err) {
+			return err
+		}
+
+		rc.setHealthy(false, err)
+	}
+
+	rc.bufferMu.Lock()
+
+	// Redis is only marked healthy once the buffer has been flushed so if
+	// it recovered whilst we were waiting, the write can be ran directly
+	// without being overwritten by older buffered writes.
+	if rc.Healthy() {
+		rc.bufferMu.Unlock()
+		return rc.CriticalWrite(ctx, fn)
+	}
+	defer rc.bufferMu.Unlock()
+
+	if len(rc.buffer) >= rc.bufferSize {
+		return ErrRedisBufferFull
+	}
+
+	rc.buffer = append(rc.buffer, fn)
+	return nil
+}
+
+// Close stops the health checks and closes the client
+func (rc *RedisClient) Close() error {
+	close(rc.stop)
+	return rc.Client.Close()
+}
+
+// monitor periodically pings redis, flushing buffered writes once redis
+// becomes reachable again.
+func (rc *RedisClient) monitor() {
+	ticker := time.NewTicker(redisHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rc.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), redisHealthInterval)
+		err := rc.Ping(ctx).Err()
+		if err == nil {
+			err = rc.flush(ctx)
+		}
+		cancel()
+
+		if err != nil {
+			rc.setHealthy(false, err)
+		}
+	}
+}
+
+// flush runs all buffered writes in a single pipeline. The buffer is
+// only cleared if redis was reachable, commands that failed with a reply
+// such as WRONGTYPE are logged and dropped as they would fail again.
+// Redis is marked healthy whilst the buffer is still locked so writes
+// can not be ran directly until all the buffered writes before them
+// have been.
+func (rc *RedisClient) flush(ctx context.Context) (err error) {
+	rc.bufferMu.Lock()
+	defer rc.bufferMu.Unlock()
+
+	if len(rc.buffer) == 0 {
+		rc.setHealthy(true, nil)
+		return
+	}
+
+	cmds, err := rc.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, fn := range rc.buffer {
+			fn(pipe)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil && redisUnavailable(err) {
+		return
+	}
+
+	for _, cmd := range cmds {
+		if cmdErr := cmd.Err(); cmdErr != nil && cmdErr != redis.Nil {
+			rc.log.Error().Err(cmdErr).Str("command", cmd.Name()).Msg("Dropped buffered redis write")
+		}
+	}
+
+	rc.log.Info().Int("writes", len(rc.buffer)).Msg("Flushed buffered redis writes")
+	rc.buffer = rc.buffer[:0]
+	rc.setHealthy(true, nil)
+	return nil
+}
+
+func (rc *RedisClient) setHealthy(healthy bool, err error) {
+	if healthy {
+		if atomic.SwapInt32(rc.healthy, 1) == 0 {
+			rc.log.Info().Msg("Redis has recovered")
+		}
+	} else {
+		if atomic.SwapInt32(rc.healthy, 0) == 1 {
+			rc.log.Warn().Err(err).Msg("Redis is unavailable, buffering critical writes")
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog"
+)
+
+// testRedisClient returns a RedisClient connected to an in memory redis
+func testRedisClient(t *testing.T, bufferSize int) (*RedisClient, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start redis: %v", err)
+	}
+
+	rc := NewRedisClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1}, bufferSize, zerolog.Nop())
+	t.Cleanup(func() {
+		rc.Close()
+		mr.Close()
+	})
+	return rc, mr
+}
+
+// set returns a critical write setting key to value
+func set(key, value string) func(redis.Pipeliner) {
+	return func(pipe redis.Pipeliner) {
+		pipe.Set(context.Background(), key, value, 0)
+	}
+}
+
+func TestCriticalWriteBuffersWhilstUnavailable(t *testing.T) {
+	rc, mr := testRedisClient(t, 10)
+	ctx := context.Background()
+
+	mr.SetError("LOADING redis is loading")
+	if err := rc.CriticalWrite(ctx, set("key", "value")); err != nil {
+		t.Fatalf("expected the write to be buffered, got %v", err)
+	}
+	if rc.Healthy() || rc.Health() != 0 {
+		t.Fatal("expected redis to be unhealthy after a write failed")
+	}
+	if buffered := rc.Buffered(); buffered != 1 {
+		t.Fatalf("expected 1 buffered write, got %d", buffered)
+	}
+
+	// Flushing whilst redis is still unavailable keeps the buffer
+	if err := rc.flush(ctx); err == nil {
+		t.Fatal("expected flushing to fail whilst redis is unavailable")
+	}
+	if rc.Healthy() || rc.Buffered() != 1 {
+		t.Fatal("expected the write to still be buffered")
+	}
+
+	mr.SetError("")
+	if err := rc.flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if !rc.Healthy() || rc.Buffered() != 0 {
+		t.Fatalf("expected redis to be healthy with nothing buffered, %d buffered", rc.Buffered())
+	}
+	if value, _ := mr.Get("key"); value != "value" {
+		t.Errorf("expected the buffered write to be flushed, got %q", value)
+	}
+}
+
+func TestCriticalWriteBufferFull(t *testing.T) {
+	rc, mr := testRedisClient(t, 1)
+	ctx := context.Background()
+
+	mr.SetError("LOADING redis is loading")
+	rc.CriticalWrite(ctx, set("a", "1"))
+	if err := rc.CriticalWrite(ctx, set("b", "1")); err != ErrRedisBufferFull {
+		t.Errorf("expected ErrRedisBufferFull, got %v", err)
+	}
+}
+
+func TestCriticalWriteAfterRecovery(t *testing.T) {
+	rc, mr := testRedisClient(t, 10)
+	ctx := context.Background()
+
+	mr.SetError("LOADING redis is loading")
+	rc.CriticalWrite(ctx, set("key", "old"))
+	mr.SetError("")
+
+	// Whilst the buffer is locked, such as when it is being flushed, a
+	// write must wait and then not be overwritten by the older write.
+	rc.bufferMu.Lock()
+	done := make(chan error)
+	go func() {
+		done <- rc.CriticalWrite(ctx, set("key", "new"))
+	}()
+
+	rc.bufferMu.Unlock()
+	if err := rc.flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	// The write was either flushed with the buffer or ran directly after
+	// it, so nothing is left to overwrite newer writes later on.
+	if buffered := rc.Buffered(); buffered != 0 {
+		t.Fatalf("expected nothing to be buffered once healthy, got %d", buffered)
+	}
+
+	rc.CriticalWrite(ctx, set("key", "newer"))
+	rc.flush(ctx)
+	if value, _ := mr.Get("key"); value != "newer" {
+		t.Errorf("expected the newest write to be kept, got %q", value)
+	}
+}
+
+func TestCriticalWriteReplyError(t *testing.T) {
+	rc, mr := testRedisClient(t, 10)
+	ctx := context.Background()
+	mr.HSet("hash", "field", "value")
+
+	// A command failing is not an outage so the write is not buffered
+	wrongType := func(pipe redis.Pipeliner) {
+		pipe.LPush(ctx, "hash", "value")
+	}
+	if err := rc.CriticalWrite(ctx, wrongType); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Fatalf("expected WRONGTYPE to be returned, got %v", err)
+	}
+	if !rc.Healthy() || rc.Buffered() != 0 {
+		t.Fatalf("expected redis to be healthy with nothing buffered, %d buffered", rc.Buffered())
+	}
+
+	// A WRONGTYPE write buffered during an outage does not stop redis
+	// from recovering or the writes around it from being flushed
+	mr.SetError("LOADING redis is loading")
+	rc.CriticalWrite(ctx, set("a", "1"))
+	mr.SetError("")
+	rc.bufferMu.Lock()
+	rc.buffer = append(rc.buffer, wrongType)
+	rc.bufferMu.Unlock()
+	rc.CriticalWrite(ctx, set("b", "1"))
+
+	if err := rc.flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if !rc.Healthy() || rc.Buffered() != 0 {
+		t.Fatalf("expected redis to be healthy with nothing buffered, %d buffered", rc.Buffered())
+	}
+	for _, key := range []string{"a", "b"} {
+		if value, _ := mr.Get(key); value != "1" {
+			t.Errorf("expected %s to be flushed, got %q", key, value)
+		}
+	}
+}
@@ -3,19 +3,29 @@ package gateway
 import (
 	"context"
 	"errors"
+	"math/rand"
+	"net/url"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/TheRockettek/Sandwich-Producer/events"
-	"github.com/TheRockettek/czlib"
+	"github.com/bwmarrin/snowflake"
+	jsoniter "github.com/json-iterator/go"
 	"nhooyr.io/websocket"
 )
 
 // ErrReconnectPlease is used to tell the restarter it can restart the client
 var ErrReconnectPlease = errors.New("B) Can you restart the client kthx")
 
+// ErrShardStopped is returned when waiting for a Shard that has stopped
+var ErrShardStopped = errors.New("shard stopped before it was ready")
+
+// ErrShardNotConnected is returned when sending to a Shard that does not
+// currently have a connection
+var ErrShardNotConnected = errors.New("shard is not connected")
+
 // Shard represents a single gateway connection
 type Shard struct {
 	Manager    *Manager
@@ -29,6 +39,7 @@ type Shard struct {
 	ShardID    int
 	ShardCount int
 
+	heartbeatMu       sync.RWMutex
 	LastHeartbeatAck  time.Time
 	LastHeartbeatSent time.Time
 
@@ -38,14 +49,89 @@ type Shard struct {
 	msg events.ReceivedPayload
 	buf []byte
 
-	seq       *int64
+	// decompressor is the transport decompression context for the
+	// current connection
+	decompressor Decompressor
+
+	seq *int64
+
+	// sessionMu guards sessionID and resumeSequence as they are also read
+	// when marshaling events
+	sessionMu sync.RWMutex
 	sessionID string
+
+	// resumeSequence is the sequence that was sent in the last resume
+	resumeSequence int64
+
+	// resuming is true whilst a resume has been sent and Discord has not
+	// yet responded with RESUMED
+	resuming bool
+
+	// resumeGatewayURL is the url provided in READY that should be used
+	// when resuming instead of the url from /gateway/bot
+	resumeGatewayURL string
+
+	// ready is closed once the Shard has received READY and stopped is
+	// closed once Open has returned with err.
+	ready     chan void
+	readyOnce sync.Once
+	stopped   chan void
+	err       error
+
+	// stopping is 1 once Stop has been called so the Shard will not
+	// reconnect
+	stopping int32
+
+	// identified frees the identify ratelimits held whilst connecting
+	identified func()
+
+	// state is the current ShardState
+	state int32
+
+	// resumingSince is the unix nano time the last resume was sent at and
+	// resumedAt is when Discord responded with RESUMED. Events Discord
+	// replays are received between the two.
+	resumingSince int64
+	resumedAt     int64
+
+	// identifyWait is how long the Shard last waited for the identify
+	// ratelimits
+	identifyWait int64
+
+	// guilds stores the guilds the Shard has and if they are available.
+	// outages stores the guilds that became unavailable after they were
+	// available or did not load within GuildLoadTimeout so GUILD_CREATE
+	// can be told apart from lazy loading.
+	guildsMu sync.RWMutex
+	guilds   map[snowflake.ID]bool
+	outages  map[snowflake.ID]void
+
+	// loading stores the guilds sent in READY that have not yet been
+	// received out of the expected guilds. If no guilds are received
+	// within GuildLoadTimeout, loadTimer gives up waiting for the rest.
+	loading   map[snowflake.ID]void
+	expected  int
+	loadTimer *time.Timer
 }
 
 // Open opens the shard, this will return once the Shard has ended
 func (s *Shard) Open() (err error) {
+	defer func() {
+		s.err = err
+		close(s.stopped)
+		s.done.Done()
+	}()
+
+	defer s.setState(ShardStateClosed)
+
 	err = s.connect()
 	for s.canContinue(err) {
+		s.setState(ShardStateReconnecting)
+		s.stopLoadTimer()
+		if isAbnormalClosure(err) {
+			atomic.AddInt64(s.Manager.abnormalClosures, 1)
+			s.Manager.log.Warn().Int("shard", s.ShardID).Err(err).Msg("Connection closed abnormally, reconnecting")
+		}
 		err = s.connect()
 	}
 
@@ -58,29 +144,59 @@ func (s *Shard) connect() (err error) {
 	// We will now wait for any ratelimits to also be freed then
 	// wait for a free spot to Identify the bot
 	s.Manager.log.Debug().Int("shard", s.ShardID).Msg("Waiting to identify")
-	s.Manager.WaitForIdentifyRatelimit(s.ShardID)
+	waitStart := time.Now()
+	release := s.Manager.WaitForIdentifyRatelimit(s.ShardID)
 
 	s.Manager.log.Debug().Int("shard", s.ShardID).Msg("Waiting for concurrent session limit")
 	ticket := s.Manager.ReadyLimiter.Wait()
 
-	// TODO: FreeTicket when ready :)
+	wait := time.Since(waitStart)
+	atomic.StoreInt64(&s.identifyWait, int64(wait))
+	s.Manager.metrics.identifyWaited(s.ShardID, wait)
 
-	s.Manager.ReadyLimiter.FreeTicket(ticket)
+	// Both the identify bucket and ticket are held until we receive READY
+	// or RESUMED so another Shard in the same bucket cannot identify at
+	// the same time.
+	s.identified = func() {
+		s.Manager.ReadyLimiter.FreeTicket(ticket)
+		release()
+	}
+	defer s.releaseIdentify()
 
 	s.Manager.log.Debug().Int("shard", s.ShardID).Msg("Ready to start")
+	s.setState(ShardStateConnecting)
 	s.ctx, s.cancel = context.WithCancel(context.Background())
 	defer s.cancel()
 
 	// Start actually connecting
 	s.Manager.log.Debug().Int("shard", s.ShardID).Msgf("Connecting to gateway")
-	s.wsConn, _, err = websocket.Dial(s.ctx, s.Manager.Gateway.URL, nil)
-	s.wsConn.SetReadLimit(512 << 20)
+	gatewayURL := s.Manager.Gateway.URL
+	if s.canResume() && s.resumeGatewayURL != "" {
+		gatewayURL = s.resumeGatewayURL
+	}
 
+	s.wsConn, _, err = websocket.Dial(s.ctx, s.gatewayQuery(gatewayURL), nil)
 	if err != nil {
-		s.Manager.log.Error().Int("shard", s.ShardID).Msg("Connecting to gateway")
+		s.Manager.log.Error().Int("shard", s.ShardID).Err(err).Msg("Failed to connect to gateway")
 		return
 	}
 
+	s.Manager.produceShardEvent("SHARD_CONNECT", ShardConnectEvent{ShardID: s.ShardID})
+	defer func() {
+		s.Manager.produceShardEvent("SHARD_DISCONNECT", ShardDisconnectEvent{
+			ShardID: s.ShardID,
+			Code:    int(websocket.CloseStatus(err)),
+			Reason:  errorString(err),
+		})
+	}()
+
+	// Every connection starts a new compression stream so the context
+	// from the previous connection cannot be reused.
+	s.resetDecompressor()
+	defer s.releaseDecompressor()
+
+	s.wsConn.SetReadLimit(512 << 20)
+
 	s.Manager.log.Debug().Int("shard", s.ShardID).Msg("Starting gateway")
 
 	// Expect a Hello
@@ -99,14 +215,19 @@ func (s *Shard) connect() (err error) {
 	}
 
 	hello.HeartbeatInterval = hello.HeartbeatInterval * time.Millisecond
-	ticker := time.NewTicker(hello.HeartbeatInterval)
 	s.Manager.log.Debug().Int("shard", s.ShardID).Dur("heartbeat", hello.HeartbeatInterval).Msg("Received hello")
 
-	var heartbeatFailures time.Duration
-	heartbeatFailures = hello.HeartbeatInterval * (time.Duration(s.Manager.Configuration.MaxHeartbeatFailures) * time.Millisecond)
+	// As this may be a reconnect, we will treat the hello as an ACK so
+	// the previous connection's heartbeats are not counted as failures.
+	s.heartbeatMu.Lock()
+	s.LastHeartbeatAck = time.Now().UTC()
+	s.heartbeatMu.Unlock()
+
+	heartbeatFailures := hello.HeartbeatInterval * time.Duration(s.Manager.Configuration.MaxHeartbeatFailures)
 
 	sequence := atomic.LoadInt64(s.seq)
-	if s.sessionID == "" && sequence == 0 {
+	sessionID, _ := s.session()
+	if sessionID == "" && sequence == 0 {
 		s.Manager.log.Debug().Int("shard", s.ShardID).Msg("Sending identify packet")
 
 		err = s.WSWriteJSON(events.SentPayload{
@@ -118,12 +239,17 @@ func (s *Shard) connect() (err error) {
 			return
 		}
 	} else {
-		s.Manager.log.Debug().Int("shard", s.ShardID).Str("session", s.sessionID).Int64("seq", sequence).Msg("Sending resume packet")
+		s.Manager.log.Debug().Int("shard", s.ShardID).Str("session", sessionID).Int64("seq", sequence).Msg("Sending resume packet")
+		s.sessionMu.Lock()
+		s.resumeSequence = sequence
+		s.sessionMu.Unlock()
+		s.resuming = true
+		atomic.StoreInt64(&s.resumingSince, time.Now().UnixNano())
 		err = s.WSWriteJSON(events.SentPayload{
 			Op: 6,
 			Data: events.Resume{
 				Token:     s.Manager.Token,
-				SessionID: s.sessionID,
+				SessionID: sessionID,
 				Seq:       sequence,
 			},
 		})
@@ -133,36 +259,194 @@ func (s *Shard) connect() (err error) {
 		}
 	}
 
+	go s.heartbeat(hello.HeartbeatInterval, heartbeatFailures)
+
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
-		case <-ticker.C:
-			s.Manager.log.Debug().Int("shard", s.ShardID).Msg("Sending heartbeat")
-			sequence := atomic.LoadInt64(s.seq)
-			err = s.WSWriteJSON(events.SentPayload{
-				Op:   int(events.GatewayOpHeartbeat),
-				Data: sequence,
-			})
-			lastAck := s.LastHeartbeatAck
-			if err != nil || time.Now().UTC().Sub(lastAck) > heartbeatFailures {
-				s.Close(4000)
-				return
-			}
 		default:
 		}
 
+		// If we fail to read, we will let Open decide if we should
+		// reconnect as the connection is no longer usable.
 		err = s.readMessage()
 		if err != nil {
 			s.Manager.log.Debug().Int("shard", s.ShardID).Msg("Failed to read message")
-			if !s.canContinue(err) {
-				return
-			}
-			continue
+			return
+		}
+
+		err = s.dispatch(s.msg)
+		if err == ErrReconnectPlease {
+			// Closing with a non 1000 code keeps the session resumable
+			s.cancel()
+			s.Close(4000)
+			return
+		}
+		if err != nil {
+			s.Manager.log.Error().Int("shard", s.ShardID).Err(err).Msg("Failed to handle message")
+		}
+	}
+}
+
+// dispatch passes dispatch payloads to the Manager to be marshaled and
+// produced. Any other ops are handled by the Shard.
+func (s *Shard) dispatch(payload events.ReceivedPayload) (err error) {
+	if events.GatewayOp(payload.Op) != events.GatewayOpDispatch {
+		return s.handleOp(payload)
+	}
+
+	// We will keep track of the sequence and session so we are able to
+	// resume if we reconnect.
+	atomic.StoreInt64(s.seq, int64(payload.Sequence))
+	if payload.Type == "READY" {
+		s.sessionMu.Lock()
+		s.sessionID = json.Get(payload.Data, "session_id").ToString()
+		s.sessionMu.Unlock()
+		s.resumeGatewayURL = json.Get(payload.Data, "resume_gateway_url").ToString()
+		atomic.StoreInt64(&s.resumingSince, 0)
+		user := &events.User{}
+		if err := json.UnmarshalFromString(json.Get(payload.Data, "user").ToString(), user); err == nil {
+			s.Manager.setSelf(user)
 		}
+		s.setReady()
+	}
+
+	if payload.Type == "READY" || payload.Type == "RESUMED" {
+		s.resuming = false
+		s.releaseIdentify()
+		s.setState(ShardStateConnected)
+	}
+
+	if payload.Type == "RESUMED" {
+		atomic.StoreInt64(&s.resumedAt, time.Now().UnixNano())
+		s.restartLoadTimer()
+	}
 
-		println("message!", s.ShardID, s.msg.Op, s.msg.Type, len(s.msg.Data))
+	created, loaded := s.trackGuilds(payload.Type, jsoniter.RawMessage(payload.Data))
+
+	// Whilst the old ShardGroup is still running, we only handle the
+	// events needed to build up the state otherwise events such as
+	// MESSAGE_CREATE would be produced twice.
+	if s.ShardGroup.IsScaling() && payload.Type != "READY" && payload.Type != "GUILD_CREATE" {
+		return
+	}
+
+	atomic.AddInt64(s.Manager.pending, 1)
+	s.Manager.eventChannel <- Event{
+		ShardID:  s.ShardID,
+		Sequence: int64(payload.Sequence),
+		Type:     payload.Type,
+		Data:     jsoniter.RawMessage(payload.Data),
+		shard:    s,
+
+		created: created,
+		loaded:  loaded,
+	}
+	return
+}
+
+// RequestGuildMembers asks Discord to send the members of a guild whose
+// username starts with query. If query is empty and limit is 0, every
+// member is sent. The members are received as GUILD_MEMBERS_CHUNK which
+// will include the nonce. If presences is true, the chunks also include
+// the presences of the members which requires the GUILD_PRESENCES intent.
+func (s *Shard) RequestGuildMembers(guildID snowflake.ID, query string, limit int, presences bool, nonce string) (err error) {
+	return s.WSWriteJSON(events.SentPayload{
+		Op: int(events.GatewayOpRequestGuildMembers),
+		Data: events.RequestGuildMembers{
+			GuildID:   guildID,
+			Query:     query,
+			Limit:     limit,
+			Presences: presences,
+			Nonce:     nonce,
+		},
+	})
+}
+
+// heartbeat sends a heartbeat every interval until the connection has
+// ended. If no heartbeat has been acknowledged within maxSilence, the
+// connection's context is cancelled so the shard can reconnect.
+func (s *Shard) heartbeat(interval time.Duration, maxSilence time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := s.sendHeartbeat()
+
+		s.heartbeatMu.RLock()
+		lastAck := s.LastHeartbeatAck
+		s.heartbeatMu.RUnlock()
+
+		if err != nil || time.Now().UTC().Sub(lastAck) > maxSilence {
+			s.Manager.log.Warn().Int("shard", s.ShardID).Err(err).Msg("Heartbeats are failing, reconnecting")
+			s.cancel()
+			return
+		}
+	}
+}
+
+// sendHeartbeat sends a heartbeat with the current sequence
+func (s *Shard) sendHeartbeat() (err error) {
+	s.Manager.log.Debug().Int("shard", s.ShardID).Msg("Sending heartbeat")
+
+	err = s.WSWriteJSON(events.SentPayload{
+		Op:   int(events.GatewayOpHeartbeat),
+		Data: atomic.LoadInt64(s.seq),
+	})
+	if err != nil {
+		return
+	}
+
+	s.heartbeatMu.Lock()
+	s.LastHeartbeatSent = time.Now().UTC()
+	s.heartbeatMu.Unlock()
+	return
+}
+
+// handleOp handles any ops received that are not dispatches
+func (s *Shard) handleOp(payload events.ReceivedPayload) (err error) {
+	switch events.GatewayOp(payload.Op) {
+	case events.GatewayOpHeartbeat:
+		// Discord is requesting a heartbeat so we will send one now
+		// instead of waiting for the next interval.
+		err = s.sendHeartbeat()
+	case events.GatewayOpHeartbeatACK:
+		s.heartbeatMu.Lock()
+		s.LastHeartbeatAck = time.Now().UTC()
+		s.heartbeatMu.Unlock()
+	case events.GatewayOpReconnect:
+		s.Manager.log.Info().Int("shard", s.ShardID).Msg("Discord requested a reconnect")
+		err = ErrReconnectPlease
+	case events.GatewayOpInvalidSession:
+		// If the session is not resumable, we must identify again. An
+		// invalid session in response to our resume means the resume was
+		// rejected so we will not try to resume the same session again.
+		resumable := json.Get(payload.Data).ToBool() && !s.resuming
+		if !resumable {
+			s.clearSession()
+		}
+
+		// Discord asks us to wait a random ammount of time between
+		// 1 and 5 seconds before identifying again.
+		wait := time.Second + time.Duration(rand.Int63n(int64(4*time.Second)))
+		s.Manager.log.Info().Int("shard", s.ShardID).Bool("resumable", resumable).Dur("wait", wait).Msg("Received invalid session")
+
+		select {
+		case <-s.ctx.Done():
+		case <-time.After(wait):
+		}
+		err = ErrReconnectPlease
+	default:
+		s.Manager.log.Debug().Int("shard", s.ShardID).Int("op", payload.Op).Msg("Received unknown op")
 	}
+	return
 }
 
 // WSWriteJSON turns an interface, marshals and sends it over WS
@@ -171,6 +455,14 @@ func (s *Shard) WSWriteJSON(i interface{}) (err error) {
 	if err != nil {
 		return
 	}
+
+	s.wsMutex.Lock()
+	defer s.wsMutex.Unlock()
+
+	if s.wsConn == nil {
+		return ErrShardNotConnected
+	}
+
 	err = s.wsConn.Write(s.ctx, websocket.MessageText, res)
 	return
 }
@@ -179,10 +471,38 @@ func (s *Shard) readMessage() (err error) {
 	s.Manager.log.Trace().Int("shard", s.ShardID).Msg("Reading message")
 	var mt websocket.MessageType
 
-	mt, s.buf, err = s.wsConn.Read(s.ctx)
-	if err != nil {
-		s.Manager.log.Error().Int("shard", s.ShardID).Msg("Failed to read websocket")
-		return
+	// With zlib-stream, large messages are split across multiple frames so
+	// we have to keep reading until a message is complete.
+	for {
+		mt, s.buf, err = s.wsConn.Read(s.ctx)
+		if err != nil {
+			s.Manager.log.Error().Int("shard", s.ShardID).Msg("Failed to read websocket")
+			return
+		}
+
+		if mt == websocket.MessageBinary && s.decompressor != nil {
+			s.buf, err = s.decompressor.Decompress(s.buf)
+			if errors.Is(err, ErrMessageTooLarge) {
+				s.droppedOversized()
+				continue
+			}
+			if err != nil {
+				s.Manager.log.Warn().Int("shard", s.ShardID).Err(err).Msg("Failed to decompress buffer")
+				return
+			}
+			if s.buf == nil {
+				continue
+			}
+		}
+
+		// The read limit only applies to the compressed message so we
+		// also have to check the size once it has been decompressed.
+		if maxSize := s.Manager.Configuration.MaxEventSize; maxSize > 0 && len(s.buf) > maxSize {
+			s.droppedOversized()
+			continue
+		}
+
+		break
 	}
 
 	start := time.Now()
@@ -193,18 +513,21 @@ func (s *Shard) readMessage() (err error) {
 		}
 	}(s)
 
-	if mt == websocket.MessageBinary {
-		s.buf, err = czlib.Decompress(s.buf)
-		if err != nil {
-			s.Manager.log.Warn().Int("shard", s.ShardID).Err(err).Msg("Failed to decompress buffer")
-			return
-		}
-	}
-
+	// As we reuse the payload, we must clear it first as fields are
+	// omitted when they are not relevant to the op.
+	s.msg = events.ReceivedPayload{}
 	err = json.Unmarshal(s.buf, &s.msg)
 	return
 }
 
+// droppedOversized records a message being dropped for being larger than
+// MaxEventSize
+func (s *Shard) droppedOversized() {
+	atomic.AddInt64(s.Manager.droppedOversized, 1)
+	s.Manager.metrics.dropped(DropReasonOversized)
+	s.Manager.log.Warn().Int("shard", s.ShardID).Int("max", s.Manager.Configuration.MaxEventSize).Msg("Dropping message that is too large")
+}
+
 func (s *Shard) decodeContent(dat interface{}) (err error) {
 	err = json.Unmarshal(s.msg.Data, &dat)
 	return
@@ -214,30 +537,162 @@ func (s *Shard) decodeContent(dat interface{}) (err error) {
 func (s *Shard) Close(statusCode int) (err error) {
 	s.Manager.log.Info().Int("shard", s.ShardID).Msgf("Closing shard with code %d", statusCode)
 
+	s.stopLoadTimer()
+
+	s.wsMutex.Lock()
+	defer s.wsMutex.Unlock()
+
 	if s.wsConn != nil {
-		if err = s.wsConn.Close(4000, ""); err != nil {
-			return
-		}
+		err = s.wsConn.Close(websocket.StatusCode(statusCode), "")
 		s.wsConn = nil
 	}
 
-	// Trigger SHARD_DISCONNECT
-
 	return
 }
 
+// Drain stops the Shard from receiving any more events and waits for the
+// events it has already received to be produced. If ctx is done before
+// then, ctx.Err() is returned.
+func (s *Shard) Drain(ctx context.Context) (err error) {
+	s.Stop()
+
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return s.Manager.waitForPending(ctx)
+}
+
+// Stop closes the Shard and stops it from reconnecting
+func (s *Shard) Stop() (err error) {
+	atomic.StoreInt32(&s.stopping, 1)
+	return s.Close(int(websocket.StatusNormalClosure))
+}
+
+// isAbnormalClosure returns true if the connection was closed without a
+// close frame (1006) which is usually caused by the network rather than
+// Discord. Failing to connect is not an abnormal closure.
+func isAbnormalClosure(err error) bool {
+	return websocket.CloseStatus(err) == websocket.StatusAbnormalClosure
+}
+
 // canResume returns a boolean if it is possible for the shard
 // to resume
 func (s *Shard) canResume() bool {
-	return *s.seq != 0 && s.sessionID != ""
+	sessionID, _ := s.session()
+	return atomic.LoadInt64(s.seq) != 0 && sessionID != ""
+}
+
+// session returns the current session ID and the sequence that was sent
+// in the last resume
+func (s *Shard) session() (sessionID string, resumeSequence int64) {
+	s.sessionMu.RLock()
+	defer s.sessionMu.RUnlock()
+
+	return s.sessionID, s.resumeSequence
+}
+
+// clearSession forgets the current session so the next connection will
+// identify instead of resuming
+func (s *Shard) clearSession() {
+	s.sessionMu.Lock()
+	s.sessionID = ""
+	s.sessionMu.Unlock()
+	s.resumeGatewayURL = ""
+	s.resuming = false
+	atomic.StoreInt64(&s.resumingSince, 0)
+	atomic.StoreInt64(s.seq, 0)
 }
 
 // canContinue returns a boolean if its possible to continue
-// running the bot
+// running the bot. Close codes that would be sent again on the next
+// identify, such as an invalid token or disallowed intents, stop the
+// Shard. A normal closure is only fatal when we stopped the Shard
+// ourselves as Discord can also close with it.
 func (s *Shard) canContinue(err error) (continuable bool) {
+	if atomic.LoadInt32(&s.stopping) == 1 {
+		return false
+	}
 
-	continuable = err == ErrReconnectPlease || !contains(websocket.CloseStatus(err), events.CloseShardingRequired, events.CloseAuthenticationFailed, events.CloseInvalidShard, websocket.StatusNormalClosure)
-	return
+	if err == ErrReconnectPlease {
+		return true
+	}
+
+	switch websocket.CloseStatus(err) {
+	case events.CloseAuthenticationFailed,
+		events.CloseInvalidShard,
+		events.CloseShardingRequired,
+		events.CloseInvalidAPIVersion,
+		events.CloseInvalidIntents,
+		events.CloseDisallowedIntents:
+		return false
+	}
+	return true
+}
+
+// resumedWithin returns true if the Shard is resuming or has resumed
+// within the window. The window starts when the resume is sent as
+// Discord replays events before it sends RESUMED.
+func (s *Shard) resumedWithin(window time.Duration) bool {
+	resumingSince := atomic.LoadInt64(&s.resumingSince)
+	if resumingSince == 0 {
+		return false
+	}
+
+	resumedAt := atomic.LoadInt64(&s.resumedAt)
+	if resumedAt < resumingSince {
+		return true
+	}
+	return time.Since(time.Unix(0, resumedAt)) < window
+}
+
+// releaseIdentify frees the identify ratelimits if they are still held
+func (s *Shard) releaseIdentify() {
+	if s.identified != nil {
+		s.identified()
+		s.identified = nil
+	}
+}
+
+// resetDecompressor creates a new decompression context for the
+// configured transport compression, releasing the old one.
+func (s *Shard) resetDecompressor() {
+	s.releaseDecompressor()
+
+	switch s.Manager.Configuration.TransportCompression {
+	case TransportCompressionZlib:
+		s.decompressor = NewZlibStream(s.Manager.Configuration.MaxEventSize)
+	case TransportCompressionZstd:
+		s.decompressor = NewZstd(s.Manager.Configuration.MaxEventSize)
+	}
+}
+
+// releaseDecompressor frees the current decompression context
+func (s *Shard) releaseDecompressor() {
+	if s.decompressor != nil {
+		s.decompressor.Release()
+		s.decompressor = nil
+	}
+}
+
+// gatewayQuery adds the gateway version, encoding and transport
+// compression to a gateway url.
+func (s *Shard) gatewayQuery(gatewayURL string) string {
+	u, err := url.Parse(gatewayURL)
+	if err != nil {
+		return gatewayURL
+	}
+
+	q := u.Query()
+	q.Set("v", "6")
+	q.Set("encoding", "json")
+	if s.Manager.Configuration.TransportCompression != "" {
+		q.Set("compress", s.Manager.Configuration.TransportCompression)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
 }
 
 // identifyPacket returns a packet to send to discord
@@ -249,20 +704,35 @@ func (s *Shard) identifyPacket() (identify events.Identify) {
 			Browser: "Sandwich",
 			Device:  "Sandwich",
 		},
-		Compress:           true,
-		LargeThreshold:     100,
+		LargeThreshold:     s.Manager.Configuration.LargeThreshold,
 		Shard:              [2]int{s.ShardID, s.ShardCount},
-		Presence:           &events.Activity{},
-		GuildSubscriptions: false,
-		Intents:            0,
+		GuildSubscriptions: s.Manager.Configuration.GuildSubscriptions,
+		Intents:            s.Manager.Configuration.Intents,
 	}
+
+	identify.Presence = s.presence()
 	return
 }
 
 // WaitForReady will yield until the shard has started up
 // and has finished lazy loading guilds and members. At the
-// moment, we just have a WaitGroup.
+// moment, we only wait for READY. If the Shard stops before
+// it is ready, the error it stopped with is returned.
 func (s *Shard) WaitForReady() (err error) {
-	// s.done.Wait()
-	return
+	select {
+	case <-s.ready:
+		return
+	case <-s.stopped:
+		if s.err == nil {
+			return ErrShardStopped
+		}
+		return s.err
+	}
+}
+
+// setReady marks the Shard as ready
+func (s *Shard) setReady() {
+	s.readyOnce.Do(func() {
+		close(s.ready)
+	})
 }
@@ -1,18 +1,22 @@
 package gateway
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
 )
 
 // ShardGroup represents a selective group of shards. Used for
 // classifying a collective of shards such as during scaling.
 type ShardGroup struct {
 	Manager *Manager
-	Scaling bool
+
+	// scaling is 1 whilst an older ShardGroup is still running
+	scaling *int32
 
 	ShardCount int
 	ShardIDs   []int
@@ -20,25 +24,54 @@ type ShardGroup struct {
 	ShardsMu sync.Mutex
 	Shards   map[int]*Shard
 	Wait     sync.WaitGroup
-	err      error
+
+	errMu sync.Mutex
+	err   error
+
+	// loaded stores the Shards that have produced SHARD_READY
+	loadedMu sync.Mutex
+	loaded   map[int]void
 }
 
 // NewShardGroup makes a new shard group object for the Manager
 func NewShardGroup(m *Manager, shardIDs []int, shardCount int) (sg *ShardGroup, err error) {
 	m.log.Info().Int("shardcount", shardCount).Msg("Creating new ShardGroup")
-	return &ShardGroup{
+	sg = &ShardGroup{
 		Manager:    m,
-		Scaling:    false,
+		scaling:    new(int32),
 		ShardCount: shardCount,
 		ShardIDs:   shardIDs,
 		ShardsMu:   sync.Mutex{},
 		Shards:     make(map[int]*Shard),
 		Wait:       sync.WaitGroup{},
-	}, nil
+		loaded:     make(map[int]void),
+	}
+
+	m.ShardGroupsMu.Lock()
+	if len(m.ShardGroups) > 0 {
+		atomic.StoreInt32(sg.scaling, 1)
+	}
+	m.ShardGroupsMu.Unlock()
+
+	return sg, nil
 }
 
-// Spawn creates a new Shard for the ShardGroup
+// IsScaling returns true whilst an older ShardGroup is still running.
+// Scaling Shards only handle READY and GUILD_CREATE.
+func (sg *ShardGroup) IsScaling() bool {
+	return atomic.LoadInt32(sg.scaling) == 1
+}
+
+// Spawn creates a new Shard for the ShardGroup and waits for it to be ready
 func (sg *ShardGroup) Spawn(shardID int) (s *Shard, err error) {
+	s = sg.open(shardID)
+	err = s.WaitForReady()
+	return
+}
+
+// open creates a new Shard for the ShardGroup and starts it without
+// waiting for it to be ready
+func (sg *ShardGroup) open(shardID int) (s *Shard) {
 	s = &Shard{
 		Manager:    sg.Manager,
 		ShardGroup: sg,
@@ -56,66 +89,184 @@ func (sg *ShardGroup) Spawn(shardID int) (s *Shard, err error) {
 		buf: make([]byte, 0),
 
 		seq: new(int64),
+
+		ready:   make(chan void),
+		stopped: make(chan void),
+
+		guilds:  make(map[snowflake.ID]bool),
+		outages: make(map[snowflake.ID]void),
 	}
 
 	// Now we have added the Shard to the group, we can now start it up
-	// and wait for it to be ready.
 	sg.ShardsMu.Lock()
 	sg.Shards[shardID] = s
 	sg.ShardsMu.Unlock()
 	s.done.Add(1)
 	go s.Open()
-	err = s.WaitForReady()
-	return sg.Shards[shardID], err
+	return s
 }
 
 // Start creates the Shards specified in the ShardIDs. Start will return
 // when all Shards have started up.
 func (sg *ShardGroup) Start() (err error) {
 	wg := sync.WaitGroup{}
-	sg.err = nil
+	sg.setErr(nil)
+
+	// Shards are started in spawnOrder. As only one Shard per bucket can
+	// identify at a time, a Shard is not started until the Shard before it
+	// in the same bucket is ready.
+	maxConcurrency := sg.maxConcurrency()
+	previous := make(map[int]*Shard, maxConcurrency)
+
+	for _, shardID := range sg.spawnOrder() {
+		bucket := shardID % maxConcurrency
+		if s, ok := previous[bucket]; ok {
+			s.WaitForReady()
+		}
+
+		if sg.Err() != nil {
+			break
+		}
+
+		s := sg.open(shardID)
+		previous[bucket] = s
 
-	for _, shardID := range sg.ShardIDs {
 		wg.Add(1)
-		go func(shardID int) {
+		go func(s *Shard) {
 			defer wg.Done()
-			if _, err := sg.Spawn(shardID); err != nil {
-				sg.err = err
-				sg.Manager.log.Error().Err(err).Msgf("Failed to start Shard %d", shardID)
+			if err := s.WaitForReady(); err != nil {
+				sg.setErr(err)
+				sg.Manager.log.Error().Err(err).Msgf("Failed to start Shard %d", s.ShardID)
 			}
-		}(shardID)
+		}(s)
 	}
 	wg.Wait()
 
-	if sg.err != nil {
+	err = sg.Err()
+	if err != nil {
 		// If problems occur waiting for a ShardGroup's shard to start up, we
 		// will kill the entire Group
 		sg.Stop()
 	} else {
-		// Once we have created the ShardGroup, we will close the old ShardGroup if
+		// Once we have created the ShardGroup, we will close the old ShardGroups if
 		// there were no problems starting up the current Shard
 		sg.Manager.ShardGroupsMu.Lock()
-		counter := int(atomic.LoadInt64(sg.Manager.ShardGroupsCounter)) % sg.Manager.MaxShardGroups
-
-		// Well we cant stop a ShardGroup if none have started yet...
-		if counter != 0 {
-			sg.Manager.ShardGroups[counter].Stop()
+		for counter, oldGroup := range sg.Manager.ShardGroups {
+			oldGroup.Stop()
 			delete(sg.Manager.ShardGroups, counter)
 		}
 
-		atomic.AddInt64(sg.Manager.ShardGroupsCounter, 1)
-		counter = int(atomic.LoadInt64(sg.Manager.ShardGroupsCounter)) % sg.Manager.MaxShardGroups
-
+		counter := int(atomic.AddInt64(sg.Manager.ShardGroupsCounter, 1)) % sg.Manager.MaxShardGroups
 		sg.Manager.ShardGroups[counter] = sg
 		sg.Manager.ShardGroupsMu.Unlock()
+
+		// Now the old Shards are gone, the new ones can handle everything
+		atomic.StoreInt32(sg.scaling, 0)
 	}
 
+	return
+}
+
+// shardLoaded counts a Shard as having produced SHARD_READY. Once every
+// Shard of the ShardGroup has, WaitForReady on the Manager returns.
+func (sg *ShardGroup) shardLoaded(shardID int) {
+	sg.loadedMu.Lock()
+	sg.loaded[shardID] = void{}
+	loaded := len(sg.loaded)
+	sg.loadedMu.Unlock()
+
+	if loaded >= len(sg.ShardIDs) {
+		sg.Manager.readyOnce.Do(func() {
+			close(sg.Manager.ready)
+		})
+	}
+}
+
+// Err returns the error that stopped the ShardGroup from starting, if any
+func (sg *ShardGroup) Err() (err error) {
+	sg.errMu.Lock()
+	defer sg.errMu.Unlock()
 	return sg.err
 }
 
+// setErr sets the error returned by Err
+func (sg *ShardGroup) setErr(err error) {
+	sg.errMu.Lock()
+	sg.err = err
+	sg.errMu.Unlock()
+}
+
+// maxConcurrency returns the number of identify buckets
+func (sg *ShardGroup) maxConcurrency() int {
+	if sg.Manager.Gateway != nil && sg.Manager.Gateway.SessionStartLimit.MaxConcurrency > 0 {
+		return sg.Manager.Gateway.SessionStartLimit.MaxConcurrency
+	}
+	return 1
+}
+
+// spawnOrder returns the order the ShardIDs should be spawned in. When
+// ordered by bucket, the first shard of every identify bucket is spawned
+// before the second shard of any bucket and so on as only one shard per
+// bucket can identify at a time.
+func (sg *ShardGroup) spawnOrder() (shardIDs []int) {
+	if sg.Manager.Configuration.SpawnOrder != SpawnOrderBucket {
+		return sg.ShardIDs
+	}
+
+	return interleaveBuckets(sg.ShardIDs, sg.maxConcurrency())
+}
+
+// interleaveBuckets orders shardIDs round robin across the buckets they
+// identify in, keeping the original order within each bucket.
+func interleaveBuckets(shardIDs []int, maxConcurrency int) (ordered []int) {
+	buckets := make([][]int, maxConcurrency)
+	for _, shardID := range shardIDs {
+		bucket := shardID % maxConcurrency
+		buckets[bucket] = append(buckets[bucket], shardID)
+	}
+
+	ordered = make([]int, 0, len(shardIDs))
+	for round := 0; len(ordered) < len(shardIDs); round++ {
+		for _, bucket := range buckets {
+			if round < len(bucket) {
+				ordered = append(ordered, bucket[round])
+			}
+		}
+	}
+	return
+}
+
+// Drain drains every Shard in the ShardGroup at the same time. The first
+// error a Shard returns, such as when ctx is done, is returned.
+func (sg *ShardGroup) Drain(ctx context.Context) (err error) {
+	sg.ShardsMu.Lock()
+	shards := make([]*Shard, 0, len(sg.Shards))
+	for _, shard := range sg.Shards {
+		shards = append(shards, shard)
+	}
+	sg.ShardsMu.Unlock()
+
+	errs := make(chan error, len(shards))
+	for _, shard := range shards {
+		go func(shard *Shard) {
+			errs <- shard.Drain(ctx)
+		}(shard)
+	}
+
+	for range shards {
+		if shardErr := <-errs; shardErr != nil && err == nil {
+			err = shardErr
+		}
+	}
+	return
+}
+
 // Stop stops all Shards in the ShardGroup.
 func (sg *ShardGroup) Stop() {
+	sg.ShardsMu.Lock()
+	defer sg.ShardsMu.Unlock()
+
 	for _, shard := range sg.Shards {
-		shard.Close(4000)
+		shard.Stop()
 	}
 }
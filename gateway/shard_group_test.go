@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+)
+
+func TestInterleaveBuckets(t *testing.T) {
+	tests := []struct {
+		shardIDs       []int
+		maxConcurrency int
+		expected       []int
+	}{
+		{[]int{0, 1, 2, 3}, 1, []int{0, 1, 2, 3}},
+		{[]int{0, 1, 2, 3, 4, 5}, 2, []int{0, 1, 2, 3, 4, 5}},
+		{[]int{0, 2, 4, 1, 3, 5}, 2, []int{0, 1, 2, 3, 4, 5}},
+		{[]int{0, 1, 2, 3, 4, 5, 6}, 3, []int{0, 1, 2, 3, 4, 5, 6}},
+		{[]int{0, 3, 6, 1, 4, 2}, 3, []int{0, 1, 2, 3, 4, 6}},
+	}
+
+	for _, test := range tests {
+		if got := interleaveBuckets(test.shardIDs, test.maxConcurrency); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("interleaveBuckets(%v, %d) = %v, expected %v", test.shardIDs, test.maxConcurrency, got, test.expected)
+		}
+	}
+}
+
+func TestSpawnOrder(t *testing.T) {
+	m := testManager()
+	m.Gateway = &events.GatewayBot{}
+	m.Gateway.SessionStartLimit.MaxConcurrency = 2
+
+	sg := &ShardGroup{Manager: m, ShardIDs: []int{0, 2, 4, 1, 3}}
+	if got := sg.spawnOrder(); !reflect.DeepEqual(got, sg.ShardIDs) {
+		t.Errorf("expected the ShardIDs to be spawned in order, got %v", got)
+	}
+
+	m.Configuration.SpawnOrder = SpawnOrderBucket
+	if got, expected := sg.spawnOrder(), []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the ShardIDs to be spawned round robin across buckets, got %v", got)
+	}
+}
+
+func TestShardGroupErr(t *testing.T) {
+	sg := &ShardGroup{}
+	done := make(chan void)
+	for i := 0; i < 8; i++ {
+		go func() {
+			sg.setErr(ErrShardStopped)
+			done <- void{}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+
+	if err := sg.Err(); err != ErrShardStopped {
+		t.Errorf("expected ErrShardStopped, got %v", err)
+	}
+}
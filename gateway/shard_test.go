@@ -0,0 +1,444 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+	"nhooyr.io/websocket"
+)
+
+// testShard returns a Shard connected to a websocket server which passes
+// every message it receives to the returned channel
+func testShard(t *testing.T, shardID int) (*Shard, <-chan []byte) {
+	received := make(chan []byte, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
+		for {
+			_, msg, err := conn.Read(r.Context())
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}))
+
+	s := &Shard{ShardID: shardID, ShardCount: 1}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	var err error
+	s.wsConn, _, err = websocket.Dial(s.ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the test server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		s.wsConn.Close(websocket.StatusNormalClosure, "")
+		s.cancel()
+		server.Close()
+	})
+	return s, received
+}
+
+// receive returns the next message received by a test server
+func receive(t *testing.T, received <-chan []byte) []byte {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+func TestRequestGuildMembersPresences(t *testing.T) {
+	s, received := testShard(t, 0)
+
+	for _, presences := range []bool{true, false} {
+		if err := s.RequestGuildMembers(snowflake.ID(1), "", 0, presences, "nonce"); err != nil {
+			t.Fatalf("failed to request guild members: %v", err)
+		}
+
+		payload := receive(t, received)
+		if op := json.Get(payload, "op").ToInt(); op != int(events.GatewayOpRequestGuildMembers) {
+			t.Errorf("expected op %d, got %d", events.GatewayOpRequestGuildMembers, op)
+		}
+
+		data := json.Get(payload, "d")
+		if got := data.Get("presences").ToBool(); got != presences {
+			t.Errorf("expected presences to be %t, got %t in %s", presences, got, payload)
+		}
+		if nonce := data.Get("nonce").ToString(); nonce != "nonce" {
+			t.Errorf("expected the nonce to be sent, got %q", nonce)
+		}
+	}
+}
+
+func TestResumedWithin(t *testing.T) {
+	s := &Shard{}
+	if s.resumedWithin(time.Minute) {
+		t.Fatal("expected a Shard that never resumed to not be within the window")
+	}
+
+	// Replayed events are received after the resume is sent but before
+	// RESUMED so the window must already have started.
+	atomic.StoreInt64(&s.resumingSince, time.Now().UnixNano())
+	if !s.resumedWithin(time.Minute) {
+		t.Fatal("expected a Shard that is resuming to be within the window")
+	}
+
+	atomic.StoreInt64(&s.resumedAt, time.Now().UnixNano())
+	if !s.resumedWithin(time.Minute) {
+		t.Fatal("expected a Shard that has just resumed to be within the window")
+	}
+
+	atomic.StoreInt64(&s.resumedAt, time.Now().Add(-2*time.Minute).UnixNano())
+	atomic.StoreInt64(&s.resumingSince, time.Now().Add(-3*time.Minute).UnixNano())
+	if s.resumedWithin(time.Minute) {
+		t.Fatal("expected a Shard that resumed before the window to not be within it")
+	}
+
+	// An identify ends the resume even if RESUMED was never received
+	seq := int64(1)
+	s.seq = &seq
+	atomic.StoreInt64(&s.resumingSince, time.Now().UnixNano())
+	s.clearSession()
+	if s.resumedWithin(time.Minute) {
+		t.Fatal("expected a cleared session to not be within the window")
+	}
+}
+
+func TestReplayedUpdateBurst(t *testing.T) {
+	m := &Manager{}
+	m.Configuration.ResumeWindow = 5
+
+	s := &Shard{Manager: m}
+	atomic.StoreInt64(&s.resumingSince, time.Now().UnixNano())
+
+	// The burst of GUILD_UPDATE, GUILD_ROLE_UPDATE and CHANNEL_UPDATE
+	// replayed before RESUMED is suppressed if nothing changed.
+	for _, eventType := range []string{"GUILD_UPDATE", "GUILD_ROLE_UPDATE", "CHANNEL_UPDATE"} {
+		e := Event{Type: eventType, shard: s}
+		if !m.replayedUpdate(e, true) {
+			t.Errorf("expected an unchanged %s whilst resuming to be suppressed", eventType)
+		}
+		if m.replayedUpdate(e, false) {
+			t.Errorf("expected a changed %s whilst resuming to be produced", eventType)
+		}
+	}
+
+	atomic.StoreInt64(&s.resumedAt, time.Now().UnixNano())
+	if !m.replayedUpdate(Event{Type: "GUILD_UPDATE", shard: s}, true) {
+		t.Error("expected an unchanged update just after RESUMED to be suppressed")
+	}
+
+	atomic.StoreInt64(&s.resumingSince, time.Now().Add(-11*time.Second).UnixNano())
+	atomic.StoreInt64(&s.resumedAt, time.Now().Add(-10*time.Second).UnixNano())
+	if m.replayedUpdate(Event{Type: "GUILD_UPDATE", shard: s}, true) {
+		t.Error("expected an unchanged update after the window to be produced")
+	}
+
+	m.Configuration.ResumeWindow = 0
+	atomic.StoreInt64(&s.resumedAt, time.Now().UnixNano())
+	if m.replayedUpdate(Event{Type: "GUILD_UPDATE", shard: s}, true) {
+		t.Error("expected updates to be produced when ResumeWindow is disabled")
+	}
+}
+
+func TestReadMessageMaxEventSize(t *testing.T) {
+	large := `{"op":0,"t":"GUILD_CREATE","d":"` + strings.Repeat("a", 4096) + `"}`
+	frames := zlibFrames(t, large, `{"op":11}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
+		for _, frame := range frames {
+			if err := conn.Write(r.Context(), websocket.MessageBinary, frame); err != nil {
+				return
+			}
+		}
+		conn.Read(r.Context())
+	}))
+	defer server.Close()
+
+	m := testManager()
+	m.Configuration.MaxEventSize = 1024
+	m.Configuration.TransportCompression = TransportCompressionZlib
+
+	s := &Shard{Manager: m}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+	s.resetDecompressor()
+	defer s.releaseDecompressor()
+
+	var err error
+	s.wsConn, _, err = websocket.Dial(s.ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the test server: %v", err)
+	}
+	defer s.wsConn.Close(websocket.StatusNormalClosure, "")
+
+	if err = s.readMessage(); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if s.msg.Op != int(events.GatewayOpHeartbeatACK) {
+		t.Errorf("expected the oversized message to be skipped, got op %d", s.msg.Op)
+	}
+	if dropped := m.DroppedOversized(); dropped != 1 {
+		t.Errorf("expected 1 oversized message to be dropped, got %d", dropped)
+	}
+}
+
+func TestIsAbnormalClosure(t *testing.T) {
+	tests := []struct {
+		err      error
+		abnormal bool
+	}{
+		{nil, false},
+		{websocket.CloseError{Code: websocket.StatusAbnormalClosure}, true},
+		{fmt.Errorf("failed to read: %w", websocket.CloseError{Code: websocket.StatusAbnormalClosure}), true},
+		{websocket.CloseError{Code: websocket.StatusNormalClosure}, false},
+		{websocket.CloseError{Code: 4000, Reason: "Unknown error"}, false},
+		{io.EOF, false},
+		{io.ErrUnexpectedEOF, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, false},
+	}
+
+	for _, test := range tests {
+		if abnormal := isAbnormalClosure(test.err); abnormal != test.abnormal {
+			t.Errorf("isAbnormalClosure(%v) = %t, expected %t", test.err, abnormal, test.abnormal)
+		}
+	}
+}
+
+func TestCanContinue(t *testing.T) {
+	tests := []struct {
+		err         error
+		continuable bool
+	}{
+		{nil, true},
+		{ErrReconnectPlease, true},
+		{io.EOF, true},
+		{websocket.CloseError{Code: websocket.StatusAbnormalClosure}, true},
+		{websocket.CloseError{Code: websocket.StatusNormalClosure}, true},
+		{websocket.CloseError{Code: events.CloseSessionTimeout}, true},
+		{websocket.CloseError{Code: events.CloseAuthenticationFailed}, false},
+		{websocket.CloseError{Code: events.CloseInvalidShard}, false},
+		{websocket.CloseError{Code: events.CloseShardingRequired}, false},
+		{websocket.CloseError{Code: events.CloseInvalidAPIVersion}, false},
+		{websocket.CloseError{Code: events.CloseInvalidIntents}, false},
+		{fmt.Errorf("failed to read: %w", websocket.CloseError{Code: events.CloseDisallowedIntents}), false},
+	}
+
+	s := &Shard{}
+	for _, test := range tests {
+		if continuable := s.canContinue(test.err); continuable != test.continuable {
+			t.Errorf("canContinue(%v) = %t, expected %t", test.err, continuable, test.continuable)
+		}
+	}
+
+	atomic.StoreInt32(&s.stopping, 1)
+	if s.canContinue(ErrReconnectPlease) {
+		t.Error("expected a stopped Shard to not continue")
+	}
+}
+
+func TestOpenStopsOnDisallowedIntents(t *testing.T) {
+	connections := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(connections, 1)
+		conn.Close(events.CloseDisallowedIntents, "Disallowed intent(s).")
+	}))
+	defer server.Close()
+
+	m := testManager()
+	m.Gateway = &events.GatewayBot{URL: "ws" + strings.TrimPrefix(server.URL, "http")}
+	m.Gateway.SessionStartLimit.MaxConcurrency = 1
+	m.Buckets = NewBucketStore()
+	m.Buckets.CreateBucket("/gateway/bot/0", 1, time.Millisecond)
+	m.identifyLocks = make(map[int]*ConcurrencyLimiter)
+	m.ReadyLimiter = NewConcurrencyLimiter(1)
+
+	s := &Shard{Manager: m, seq: new(int64), done: &sync.WaitGroup{}, stopped: make(chan void)}
+	s.done.Add(1)
+
+	opened := make(chan error, 1)
+	go func() {
+		opened <- s.Open()
+	}()
+
+	// Identifying again would be closed with 4014 again so the Shard
+	// must stop rather than reconnect
+	select {
+	case err := <-opened:
+		if code := websocket.CloseStatus(err); code != events.CloseDisallowedIntents {
+			t.Errorf("expected the Shard to stop with 4014, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		s.Stop()
+		t.Fatal("expected the Shard to stop after being closed with 4014")
+	}
+	if count := atomic.LoadInt32(connections); count != 1 {
+		t.Errorf("expected 1 connection, got %d", count)
+	}
+}
+
+func TestResetDecompressorPerConnection(t *testing.T) {
+	s := &Shard{Manager: testManager()}
+	s.Manager.Configuration.TransportCompression = TransportCompressionZlib
+
+	// Each connection starts a new zlib stream, beginning with a header
+	connections := [][]string{
+		{`{"op":10,"d":{"heartbeat_interval":41250}}`, `{"op":0,"t":"READY","d":{"session_id":"a"}}`},
+		{`{"op":10,"d":{"heartbeat_interval":41250}}`, `{"op":0,"t":"RESUMED","d":{}}`},
+	}
+
+	var previous Decompressor
+	for i, messages := range connections {
+		s.resetDecompressor()
+		if s.decompressor == nil || s.decompressor == previous {
+			t.Fatalf("expected connection %d to have a new decompressor", i)
+		}
+		previous = s.decompressor
+
+		for j, frame := range zlibFrames(t, messages...) {
+			data, err := s.decompressor.Decompress(frame)
+			if err != nil {
+				t.Fatalf("failed to decompress message %d of connection %d: %v", j, i, err)
+			}
+			if string(data) != messages[j] {
+				t.Errorf("expected message %d of connection %d to be %q, got %q", j, i, messages[j], data)
+			}
+		}
+	}
+
+	s.releaseDecompressor()
+	if s.decompressor != nil {
+		t.Error("expected the decompressor to be released")
+	}
+}
+
+func TestConnectRecordsIdentifyWait(t *testing.T) {
+	m := testManager()
+	m.Gateway = &events.GatewayBot{URL: "ws://" + closedAddress(t)}
+	m.Gateway.SessionStartLimit.MaxConcurrency = 1
+	m.Buckets = NewBucketStore()
+	m.Buckets.CreateBucket("/gateway/bot/0", 1, time.Millisecond)
+	m.identifyLocks = make(map[int]*ConcurrencyLimiter)
+	m.ReadyLimiter = NewConcurrencyLimiter(1)
+
+	s := &Shard{Manager: m, ShardID: 0, seq: new(int64)}
+
+	// Another Shard is still identifying so we have to wait for it
+	ticket := m.ReadyLimiter.Wait()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.ReadyLimiter.FreeTicket(ticket)
+	}()
+
+	// There is nothing to connect to so connect returns once it has
+	// finished waiting
+	if err := s.connect(); err == nil {
+		t.Fatal("expected connecting to fail")
+	}
+
+	wait := time.Duration(atomic.LoadInt64(&s.identifyWait))
+	if wait < 50*time.Millisecond {
+		t.Errorf("expected the shard to have waited at least 50ms, got %s", wait)
+	}
+
+	families, err := m.metrics.registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	recorded := map[string]bool{}
+	for _, family := range families {
+		switch family.GetName() {
+		case "sandwich_identify_wait_seconds":
+			recorded[family.GetName()] = family.GetMetric()[0].GetHistogram().GetSampleCount() == 1
+		case "sandwich_identify_wait_last_seconds":
+			gauge := family.GetMetric()[0].GetGauge().GetValue()
+			recorded[family.GetName()] = gauge >= wait.Seconds()-0.001
+		}
+	}
+	for _, name := range []string{"sandwich_identify_wait_seconds", "sandwich_identify_wait_last_seconds"} {
+		if !recorded[name] {
+			t.Errorf("expected the wait to be recorded in %s", name)
+		}
+	}
+
+	// The identify ratelimits are released when connecting fails
+	select {
+	case ticket := <-m.ReadyLimiter.tickets:
+		m.ReadyLimiter.tickets <- ticket
+	default:
+		t.Error("expected the ready limiter ticket to be freed")
+	}
+}
+
+func TestInvalidSessionAfterResume(t *testing.T) {
+	tests := []struct {
+		name      string
+		resuming  bool
+		resumable string
+		expected  bool
+	}{
+		{"resume rejected", true, "true", false},
+		{"resume rejected and not resumable", true, "false", false},
+		{"resumable", false, "true", true},
+		{"not resumable", false, "false", false},
+	}
+
+	for _, test := range tests {
+		s := &Shard{Manager: testManager(), seq: new(int64)}
+		s.sessionID = "abc"
+		s.resumeGatewayURL = "wss://gateway-us-east1-b.discord.gg"
+		s.resuming = test.resuming
+		atomic.StoreInt64(s.seq, 10)
+
+		// Skip waiting before reconnecting
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s.ctx = ctx
+
+		err := s.handleOp(events.ReceivedPayload{
+			Op:   int(events.GatewayOpInvalidSession),
+			Data: []byte(test.resumable),
+		})
+		if err != ErrReconnectPlease {
+			t.Errorf("%s: expected ErrReconnectPlease, got %v", test.name, err)
+		}
+
+		if resumable := s.canResume(); resumable != test.expected {
+			t.Errorf("%s: expected the shard to resume next to be %t, got %t", test.name, test.expected, resumable)
+		}
+		if !test.expected && (s.resumeGatewayURL != "" || s.resuming) {
+			t.Errorf("%s: expected the session to be cleared so the shard identifies", test.name)
+		}
+	}
+}
@@ -1,27 +1,637 @@
 package gateway
 
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrStateNotFound is returned when the requested object is not present
+// in the state
+var ErrStateNotFound = errors.New("object is not present in the state")
+
+// The different types of objects stored in the state
+const (
+	StateGuild   = "guild"
+	StateChannel = "channel"
+	StateUser    = "user"
+	StateMember  = "member"
+	StateRole    = "role"
+	StateEmoji   = "emoji"
+
+	StateVoiceState = "voicestate"
+	StatePresence   = "presence"
+)
+
+// CacheStat is the ammount of hits and misses when retrieving an object
+// type from the state
+type CacheStat struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// cacheStats stores the CacheStat of each object type. The map is never
+// modified after it has been made so it is safe to read concurrently.
+type cacheStats map[string]*CacheStat
+
+func newCacheStats() cacheStats {
+	return cacheStats{
+		StateGuild:   &CacheStat{},
+		StateChannel: &CacheStat{},
+		StateUser:    &CacheStat{},
+		StateMember:  &CacheStat{},
+		StateRole:    &CacheStat{},
+		StateEmoji:   &CacheStat{},
+
+		StateVoiceState: &CacheStat{},
+		StatePresence:   &CacheStat{},
+	}
+}
+
+func (cs cacheStats) hit(entity string) {
+	atomic.AddInt64(&cs[entity].Hits, 1)
+}
+
+func (cs cacheStats) miss(entity string) {
+	atomic.AddInt64(&cs[entity].Misses, 1)
+}
+
+// CacheStats returns the ammount of hits and misses of each object type
+// in the state. A high ammount of misses can show that events are often
+// being marshaled without the objects they reference.
+func (m *Manager) CacheStats() (stats map[string]CacheStat) {
+	stats = make(map[string]CacheStat)
+	for entity, stat := range m.cacheStats {
+		stats[entity] = CacheStat{
+			Hits:   atomic.LoadInt64(&stat.Hits),
+			Misses: atomic.LoadInt64(&stat.Misses),
+		}
+	}
+	return
+}
+
+// getState retrieves a field from a hash in the state and unmarshals it
+// into v, recording if it was a hit or miss.
+func (m *Manager) getState(entity string, key string, field string, v interface{}) (err error) {
+	res, err := m.RedisClient.HGet(m.ctx, key, field).Result()
+	if err != nil {
+		if err == redis.Nil {
+			m.cacheStats.miss(entity)
+			err = ErrStateNotFound
+		}
+		return
+	}
+
+	m.cacheStats.hit(entity)
+	err = json.UnmarshalFromString(res, v)
+	return
+}
+
+// getGuild returns the cached guild. The MemberCount is kept separately
+// so it can be updated atomically and is added to the guild.
+func (m *Manager) getGuild(guildID snowflake.ID) (guild *events.Guild, err error) {
+	guild = &events.Guild{}
+	err = m.getState(
+		StateGuild,
+		m.keys().Guilds(),
+		guildID.String(),
+		guild,
+	)
+	if err != nil {
+		return
+	}
+
+	memberCount, err := m.RedisClient.HGet(m.ctx, m.keys().MemberCounts(), guildID.String()).Int()
+	if err == redis.Nil {
+		return guild, nil
+	}
+
+	guild.MemberCount = memberCount
+	return
+}
+
+// setMemberCount stores the MemberCount of a guild
+func (m *Manager) setMemberCount(guildID snowflake.ID, memberCount int) (err error) {
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		pipe.HSet(m.ctx, m.keys().MemberCounts(), guildID.String(), memberCount)
+	})
+}
+
+// addMemberCountScript adds to the MemberCount of a guild only if it is
+// already stored so guilds that are not cached are not given a count of
+// 1 or -1. KEYS is the membercounts hash. ARGV is the guild id and the
+// delta.
+var addMemberCountScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then return 0 end
+return redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])`)
+
+// addMemberCount atomically adds delta to the MemberCount of a guild if
+// it is cached
+func (m *Manager) addMemberCount(guildID snowflake.ID, delta int64) (err error) {
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		// Eval is used as EvalSha can not fall back to Eval in a pipeline
+		addMemberCountScript.Eval(m.ctx, pipe,
+			[]string{m.keys().MemberCounts()},
+			guildID.String(), delta,
+		)
+	})
+}
+
+// getChannel returns the cached channel
+func (m *Manager) getChannel(channelID snowflake.ID) (channel *events.Channel, err error) {
+	channel = &events.Channel{}
+	err = m.getState(
+		StateChannel,
+		m.keys().Channels(),
+		channelID.String(),
+		channel,
+	)
+	return
+}
+
+// getUser returns the cached user
+func (m *Manager) getUser(userID snowflake.ID) (user *events.User, err error) {
+	user = &events.User{}
+	err = m.getState(
+		StateUser,
+		m.keys().Users(),
+		userID.String(),
+		user,
+	)
+	return
+}
+
+// getMember returns the cached member of a guild. If MemberLRUSize is
+// set, members that are not cached are fetched from the API and cached.
+// If the member could not be fetched, ErrStateNotFound is still returned.
+// As this can wait on the API, marshalers use lookupMember instead.
+func (m *Manager) getMember(guildID snowflake.ID, userID snowflake.ID) (member *events.GuildMember, err error) {
+	member, err = m.lookupMember(guildID, userID)
+	if err != ErrStateNotFound || m.Features.MemberLRUSize <= 0 {
+		return
+	}
+
+	member, err = m.Client.GetGuildMember(guildID, userID)
+	if err != nil || member.User == nil {
+		m.log.Debug().Str("guild", guildID.String()).Str("user", userID.String()).Err(err).
+			Msg("Failed to fetch member that is not cached")
+		return nil, ErrStateNotFound
+	}
+
+	err = m.setMember(guildID, member)
+	return
+}
+
+// lookupMember returns the cached member of a guild without fetching it
+// if it is not cached
+func (m *Manager) lookupMember(guildID snowflake.ID, userID snowflake.ID) (member *events.GuildMember, err error) {
+	member = &events.GuildMember{}
+	err = m.getState(
+		StateMember,
+		m.keys().Members(guildID),
+		userID.String(),
+		member,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.touchMember(guildID, userID)
+	return
+}
+
+// setEmojis stores the emojis of a guild and removes the emojis in
+// removed in a single pipeline
+func (m *Manager) setEmojis(emojis []*events.Emoji, removed []*events.Emoji) (err error) {
+	values := make(map[string]interface{}, len(emojis))
+	for _, emoji := range emojis {
+		if values[emoji.ID.String()], err = json.Marshal(emoji); err != nil {
+			return
+		}
+	}
+
+	removedIDs := make([]string, 0, len(removed))
+	for _, emoji := range removed {
+		removedIDs = append(removedIDs, emoji.ID.String())
+	}
+
+	key := m.keys().Emojis()
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		if len(values) > 0 {
+			pipe.HSet(m.ctx, key, values)
+		}
+		if len(removedIDs) > 0 {
+			pipe.HDel(m.ctx, key, removedIDs...)
+		}
+	})
+}
+
+// deleteMember removes the member of a guild from the state along with
+// the guild from their mutuals. If StoreMutuals is enabled, users that
+// no longer share a guild with the bot are also removed. As mutuals are
+// not stored for bots, bots are kept as they may still be in other
+// guilds.
+func (m *Manager) deleteMember(guildID snowflake.ID, user *events.User) (err error) {
+	keys := m.keys()
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		pipe.HDel(m.ctx, keys.Members(guildID), user.ID.String())
+		if m.Features.MemberLRUSize > 0 {
+			pipe.ZRem(m.ctx, keys.MemberLRU(), memberLRUEntry(guildID, user.ID))
+		}
+		if m.Features.StoreMutuals && !user.Bot {
+			// Eval is used as EvalSha can not fall back to Eval in a pipeline
+			removeMutualsScript.Eval(m.ctx, pipe,
+				[]string{keys.Users(), keys.UserMutual(user.ID)},
+				guildID.String(), user.ID.String(),
+			)
+		}
+	})
+}
+
+// setMembersChunk stores the members and users of a GUILD_MEMBERS_CHUNK,
+// its presences if CachePresences is enabled and the mutuals of the
+// users if StoreMutuals is enabled. Everything is written in a single
+// pipeline as large guilds can send hundreds of chunks. If MemberLRUSize
+// is set, the least recently used members are evicted afterwards.
+func (m *Manager) setMembersChunk(chunk *events.GuildMembersChunk) (err error) {
+	members := make(map[string]interface{}, len(chunk.Members))
+	users := make(map[string]interface{}, len(chunk.Members))
+	userIDs := make([]snowflake.ID, 0, len(chunk.Members))
+	mutuals := make([]snowflake.ID, 0, len(chunk.Members))
+
+	for _, member := range chunk.Members {
+		if member.User == nil {
+			continue
+		}
+
+		userID := member.User.ID.String()
+		if members[userID], err = json.Marshal(member); err != nil {
+			return
+		}
+		if users[userID], err = json.Marshal(member.User); err != nil {
+			return
+		}
+		userIDs = append(userIDs, member.User.ID)
+
+		if m.Features.StoreMutuals && !member.User.Bot {
+			mutuals = append(mutuals, member.User.ID)
+		}
+	}
+
+	presences := make(map[string]interface{}, len(chunk.Presences))
+	if m.Features.CachePresences {
+		for _, presence := range chunk.Presences {
+			if presence.User == nil {
+				continue
+			}
+
+			if presences[presence.User.ID.String()], err = json.Marshal(presence); err != nil {
+				return
+			}
+		}
+	}
+
+	err = m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		if len(members) > 0 {
+			pipe.HSet(m.ctx, m.keys().Members(chunk.GuildID), members)
+			m.expire(pipe, m.keys().Members(chunk.GuildID))
+			pipe.HSet(m.ctx, m.keys().Users(), users)
+			m.touchMembers(pipe, chunk.GuildID, userIDs...)
+		}
+		if len(presences) > 0 {
+			pipe.HSet(m.ctx, m.keys().Presences(chunk.GuildID), presences)
+			m.expire(pipe, m.keys().Presences(chunk.GuildID))
+		}
+		for _, userID := range mutuals {
+			pipe.SAdd(m.ctx, m.keys().UserMutual(userID), chunk.GuildID.String())
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	return m.evictMembers()
+}
+
+// defaultSearchLimit is how many members SearchGuildMembers returns if
+// no limit is given
+const defaultSearchLimit = 100
+
+// SearchGuildMembers returns at most limit cached members of a guild
+// whose username or nick starts with query, ignoring case. The members
+// are scanned in batches so the entire hash is not loaded at once. This
+// requires CacheMembers. If limit is 0 or less, at most 100 members are
+// returned.
+func (m *Manager) SearchGuildMembers(guildID snowflake.ID, query string, limit int) (members []*events.GuildMember, err error) {
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	key := m.keys().Members(guildID)
+	query = strings.ToLower(query)
+	members = make([]*events.GuildMember, 0)
+
+	iter := m.RedisClient.HScan(m.ctx, key, 0, "", int64(limit)).Iterator()
+	for iter.Next(m.ctx) {
+		// HSCAN returns the field followed by the value so we skip the
+		// user ids.
+		if !iter.Next(m.ctx) {
+			break
+		}
+
+		member := &events.GuildMember{}
+		if err = json.UnmarshalFromString(iter.Val(), member); err != nil {
+			return
+		}
+
+		if !memberMatches(member, query) {
+			continue
+		}
+
+		members = append(members, member)
+		if len(members) >= limit {
+			break
+		}
+	}
+
+	if err = iter.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// memberMatches returns true if the username or nick of a member starts
+// with the lowercase query
+func memberMatches(member *events.GuildMember, query string) bool {
+	if member.User != nil && strings.HasPrefix(strings.ToLower(member.User.Username), query) {
+		return true
+	}
+	return member.Nick != "" && strings.HasPrefix(strings.ToLower(member.Nick), query)
+}
+
+// getRole returns the cached role of a guild
+func (m *Manager) getRole(guildID snowflake.ID, roleID snowflake.ID) (role *events.Role, err error) {
+	role = &events.Role{}
+	err = m.getState(
+		StateRole,
+		m.keys().Roles(guildID),
+		roleID.String(),
+		role,
+	)
+	return
+}
+
+// getEmoji returns the cached emoji
+func (m *Manager) getEmoji(emojiID snowflake.ID) (emoji *events.Emoji, err error) {
+	emoji = &events.Emoji{}
+	err = m.getState(
+		StateEmoji,
+		m.keys().Emojis(),
+		emojiID.String(),
+		emoji,
+	)
+	return
+}
+
+// getVoiceState returns the cached voice state of a user in a guild
+func (m *Manager) getVoiceState(guildID snowflake.ID, userID snowflake.ID) (voiceState *events.VoiceState, err error) {
+	voiceState = &events.VoiceState{}
+	err = m.getState(
+		StateVoiceState,
+		m.keys().VoiceStates(guildID),
+		userID.String(),
+		voiceState,
+	)
+	return
+}
+
+// getPresence returns the cached presence of a user in a guild
+func (m *Manager) getPresence(guildID snowflake.ID, userID snowflake.ID) (presence *events.PresenceUpdate, err error) {
+	presence = &events.PresenceUpdate{}
+	err = m.getState(
+		StatePresence,
+		m.keys().Presences(guildID),
+		userID.String(),
+		presence,
+	)
+	return
+}
+
+// setChannel stores a channel in the state
+func (m *Manager) setChannel(channel *events.Channel) (err error) {
+	data, err := json.Marshal(channel)
+	if err != nil {
+		return
+	}
+
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		pipe.HSet(m.ctx, m.keys().Channels(), channel.ID.String(), data)
+	})
+}
+
+// setGuild stores a guild in the state
+func (m *Manager) setGuild(guild *events.Guild) (err error) {
+	data, err := json.Marshal(guild)
+	if err != nil {
+		return
+	}
+
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		pipe.HSet(m.ctx, m.keys().Guilds(), guild.ID, data)
+	})
+}
+
+// setRole stores the role of a guild in the state
+func (m *Manager) setRole(guildID snowflake.ID, role *events.Role) (err error) {
+	data, err := json.Marshal(role)
+	if err != nil {
+		return
+	}
+
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		pipe.HSet(m.ctx, m.keys().Roles(guildID), role.ID.String(), data)
+		m.expire(pipe, m.keys().Roles(guildID))
+	})
+}
+
+// setPresence stores the presence of a user in a guild. Presences of
+// users that are offline are removed as chunks only include the
+// presences of users that are not offline.
+func (m *Manager) setPresence(presence *events.PresenceUpdate) (err error) {
+	if presence.User == nil || presence.GuildID == 0 {
+		return
+	}
+
+	key := m.keys().Presences(presence.GuildID)
+	userID := presence.User.ID.String()
+
+	if presence.Status == events.PresenceStatusOffline {
+		return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+			pipe.HDel(m.ctx, key, userID)
+		})
+	}
+
+	data, err := json.Marshal(presence)
+	if err != nil {
+		return
+	}
+
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		pipe.HSet(m.ctx, key, userID, data)
+		m.expire(pipe, key)
+	})
+}
+
+// deleteRole removes the role of a guild from the state
+func (m *Manager) deleteRole(guildID snowflake.ID, roleID snowflake.ID) (err error) {
+	return m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		pipe.HDel(m.ctx, m.keys().Roles(guildID), roleID.String())
+	})
+}
+
+// setGuildRoles replaces the roles of a cached guild with the result of
+// update so the guild stays consistent with its roles hash. Nothing is
+// done if the guild is not cached.
+func (m *Manager) setGuildRoles(guildID snowflake.ID, update func(roles []*events.Role) []*events.Role) (err error) {
+	guild, err := m.getGuild(guildID)
+	if err == ErrStateNotFound {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	guild.Roles = update(guild.Roles)
+	return m.setGuild(guild)
+}
+
+// setMember stores the member of a guild and their user in the state
+// along with the guild in their mutuals if StoreMutuals is enabled and
+// they are not a bot. If MemberLRUSize is set, the least recently used
+// members are evicted.
+func (m *Manager) setMember(guildID snowflake.ID, member *events.GuildMember) (err error) {
+	data, err := json.Marshal(member)
+	if err != nil {
+		return
+	}
+
+	user, err := json.Marshal(member.User)
+	if err != nil {
+		return
+	}
+
+	keys := m.keys()
+	err = m.RedisClient.CriticalWrite(m.ctx, func(pipe redis.Pipeliner) {
+		pipe.HSet(m.ctx, keys.Members(guildID), member.User.ID.String(), data)
+		m.expire(pipe, keys.Members(guildID))
+		pipe.HSet(m.ctx, keys.Users(), member.User.ID.String(), user)
+		if m.Features.StoreMutuals && !member.User.Bot {
+			pipe.SAdd(m.ctx, keys.UserMutual(member.User.ID), guildID.String())
+		}
+		m.touchMembers(pipe, guildID, member.User.ID)
+	})
+	if err != nil {
+		return
+	}
+
+	return m.evictMembers()
+}
+
+// memberLRUEntry is how a member is stored in the MemberLRU sorted set
+func memberLRUEntry(guildID snowflake.ID, userID snowflake.ID) string {
+	return guildID.String() + ":" + userID.String()
+}
+
+// touchMember marks the member as recently used if MemberLRUSize is set.
+// Failing to do so only makes the member more likely to be evicted so
+// the error is only logged.
+func (m *Manager) touchMember(guildID snowflake.ID, userID snowflake.ID) {
+	if m.Features.MemberLRUSize <= 0 {
+		return
+	}
+
+	err := m.RedisClient.ZAdd(m.ctx, m.keys().MemberLRU(), &redis.Z{
+		Score:  float64(time.Now().UnixNano()),
+		Member: memberLRUEntry(guildID, userID),
+	}).Err()
+	if err != nil {
+		m.log.Debug().Err(err).Msg("Failed to mark member as recently used")
+	}
+}
+
+// touchMembers queues marking the members as recently used in the
+// pipeline if MemberLRUSize is set. Every member that is stored must be
+// touched or it will never be evicted.
+func (m *Manager) touchMembers(pipe redis.Pipeliner, guildID snowflake.ID, userIDs ...snowflake.ID) {
+	if m.Features.MemberLRUSize <= 0 || len(userIDs) == 0 {
+		return
+	}
+
+	score := float64(time.Now().UnixNano())
+	entries := make([]*redis.Z, 0, len(userIDs))
+	for _, userID := range userIDs {
+		entries = append(entries, &redis.Z{
+			Score:  score,
+			Member: memberLRUEntry(guildID, userID),
+		})
+	}
+	pipe.ZAdd(m.ctx, m.keys().MemberLRU(), entries...)
+}
+
+// evictMembers removes the least recently used members once there are
+// more than MemberLRUSize
+func (m *Manager) evictMembers() (err error) {
+	if m.Features.MemberLRUSize <= 0 {
+		return
+	}
+
+	keys := m.keys()
+	size, err := m.RedisClient.ZCard(m.ctx, keys.MemberLRU()).Result()
+	if err != nil || size <= int64(m.Features.MemberLRUSize) {
+		return
+	}
+
+	evicted, err := m.RedisClient.ZPopMin(m.ctx, keys.MemberLRU(), size-int64(m.Features.MemberLRUSize)).Result()
+	if err != nil {
+		return
+	}
+
+	_, err = m.RedisClient.Pipelined(m.ctx, func(pipe redis.Pipeliner) error {
+		for _, z := range evicted {
+			entry, _ := z.Member.(string)
+			separator := strings.IndexByte(entry, ':')
+			if separator == -1 {
+				continue
+			}
+
+			guildID, err := snowflake.ParseString(entry[:separator])
+			if err != nil {
+				continue
+			}
+			pipe.HDel(m.ctx, keys.Members(guildID), entry[separator+1:])
+		}
+		return nil
+	})
+	return
+}
+
 // RediScripts contains all the custom redis scripts
 type RediScripts struct{}
 
 // ClearKeys allows for you to clear redis keys based off of a pattern.
-// We really should not be doing it this way. It really should be
-// scanning keys, finding guilds that would belong to this cluster
-// through normal shardID bitwise calculations, iterating through
-// guild members, removing their mutual and if it is empty, remove
-// their user object, remove the guild members reguardless and lastly
-// delete the emoji fields, role fields, channel fields and the guild
-// entry. It could be possible to add an expiry on the objects
-// themself but that would require to constantly update the expiry on
-// objects as it could be that it expires too early so would need
-// to renew it more often or too long that it never is removed.
-// Reguardless, either way would require another routine to keep
-// all entries constantly refreshed.
+// This removes every matching key including those of other clusters
+// sharing the prefix so should only be used to wipe the entire state.
+// Use ClearOwnedCache to only clear the guilds of this cluster.
 func (*RediScripts) ClearKeys(pattern string, m *Manager) (result int64, err error) {
 	if _result, err := m.RedisClient.Eval(
 		m.ctx,
 		`local count, cursor = 0, "0"
 		while true do
-			local req = redis.call("SCAN", cursor, "MATCH", ARGV[1], "COUNT", ARGV[2], "TYPE", "string")
+			local req = redis.call("SCAN", cursor, "MATCH", ARGV[1], "COUNT", ARGV[2])
 			if #req[2] > 0 then redis.call("DEL", unpack(req[2])) end
 			count, cursor = count + #req[2], req[1]
 			if cursor == "0" then break end
@@ -0,0 +1,477 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/TheRockettek/Sandwich-Producer/client"
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+	"github.com/go-redis/redis/v8"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// testMembers returns members with the userIDs
+func testMembers(userIDs ...snowflake.ID) (members []*events.GuildMember) {
+	for _, userID := range userIDs {
+		members = append(members, &events.GuildMember{User: &events.User{ID: userID}})
+	}
+	return
+}
+
+func TestMembersChunkMemberLRU(t *testing.T) {
+	m, _ := testRedisManager(t)
+	m.Features.MemberLRUSize = 2
+
+	err := m.setMembersChunk(&events.GuildMembersChunk{
+		GuildID: snowflake.ID(1),
+		Members: testMembers(2, 3, 4),
+	})
+	if err != nil {
+		t.Fatalf("failed to set members chunk: %v", err)
+	}
+
+	if size := m.RedisClient.ZCard(m.ctx, m.keys().MemberLRU()).Val(); size != 2 {
+		t.Errorf("expected 2 members to be tracked, got %d", size)
+	}
+	if members := m.RedisClient.HLen(m.ctx, m.keys().Members(snowflake.ID(1))).Val(); members != 2 {
+		t.Errorf("expected the members over MemberLRUSize to be evicted, %d cached", members)
+	}
+
+	// Members added one at a time share the same LRU
+	if err = m.setMember(snowflake.ID(5), testMembers(6)[0]); err != nil {
+		t.Fatalf("failed to set member: %v", err)
+	}
+	if _, err = m.lookupMember(snowflake.ID(5), snowflake.ID(6)); err != nil {
+		t.Errorf("expected the newest member to be cached: %v", err)
+	}
+	if size := m.RedisClient.ZCard(m.ctx, m.keys().MemberLRU()).Val(); size != 2 {
+		t.Errorf("expected 2 members to be tracked, got %d", size)
+	}
+}
+
+func TestMembersChunkWithoutMemberLRU(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	err := m.setMembersChunk(&events.GuildMembersChunk{
+		GuildID: snowflake.ID(1),
+		Members: testMembers(2, 3, 4),
+	})
+	if err != nil {
+		t.Fatalf("failed to set members chunk: %v", err)
+	}
+
+	if exists := m.RedisClient.Exists(m.ctx, m.keys().MemberLRU()).Val(); exists != 0 {
+		t.Error("expected members to not be tracked without MemberLRUSize")
+	}
+	if members := m.RedisClient.HLen(m.ctx, m.keys().Members(snowflake.ID(1))).Val(); members != 3 {
+		t.Errorf("expected every member to be cached, %d cached", members)
+	}
+}
+
+func TestGetMemberFetchesMissingMembers(t *testing.T) {
+	m, _ := testRedisManager(t)
+	m.Features.MemberLRUSize = 10
+	testAPI(t, m, map[string]string{
+		"/api/v6/guilds/1/members/2": `{"user":{"id":"2","username":"a"},"roles":[]}`,
+	})
+
+	member, err := m.getMember(snowflake.ID(1), snowflake.ID(2))
+	if err != nil {
+		t.Fatalf("expected the member to be fetched: %v", err)
+	}
+	if member.User.Username != "a" {
+		t.Errorf("unexpected member %+v", member.User)
+	}
+	if _, err = m.lookupMember(snowflake.ID(1), snowflake.ID(2)); err != nil {
+		t.Errorf("expected the fetched member to be cached: %v", err)
+	}
+}
+
+func TestTypingStartDoesNotFetchMembers(t *testing.T) {
+	m, _ := testRedisManager(t)
+	m.Features.MemberLRUSize = 10
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s whilst marshaling", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	m.Client = client.NewClient("token")
+	m.Client.HTTP = server.Client()
+	m.Client.URLHost = server.Listener.Addr().String()
+	m.Client.URLScheme = "http"
+
+	ok, se, err := typingStartMarshaler(m, Event{
+		Type: "TYPING_START",
+		Data: jsoniter.RawMessage(`{"guild_id":"1","channel_id":"3","user_id":"2","timestamp":1}`),
+	})
+	if !ok || err != nil {
+		t.Fatalf("expected TYPING_START to be produced, got %t %v", ok, err)
+	}
+	if typingStart := se.Data.(*events.TypingStart); typingStart.Member != nil {
+		t.Errorf("expected no member, got %+v", typingStart.Member)
+	}
+}
+
+func TestMemberCountJoinsAndLeaves(t *testing.T) {
+	m, _ := testRedisManager(t)
+	if err := m.setMemberCount(snowflake.ID(1), 0); err != nil {
+		t.Fatalf("failed to set member count: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		_, _, err := guildMemberAddMarshaler(m, Event{
+			Type: "GUILD_MEMBER_ADD",
+			Data: jsoniter.RawMessage(fmt.Sprintf(`{"guild_id":"1","user":{"id":"%d"},"roles":[]}`, i+2)),
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal GUILD_MEMBER_ADD: %v", err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		_, _, err := guildMemberRemoveMarshaler(m, Event{
+			Type: "GUILD_MEMBER_REMOVE",
+			Data: jsoniter.RawMessage(fmt.Sprintf(`{"guild_id":"1","user":{"id":"%d"}}`, i+2)),
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal GUILD_MEMBER_REMOVE: %v", err)
+		}
+	}
+
+	count, err := m.RedisClient.HGet(m.ctx, m.keys().MemberCounts(), "1").Int()
+	if err != nil {
+		t.Fatalf("failed to get member count: %v", err)
+	}
+	if count != 60 {
+		t.Errorf("expected a member count of 60, got %d", count)
+	}
+}
+
+func TestMemberCountUncachedGuild(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	for _, delta := range []int64{1, -1} {
+		if err := m.addMemberCount(snowflake.ID(1), delta); err != nil {
+			t.Fatalf("failed to add %d to member count: %v", delta, err)
+		}
+		if exists := m.RedisClient.HExists(m.ctx, m.keys().MemberCounts(), "1").Val(); exists {
+			t.Fatalf("expected no member count to be stored for a guild that is not cached after adding %d", delta)
+		}
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	m, mr := testRedisManager(t)
+	keys := m.keys()
+
+	mr.HSet(keys.Channels(), "1", `{"id":"1","type":0}`)
+	mr.HSet(keys.Emojis(), "2", `{"id":"2","name":"a"}`)
+
+	m.getChannel(snowflake.ID(1))
+	m.getChannel(snowflake.ID(1))
+	m.getChannel(snowflake.ID(3))
+	m.getEmoji(snowflake.ID(2))
+	m.getUser(snowflake.ID(4))
+	m.getRole(snowflake.ID(5), snowflake.ID(6))
+
+	expected := map[string]CacheStat{
+		StateGuild:   {},
+		StateChannel: {Hits: 2, Misses: 1},
+		StateUser:    {Misses: 1},
+		StateMember:  {},
+		StateRole:    {Misses: 1},
+		StateEmoji:   {Hits: 1},
+
+		StateVoiceState: {},
+		StatePresence:   {},
+	}
+
+	stats := m.CacheStats()
+	if len(stats) != len(expected) {
+		t.Fatalf("expected stats for %d object types, got %v", len(expected), stats)
+	}
+	for entity, stat := range expected {
+		if stats[entity] != stat {
+			t.Errorf("expected %s to have %+v, got %+v", entity, stat, stats[entity])
+		}
+	}
+}
+
+func TestSearchGuildMembers(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	members := []*events.GuildMember{
+		{User: &events.User{ID: 2, Username: "Sandwich"}},
+		{User: &events.User{ID: 3, Username: "sandbox"}},
+		{User: &events.User{ID: 4, Username: "toast"}, Nick: "Sandy"},
+		{User: &events.User{ID: 5, Username: "bread"}, Nick: "not sand"},
+	}
+	err := m.setMembersChunk(&events.GuildMembersChunk{GuildID: snowflake.ID(1), Members: members})
+	if err != nil {
+		t.Fatalf("failed to set members chunk: %v", err)
+	}
+
+	tests := []struct {
+		query    string
+		expected []snowflake.ID
+	}{
+		{"sand", []snowflake.ID{2, 3, 4}},
+		{"SANDW", []snowflake.ID{2}},
+		{"toast", []snowflake.ID{4}},
+		{"pickle", []snowflake.ID{}},
+	}
+
+	for _, test := range tests {
+		found, err := m.SearchGuildMembers(snowflake.ID(1), test.query, 0)
+		if err != nil {
+			t.Fatalf("failed to search members: %v", err)
+		}
+
+		userIDs := make([]snowflake.ID, 0, len(found))
+		for _, member := range found {
+			userIDs = append(userIDs, member.User.ID)
+		}
+		sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+
+		if fmt.Sprint(userIDs) != fmt.Sprint(test.expected) {
+			t.Errorf("expected %q to match %v, got %v", test.query, test.expected, userIDs)
+		}
+	}
+
+	if found, _ := m.SearchGuildMembers(snowflake.ID(2), "sand", 0); len(found) != 0 {
+		t.Errorf("expected members of other guilds to not match, got %d", len(found))
+	}
+}
+
+func TestSearchGuildMembersLimit(t *testing.T) {
+	m, _ := testRedisManager(t)
+
+	members := make([]*events.GuildMember, 0, 150)
+	for i := 0; i < 150; i++ {
+		members = append(members, &events.GuildMember{User: &events.User{ID: snowflake.ID(i + 2), Username: fmt.Sprintf("user%d", i)}})
+	}
+	err := m.setMembersChunk(&events.GuildMembersChunk{GuildID: snowflake.ID(1), Members: members})
+	if err != nil {
+		t.Fatalf("failed to set members chunk: %v", err)
+	}
+
+	for limit, expected := range map[int]int{1: 1, 10: 10, 0: 100, -1: 100, 200: 150} {
+		found, err := m.SearchGuildMembers(snowflake.ID(1), "user", limit)
+		if err != nil {
+			t.Fatalf("failed to search members: %v", err)
+		}
+		if len(found) != expected {
+			t.Errorf("expected a limit of %d to return %d members, got %d", limit, expected, len(found))
+		}
+	}
+}
+
+// roundTrips is a redis hook that counts the requests made to redis. A
+// pipeline is a single round trip.
+type roundTrips int64
+
+func (rt *roundTrips) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	atomic.AddInt64((*int64)(rt), 1)
+	return ctx, nil
+}
+
+func (rt *roundTrips) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (rt *roundTrips) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	atomic.AddInt64((*int64)(rt), 1)
+	return ctx, nil
+}
+
+func (rt *roundTrips) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+// benchmarkMembers returns count synthetic members
+func benchmarkMembers(count int) (members []*events.GuildMember) {
+	members = make([]*events.GuildMember, 0, count)
+	for i := 0; i < count; i++ {
+		members = append(members, &events.GuildMember{
+			User:  &events.User{ID: snowflake.ID(i + 2), Username: fmt.Sprintf("user%d", i), Discriminator: "0001"},
+			Roles: []snowflake.ID{1},
+		})
+	}
+	return
+}
+
+func BenchmarkMembersChunk(b *testing.B) {
+	m, _ := testRedisManager(b)
+	m.Features.StoreMutuals = true
+	rt := new(roundTrips)
+	m.RedisClient.AddHook(rt)
+
+	chunk := &events.GuildMembersChunk{GuildID: snowflake.ID(1), Members: benchmarkMembers(10000)}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.setMembersChunk(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(*rt)/float64(b.N), "roundtrips/op")
+}
+
+// BenchmarkMembersChunkPerMember caches the same members one at a time to
+// compare against the pipelined BenchmarkMembersChunk
+func BenchmarkMembersChunkPerMember(b *testing.B) {
+	m, _ := testRedisManager(b)
+	m.Features.StoreMutuals = true
+	rt := new(roundTrips)
+	m.RedisClient.AddHook(rt)
+
+	members := benchmarkMembers(10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, member := range members {
+			if err := m.setMember(snowflake.ID(1), member); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(*rt)/float64(b.N), "roundtrips/op")
+}
+
+func TestUserRemovedAfterLeavingEveryGuild(t *testing.T) {
+	m, _ := testRedisManager(t)
+	m.Features.CacheMembers = true
+	m.Features.StoreMutuals = true
+	keys := m.keys()
+
+	for _, guildID := range []string{"1", "2"} {
+		_, _, err := guildMemberAddMarshaler(m, Event{Type: "GUILD_MEMBER_ADD", Data: jsoniter.RawMessage(`{
+			"guild_id":"` + guildID + `","roles":[],
+			"user":{"id":"4","username":"a","discriminator":"0001","avatar":""}
+		}`)})
+		if err != nil {
+			t.Fatalf("failed to add member to guild %s: %v", guildID, err)
+		}
+	}
+
+	if mutuals := m.RedisClient.SCard(m.ctx, keys.UserMutual(snowflake.ID(4))).Val(); mutuals != 2 {
+		t.Fatalf("expected the user to have 2 mutuals, got %d", mutuals)
+	}
+
+	remove := func(guildID string) {
+		_, _, err := guildMemberRemoveMarshaler(m, Event{Type: "GUILD_MEMBER_REMOVE", Data: jsoniter.RawMessage(`{
+			"guild_id":"` + guildID + `",
+			"user":{"id":"4","username":"a","discriminator":"0001","avatar":""}
+		}`)})
+		if err != nil {
+			t.Fatalf("failed to remove member from guild %s: %v", guildID, err)
+		}
+	}
+
+	remove("1")
+	if _, err := m.getUser(snowflake.ID(4)); err != nil {
+		t.Errorf("expected the user to be kept whilst they share a guild: %v", err)
+	}
+	if mutuals := m.RedisClient.SMembers(m.ctx, keys.UserMutual(snowflake.ID(4))).Val(); len(mutuals) != 1 || mutuals[0] != "2" {
+		t.Errorf("expected the user to only share guild 2, got %v", mutuals)
+	}
+
+	remove("2")
+	if _, err := m.getUser(snowflake.ID(4)); err != ErrStateNotFound {
+		t.Errorf("expected the user to be removed after leaving every guild, got %v", err)
+	}
+	if m.RedisClient.Exists(m.ctx, keys.UserMutual(snowflake.ID(4))).Val() != 0 {
+		t.Error("expected the mutuals of the user to be removed")
+	}
+}
+
+// commands is a redis hook that records the names of every command sent
+// to redis, including those in pipelines
+type commands struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (c *commands) record(cmds ...redis.Cmder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cmd := range cmds {
+		c.names = append(c.names, cmd.Name())
+	}
+}
+
+func (c *commands) count(name string) (n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, recorded := range c.names {
+		if recorded == name {
+			n++
+		}
+	}
+	return
+}
+
+func (c *commands) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	c.record(cmd)
+	return ctx, nil
+}
+
+func (c *commands) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (c *commands) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	c.record(cmds...)
+	return ctx, nil
+}
+
+func (c *commands) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+func TestStoreMutuals(t *testing.T) {
+	user := &events.User{ID: snowflake.ID(2), Username: "a"}
+	bot := &events.User{ID: snowflake.ID(3), Username: "b", Bot: true}
+
+	tests := []struct {
+		name         string
+		storeMutuals bool
+		user         *events.User
+		expected     int
+	}{
+		{"disabled", false, user, 0},
+		{"disabled bot", false, bot, 0},
+		{"enabled", true, user, 2},
+		{"enabled bot", true, bot, 0},
+	}
+
+	for _, test := range tests {
+		m, _ := testRedisManager(t)
+		m.Features.StoreMutuals = test.storeMutuals
+		recorded := new(commands)
+		m.RedisClient.AddHook(recorded)
+
+		member := &events.GuildMember{User: test.user}
+		if err := m.setMember(snowflake.ID(1), member); err != nil {
+			t.Fatalf("%s: failed to set member: %v", test.name, err)
+		}
+		err := m.setMembersChunk(&events.GuildMembersChunk{
+			GuildID: snowflake.ID(4),
+			Members: []*events.GuildMember{member},
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to set members chunk: %v", test.name, err)
+		}
+
+		if sadds := recorded.count("sadd"); sadds != test.expected {
+			t.Errorf("%s: expected %d SADD, got %d", test.name, test.expected, sadds)
+		}
+	}
+}
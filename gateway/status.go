@@ -0,0 +1,342 @@
+package gateway
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// ShardState represents the connection state of a Shard
+type ShardState int32
+
+// The states a Shard can be in
+const (
+	ShardStateIdle ShardState = iota
+	ShardStateConnecting
+	ShardStateConnected
+	ShardStateReconnecting
+	ShardStateClosed
+)
+
+func (ss ShardState) String() string {
+	switch ss {
+	case ShardStateIdle:
+		return "idle"
+	case ShardStateConnecting:
+		return "connecting"
+	case ShardStateConnected:
+		return "connected"
+	case ShardStateReconnecting:
+		return "reconnecting"
+	case ShardStateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalJSON marshals the ShardState as its name
+func (ss ShardState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ss.String())
+}
+
+// ShardStatus is a snapshot of the health of a Shard
+type ShardStatus struct {
+	ShardID  int           `json:"shard_id"`
+	Latency  time.Duration `json:"latency"`
+	State    ShardState    `json:"state"`
+	Sequence int64         `json:"sequence"`
+	Guilds   int           `json:"guilds"`
+
+	// IdentifyWait is how long the Shard last waited for the identify
+	// ratelimits before connecting
+	IdentifyWait time.Duration `json:"identify_wait"`
+}
+
+// Status returns the status of every Shard in the running ShardGroups
+func (m *Manager) Status() (statuses map[int]ShardStatus) {
+	statuses = make(map[int]ShardStatus)
+
+	m.ShardGroupsMu.Lock()
+	defer m.ShardGroupsMu.Unlock()
+
+	for _, sg := range m.ShardGroups {
+		sg.ShardsMu.Lock()
+		for shardID, shard := range sg.Shards {
+			statuses[shardID] = shard.Status()
+		}
+		sg.ShardsMu.Unlock()
+	}
+	return
+}
+
+// UnavailableGuilds returns the ids of guilds that are currently
+// unavailable across every Shard. This includes guilds that are still
+// lazy loading after READY.
+func (m *Manager) UnavailableGuilds() (guildIDs []string) {
+	guildIDs = make([]string, 0)
+
+	m.ShardGroupsMu.Lock()
+	defer m.ShardGroupsMu.Unlock()
+
+	for _, sg := range m.ShardGroups {
+		sg.ShardsMu.Lock()
+		for _, shard := range sg.Shards {
+			guildIDs = append(guildIDs, shard.UnavailableGuilds()...)
+		}
+		sg.ShardsMu.Unlock()
+	}
+	return
+}
+
+// UnavailableGuilds returns the ids of guilds the Shard has that are
+// currently unavailable
+func (s *Shard) UnavailableGuilds() (guildIDs []string) {
+	s.guildsMu.RLock()
+	defer s.guildsMu.RUnlock()
+
+	for guildID, available := range s.guilds {
+		if !available {
+			guildIDs = append(guildIDs, guildID.String())
+		}
+	}
+	return
+}
+
+// Status returns a snapshot of the health of the Shard
+func (s *Shard) Status() ShardStatus {
+	guilds := s.guildCount()
+
+	return ShardStatus{
+		ShardID:  s.ShardID,
+		Latency:  s.Latency(),
+		State:    s.State(),
+		Sequence: atomic.LoadInt64(s.seq),
+		Guilds:   guilds,
+
+		IdentifyWait: time.Duration(atomic.LoadInt64(&s.identifyWait)),
+	}
+}
+
+// guildCount returns how many guilds the Shard has
+func (s *Shard) guildCount() int {
+	s.guildsMu.RLock()
+	defer s.guildsMu.RUnlock()
+
+	return len(s.guilds)
+}
+
+// Latency returns the time between the last heartbeat being sent and
+// Discord acknowledging it. If the last heartbeat has not yet been
+// acknowledged, the time since it was sent is returned.
+func (s *Shard) Latency() time.Duration {
+	s.heartbeatMu.RLock()
+	defer s.heartbeatMu.RUnlock()
+
+	if s.LastHeartbeatAck.Before(s.LastHeartbeatSent) {
+		return time.Now().UTC().Sub(s.LastHeartbeatSent)
+	}
+	return s.LastHeartbeatAck.Sub(s.LastHeartbeatSent)
+}
+
+// State returns the connection state of the Shard
+func (s *Shard) State() ShardState {
+	return ShardState(atomic.LoadInt32(&s.state))
+}
+
+func (s *Shard) setState(state ShardState) {
+	atomic.StoreInt32(&s.state, int32(state))
+}
+
+// guildCreateType is why a GUILD_CREATE was received
+type guildCreateType int
+
+// The reasons a GUILD_CREATE can be received. The type is decided by
+// the guilds the Shard knows of when it is received:
+//
+//	sent in READY and not yet received      guildCreateLoad
+//	became unavailable after being received guildCreateAvailable
+//	still lazy loading after the timeout    guildCreateAvailable
+//	not known by the Shard                  guildCreateJoin
+//	already received and available          guildCreateLoad
+const (
+	guildCreateLoad guildCreateType = iota
+	guildCreateAvailable
+	guildCreateJoin
+)
+
+// trackGuilds keeps track of the guilds the Shard has from READY,
+// GUILD_CREATE and GUILD_DELETE. Guilds are stored with if they are
+// currently available. created is why a GUILD_CREATE was received and
+// loaded is true once every guild sent in READY has been received.
+func (s *Shard) trackGuilds(eventType string, data jsoniter.RawMessage) (created guildCreateType, loaded bool) {
+	switch eventType {
+	case "READY":
+		guilds := json.Get(data, "guilds")
+
+		s.guildsMu.Lock()
+		s.guilds = make(map[snowflake.ID]bool, guilds.Size())
+		s.outages = make(map[snowflake.ID]void)
+		s.loading = make(map[snowflake.ID]void, guilds.Size())
+		for i := 0; i < guilds.Size(); i++ {
+			if guildID, err := snowflake.ParseString(guilds.Get(i, "id").ToString()); err == nil {
+				s.guilds[guildID] = false
+				s.loading[guildID] = void{}
+			}
+		}
+		s.expected = len(s.loading)
+		loaded = s.expected == 0
+		if !loaded {
+			s.resetLoadTimer()
+		}
+		s.guildsMu.Unlock()
+	case "GUILD_CREATE":
+		guildID, err := snowflake.ParseString(json.Get(data, "id").ToString())
+		if err != nil {
+			return
+		}
+
+		s.guildsMu.Lock()
+		_, known := s.guilds[guildID]
+		_, outage := s.outages[guildID]
+		switch {
+		case outage:
+			created = guildCreateAvailable
+			delete(s.outages, guildID)
+		case !known:
+			created = guildCreateJoin
+		}
+
+		s.guilds[guildID] = true
+		loaded = s.loaded(guildID)
+		s.guildsMu.Unlock()
+	case "GUILD_DELETE":
+		guildID, err := snowflake.ParseString(json.Get(data, "id").ToString())
+		if err != nil {
+			return
+		}
+
+		// If unavailable is not present, the bot was removed from the guild
+		s.guildsMu.Lock()
+		if json.Get(data, "unavailable").ToBool() {
+			if s.guilds[guildID] {
+				s.outages[guildID] = void{}
+			}
+			s.guilds[guildID] = false
+		} else {
+			delete(s.guilds, guildID)
+			delete(s.outages, guildID)
+			loaded = s.loaded(guildID)
+		}
+		s.guildsMu.Unlock()
+	}
+	return
+}
+
+// loaded removes a guild from the guilds that are still lazy loading
+// and returns true if it was the last one. guildsMu must be held.
+func (s *Shard) loaded(guildID snowflake.ID) bool {
+	if _, ok := s.loading[guildID]; !ok {
+		return false
+	}
+
+	delete(s.loading, guildID)
+	if len(s.loading) > 0 {
+		s.resetLoadTimer()
+		return false
+	}
+
+	s.loadTimer.Stop()
+	return true
+}
+
+// resetLoadTimer restarts the GuildLoadTimeout as a guild has been
+// received. guildsMu must be held.
+func (s *Shard) resetLoadTimer() {
+	timeout := time.Duration(s.Manager.Configuration.GuildLoadTimeout) * time.Second
+	if s.loadTimer == nil {
+		s.loadTimer = time.AfterFunc(timeout, s.loadTimedOut)
+		return
+	}
+	s.loadTimer.Reset(timeout)
+}
+
+// loadTimedOut produces SHARD_READY if guilds are still lazy loading
+// once GuildLoadTimeout has passed without receiving any. Guilds that
+// stay unavailable would otherwise stop SHARD_READY from being produced.
+func (s *Shard) loadTimedOut() {
+	s.guildsMu.Lock()
+	if len(s.loading) == 0 {
+		s.guildsMu.Unlock()
+		return
+	}
+
+	s.Manager.log.Warn().Int("shard", s.ShardID).Int("unavailable", len(s.loading)).
+		Msg("Timed out waiting for guilds to load")
+
+	// The event is built before loading is cleared so it includes the
+	// guilds that did not load. As SHARD_READY has been produced without
+	// them, they are treated as unavailable so they are produced as
+	// GUILD_AVAILABLE once received.
+	event := s.shardReadyEvent()
+	for guildID := range s.loading {
+		s.outages[guildID] = void{}
+	}
+	s.loading = make(map[snowflake.ID]void)
+	s.guildsMu.Unlock()
+
+	s.produceReady(event)
+}
+
+// produceReady produces SHARD_READY and counts the Shard as loaded in its
+// ShardGroup
+func (s *Shard) produceReady(event ShardReadyEvent) {
+	s.Manager.produceShardEvent("SHARD_READY", event)
+
+	if s.ShardGroup != nil {
+		s.ShardGroup.shardLoaded(s.ShardID)
+	}
+}
+
+// stopLoadTimer stops the GuildLoadTimeout whilst the Shard is not
+// connected so SHARD_READY is not produced whilst it is reconnecting
+func (s *Shard) stopLoadTimer() {
+	s.guildsMu.Lock()
+	defer s.guildsMu.Unlock()
+
+	if s.loadTimer != nil {
+		s.loadTimer.Stop()
+	}
+}
+
+// restartLoadTimer starts the GuildLoadTimeout again once the Shard has
+// resumed if guilds are still lazy loading
+func (s *Shard) restartLoadTimer() {
+	s.guildsMu.Lock()
+	defer s.guildsMu.Unlock()
+
+	if len(s.loading) > 0 {
+		s.resetLoadTimer()
+	}
+}
+
+// readyEvent returns the SHARD_READY of the Shard
+func (s *Shard) readyEvent() ShardReadyEvent {
+	s.guildsMu.RLock()
+	defer s.guildsMu.RUnlock()
+
+	return s.shardReadyEvent()
+}
+
+// shardReadyEvent returns the SHARD_READY of the Shard. guildsMu must be
+// held.
+func (s *Shard) shardReadyEvent() ShardReadyEvent {
+	return ShardReadyEvent{
+		ShardID:  s.ShardID,
+		Guilds:   len(s.guilds),
+		Expected: s.expected,
+		Loaded:   s.expected - len(s.loading),
+	}
+}
@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// produced returns the next event queued to be produced
+func produced(t *testing.T, m *Manager) StreamEvent {
+	select {
+	case se := <-m.produceChannel:
+		return se
+	default:
+		t.Fatal("expected an event to have been produced")
+		return StreamEvent{}
+	}
+}
+
+func TestLoadTimedOutReadyEvent(t *testing.T) {
+	m := testManager()
+	s := &Shard{Manager: m, ShardID: 2}
+
+	s.trackGuilds("READY", jsoniter.RawMessage(`{"guilds":[{"id":"1"},{"id":"2"},{"id":"3"}]}`))
+	s.trackGuilds("GUILD_CREATE", jsoniter.RawMessage(`{"id":"1"}`))
+	s.loadTimedOut()
+
+	ready, ok := produced(t, m).Data.(ShardReadyEvent)
+	if !ok {
+		t.Fatal("expected SHARD_READY to be produced")
+	}
+
+	// The guilds that did not load must still be counted
+	if ready.ShardID != 2 || ready.Expected != 3 || ready.Loaded != 1 || ready.Guilds != 3 {
+		t.Errorf("unexpected SHARD_READY %+v", ready)
+	}
+
+	// Once timed out, SHARD_READY is not produced again
+	s.loadTimedOut()
+	if len(m.produceChannel) != 0 {
+		t.Error("expected SHARD_READY to only be produced once")
+	}
+	s.loadTimer.Stop()
+}
+
+func TestWaitForReadyAfterEveryShardReady(t *testing.T) {
+	m, _ := testRedisManager(t)
+	sg, err := NewShardGroup(m, []int{0, 1}, 2)
+	if err != nil {
+		t.Fatalf("failed to create ShardGroup: %v", err)
+	}
+
+	first := &Shard{Manager: m, ShardGroup: sg, ShardID: 0}
+	second := &Shard{Manager: m, ShardGroup: sg, ShardID: 1}
+
+	// Receiving READY is not enough whilst guilds are still loading
+	first.trackGuilds("READY", jsoniter.RawMessage(`{"guilds":[{"id":"1"}]}`))
+	second.trackGuilds("READY", jsoniter.RawMessage(`{"guilds":[{"id":"2"}]}`))
+	defer first.loadTimer.Stop()
+	defer second.loadTimer.Stop()
+
+	blocked := func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		return m.WaitForReady(ctx) == context.DeadlineExceeded
+	}
+	if !blocked() {
+		t.Fatal("expected WaitForReady to block until SHARD_READY")
+	}
+
+	// The same Shard producing SHARD_READY again is only counted once
+	first.loadTimedOut()
+	first.produceReady(first.readyEvent())
+	if !blocked() {
+		t.Fatal("expected WaitForReady to block until every Shard produced SHARD_READY")
+	}
+
+	created, loaded := second.trackGuilds("GUILD_CREATE", jsoniter.RawMessage(`{"id":"2"}`))
+	forward(m, Event{Type: "GUILD_CREATE", Data: jsoniter.RawMessage(`{"id":"2"}`),
+		shard: second, created: created, loaded: loaded})
+	if blocked() {
+		t.Error("expected WaitForReady to return once every Shard produced SHARD_READY")
+	}
+}
+
+func TestLoadTimerStoppedOnClose(t *testing.T) {
+	m := testManager()
+	s := &Shard{Manager: m}
+
+	s.trackGuilds("READY", jsoniter.RawMessage(`{"guilds":[{"id":"1"}]}`))
+	s.Close(4000)
+
+	if s.loadTimer.Stop() {
+		t.Error("expected the load timer to be stopped when the Shard is closed")
+	}
+
+	// Guilds are still loading once resumed so the timer starts again
+	s.restartLoadTimer()
+	if !s.loadTimer.Stop() {
+		t.Error("expected the load timer to restart once resumed")
+	}
+}
+
+func TestTrackGuildsCreated(t *testing.T) {
+	ready := jsoniter.RawMessage(`{"guilds":[{"id":"1"},{"id":"2"}]}`)
+	create := func(guildID string) jsoniter.RawMessage {
+		return jsoniter.RawMessage(`{"id":"` + guildID + `"}`)
+	}
+
+	tests := []struct {
+		name     string
+		before   func(s *Shard)
+		guildID  string
+		expected guildCreateType
+	}{
+		{
+			name:     "initial connect",
+			guildID:  "1",
+			expected: guildCreateLoad,
+		},
+		{
+			name: "resume with cached guild",
+			before: func(s *Shard) {
+				s.trackGuilds("GUILD_CREATE", create("1"))
+			},
+			guildID:  "1",
+			expected: guildCreateLoad,
+		},
+		{
+			name: "guild outage recovery",
+			before: func(s *Shard) {
+				s.trackGuilds("GUILD_CREATE", create("1"))
+				s.trackGuilds("GUILD_DELETE", jsoniter.RawMessage(`{"id":"1","unavailable":true}`))
+			},
+			guildID:  "1",
+			expected: guildCreateAvailable,
+		},
+		{
+			name:     "brand new invite",
+			guildID:  "3",
+			expected: guildCreateJoin,
+		},
+		{
+			name: "received after the load timeout",
+			before: func(s *Shard) {
+				s.trackGuilds("GUILD_CREATE", create("1"))
+				s.loadTimedOut()
+			},
+			guildID:  "2",
+			expected: guildCreateAvailable,
+		},
+	}
+
+	for _, test := range tests {
+		m := testManager()
+		s := &Shard{Manager: m}
+		s.trackGuilds("READY", ready)
+		if test.before != nil {
+			test.before(s)
+		}
+
+		if created, _ := s.trackGuilds("GUILD_CREATE", create(test.guildID)); created != test.expected {
+			t.Errorf("%s: expected GUILD_CREATE type %d, got %d", test.name, test.expected, created)
+		}
+		s.loadTimer.Stop()
+	}
+}
+
+func TestUnavailableGuilds(t *testing.T) {
+	m := testManager()
+
+	if guildIDs := m.UnavailableGuilds(); guildIDs == nil || len(guildIDs) != 0 {
+		t.Errorf("expected no unavailable guilds, got %v", guildIDs)
+	}
+
+	m.ShardGroups = map[int]*ShardGroup{
+		0: {Shards: map[int]*Shard{
+			0: {guilds: map[snowflake.ID]bool{1: true, 2: false}},
+			1: {guilds: map[snowflake.ID]bool{3: true}},
+		}},
+		1: {Shards: map[int]*Shard{
+			0: {guilds: map[snowflake.ID]bool{4: false, 5: false}},
+		}},
+	}
+
+	guildIDs := m.UnavailableGuilds()
+	sort.Strings(guildIDs)
+
+	expected := []string{"2", "4", "5"}
+	if len(guildIDs) != len(expected) {
+		t.Fatalf("expected %v to be unavailable, got %v", expected, guildIDs)
+	}
+	for i := range expected {
+		if guildIDs[i] != expected[i] {
+			t.Fatalf("expected %v to be unavailable, got %v", expected, guildIDs)
+		}
+	}
+}
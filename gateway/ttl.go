@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// cacheTTL returns the configured Redis.CacheTTL. It is 0 if the cache
+// does not expire.
+func (m *Manager) cacheTTL() time.Duration {
+	return time.Duration(m.Configuration.Redis.CacheTTL) * time.Second
+}
+
+// expire queues an EXPIRE of key using the CacheTTL if it is enabled
+func (m *Manager) expire(pipe redis.Pipeliner, key string) {
+	if ttl := m.cacheTTL(); ttl > 0 {
+		pipe.Expire(m.ctx, key, ttl)
+	}
+}
+
+// RefreshTTLs renews the CacheTTL of the keys of every guild the Shards
+// have, including guilds that are currently unavailable. Nothing is
+// done if CacheTTL is 0.
+func (m *Manager) RefreshTTLs() (err error) {
+	if m.cacheTTL() <= 0 {
+		return
+	}
+
+	guildIDs := m.guildIDs(false)
+	keys := m.keys()
+
+	_, err = m.RedisClient.Pipelined(m.ctx, func(pipe redis.Pipeliner) error {
+		for _, guildID := range guildIDs {
+			m.expire(pipe, keys.Members(guildID))
+			m.expire(pipe, keys.Roles(guildID))
+			m.expire(pipe, keys.VoiceStates(guildID))
+			m.expire(pipe, keys.Presences(guildID))
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	m.log.Debug().Int("guilds", len(guildIDs)).Msg("Refreshed cache TTLs")
+	return
+}
+
+// StartTTLRefresher calls RefreshTTLs each interval
+func (m *Manager) StartTTLRefresher(interval time.Duration) {
+	m.ttlRefresherMu.Lock()
+	defer m.ttlRefresherMu.Unlock()
+
+	if m.ttlRefresherStop != nil {
+		return
+	}
+
+	stop := make(chan void)
+	m.ttlRefresherStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := m.RefreshTTLs(); err != nil {
+					m.log.Warn().Err(err).Msg("Failed to refresh cache TTLs")
+				}
+			}
+		}
+	}()
+}
+
+// StopTTLRefresher stops the TTL refresher if it is running
+func (m *Manager) StopTTLRefresher() {
+	m.ttlRefresherMu.Lock()
+	defer m.ttlRefresherMu.Unlock()
+
+	if m.ttlRefresherStop != nil {
+		close(m.ttlRefresherStop)
+		m.ttlRefresherStop = nil
+	}
+}
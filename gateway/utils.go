@@ -1,14 +1,18 @@
 package gateway
 
-import "reflect"
+import (
+	"reflect"
 
-func contains(a interface{}, vars ...interface{}) bool {
-	for _var := range vars {
-		if _var == a {
-			return true
-		}
+	"github.com/TheRockettek/Sandwich-Producer/events"
+)
+
+// errorString returns the message of an error or an empty string if
+// there is no error
+func errorString(err error) string {
+	if err == nil {
+		return ""
 	}
-	return false
+	return err.Error()
 }
 
 // DeepEqualExports compares exported values of two interfaces based on the
@@ -35,3 +39,65 @@ func DeepEqualExports(tagName string, a interface{}, b interface{}) bool {
 	}
 	return true
 }
+
+// channelEqual returns true if two channels have the same settings. Only
+// the fields that can be changed by CHANNEL_UPDATE are compared: the
+// type, position, permission overwrites, name, topic, nsfw, bitrate,
+// user limit, slowmode, icon, owner and parent. LastMessageID and
+// LastPinTimestamp are ignored as they change without the channel being
+// edited. Permission overwrites are compared regardless of order.
+func channelEqual(a *events.Channel, b *events.Channel) bool {
+	if a.ID != b.ID ||
+		a.Type != b.Type ||
+		a.Position != b.Position ||
+		a.Name != b.Name ||
+		a.Topic != b.Topic ||
+		a.NSFW != b.NSFW ||
+		a.Bitrate != b.Bitrate ||
+		a.UserLimit != b.UserLimit ||
+		a.RateLimitPerUser != b.RateLimitPerUser ||
+		a.Icon != b.Icon ||
+		a.OwnerID != b.OwnerID ||
+		a.ParentID != b.ParentID {
+		return false
+	}
+
+	if len(a.PermissionOverwrites) != len(b.PermissionOverwrites) {
+		return false
+	}
+
+	overwrites := make(map[events.Overwrite]int, len(a.PermissionOverwrites))
+	for _, overwrite := range a.PermissionOverwrites {
+		overwrites[overwrite]++
+	}
+	for _, overwrite := range b.PermissionOverwrites {
+		if overwrites[overwrite] == 0 {
+			return false
+		}
+		overwrites[overwrite]--
+	}
+	return true
+}
+
+// roleEqual returns true if two roles have the same settings. Every
+// field of a role is compared: the name, color, hoist, position,
+// permissions, managed and mentionable.
+func roleEqual(a *events.Role, b *events.Role) bool {
+	return *a == *b
+}
+
+// maxInt returns the larger of a and b
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// minInt returns the smaller of a and b
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
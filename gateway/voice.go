@@ -0,0 +1,44 @@
+package gateway
+
+import (
+	"github.com/TheRockettek/Sandwich-Producer/events"
+	"github.com/bwmarrin/snowflake"
+)
+
+// JoinVoice joins or moves the bot to a voice channel of a guild using
+// the Shard that receives the events of the guild. Discord will send
+// VOICE_STATE_UPDATE and VOICE_SERVER_UPDATE which include the session,
+// token and endpoint needed to connect to voice.
+func (m *Manager) JoinVoice(guildID snowflake.ID, channelID snowflake.ID, mute bool, deaf bool) (err error) {
+	shard, err := m.guildShard(guildID)
+	if err != nil {
+		return
+	}
+
+	return shard.UpdateVoiceState(guildID, &channelID, mute, deaf)
+}
+
+// LeaveVoice disconnects the bot from voice in a guild
+func (m *Manager) LeaveVoice(guildID snowflake.ID) (err error) {
+	shard, err := m.guildShard(guildID)
+	if err != nil {
+		return
+	}
+
+	return shard.UpdateVoiceState(guildID, nil, false, false)
+}
+
+// UpdateVoiceState joins, moves or leaves voice in a guild. If channelID
+// is nil, the bot leaves voice. ErrShardNotConnected is returned if the
+// Shard is not connected.
+func (s *Shard) UpdateVoiceState(guildID snowflake.ID, channelID *snowflake.ID, mute bool, deaf bool) (err error) {
+	return s.WSWriteJSON(events.SentPayload{
+		Op: int(events.GatewayOpVoiceStateUpdate),
+		Data: events.UpdateVoiceState{
+			GuildID:   guildID,
+			ChannelID: channelID,
+			SelfMute:  mute,
+			SelfDeaf:  deaf,
+		},
+	})
+}
@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// zlibSuffix is the Z_SYNC_FLUSH suffix Discord ends every message with
+// when using the zlib-stream transport.
+var zlibSuffix = []byte{0x00, 0x00, 0xff, 0xff}
+
+// zlibWindowSize is the size of the deflate sliding window
+const zlibWindowSize = 32 << 10
+
+// ErrInvalidZlibHeader is returned when a zlib stream does not start with
+// a valid header.
+var ErrInvalidZlibHeader = errors.New("invalid zlib header")
+
+// ZlibStream represents a zlib-stream decompression context. Discord
+// sends a single zlib stream across an entire connection so frames must
+// be decompressed in order and with the same context. Zero value is not
+// valid.
+type ZlibStream struct {
+	buf    *bytes.Buffer
+	out    *bytes.Buffer
+	window []byte
+	header bool
+	fr     io.ReadCloser
+
+	// limit is the most bytes a message can decompress to. If 0, there
+	// is no limit.
+	limit int
+}
+
+// NewZlibStream creates a valid zlib-stream context. A new context must
+// be used for every connection. Messages decompressing to more than limit
+// bytes are discarded, if 0 there is no limit.
+func NewZlibStream(limit int) *ZlibStream {
+	return &ZlibStream{
+		buf:    new(bytes.Buffer),
+		out:    new(bytes.Buffer),
+		window: make([]byte, 0, zlibWindowSize),
+		limit:  limit,
+	}
+}
+
+// Decompress appends the frame to the stream. If the frame completes a
+// message, the decompressed message is returned otherwise nil is. The
+// returned bytes are only valid until the next call.
+func (z *ZlibStream) Decompress(d []byte) (data []byte, err error) {
+	z.buf.Write(d)
+	if !bytes.HasSuffix(d, zlibSuffix) {
+		return nil, nil
+	}
+
+	in := z.buf.Bytes()
+	if !z.header {
+		if len(in) < 2 || in[0]&0x0f != 8 || (uint16(in[0])<<8|uint16(in[1]))%31 != 0 {
+			return nil, ErrInvalidZlibHeader
+		}
+		in = in[2:]
+		z.header = true
+	}
+
+	// As every message ends with a sync flush, the only state carried
+	// between messages is the sliding window, so we can resume inflating
+	// using the previous output as the dictionary.
+	if z.fr == nil {
+		z.fr = flate.NewReaderDict(bytes.NewReader(in), z.window)
+	} else if err = z.fr.(flate.Resetter).Reset(bytes.NewReader(in), z.window); err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = z.fr
+	if z.limit > 0 {
+		r = io.LimitReader(z.fr, int64(z.limit)+1)
+	}
+
+	z.out.Reset()
+	_, err = z.out.ReadFrom(r)
+
+	// The stream does not end after a message so running out of input is
+	// expected.
+	if err != nil && err != io.ErrUnexpectedEOF {
+		z.buf.Reset()
+		return nil, err
+	}
+
+	// The rest of the message still has to be inflated as it is part of
+	// the window but only the window is kept.
+	if z.limit > 0 && z.out.Len() > z.limit {
+		z.slide(z.out.Bytes())
+		z.out.Reset()
+		_, err = io.Copy(zlibWindowWriter{z}, z.fr)
+		z.buf.Reset()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, ErrMessageTooLarge
+	}
+	z.buf.Reset()
+
+	z.slide(z.out.Bytes())
+	return z.out.Bytes(), nil
+}
+
+// zlibWindowWriter slides everything written to it into the window of a
+// ZlibStream
+type zlibWindowWriter struct {
+	z *ZlibStream
+}
+
+func (w zlibWindowWriter) Write(p []byte) (int, error) {
+	w.z.slide(p)
+	return len(p), nil
+}
+
+// slide keeps the last window of decompressed output to be used as the
+// dictionary for the next message.
+func (z *ZlibStream) slide(data []byte) {
+	if len(data) >= zlibWindowSize {
+		z.window = append(z.window[:0], data[len(data)-zlibWindowSize:]...)
+		return
+	}
+
+	if overflow := len(z.window) + len(data) - zlibWindowSize; overflow > 0 {
+		copy(z.window, z.window[overflow:])
+		z.window = z.window[:len(z.window)-overflow]
+	}
+	z.window = append(z.window, data...)
+}
+
+// Release frees the context. It must not be used afterwards.
+func (z *ZlibStream) Release() {
+	if z.fr != nil {
+		z.fr.Close()
+	}
+	z.fr = nil
+	z.buf = nil
+	z.out = nil
+	z.window = nil
+}
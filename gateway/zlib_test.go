@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// zlibFrames compresses each message into a single zlib stream, ending
+// every message with a sync flush like Discord does
+func zlibFrames(t testing.TB, messages ...string) (frames [][]byte) {
+	buf := new(bytes.Buffer)
+	zw := zlib.NewWriter(buf)
+
+	for _, message := range messages {
+		zw.Write([]byte(message))
+		if err := zw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, append([]byte(nil), buf.Bytes()...))
+		buf.Reset()
+	}
+	return
+}
+
+func TestZlibStreamLimit(t *testing.T) {
+	large := `{"op":0,"d":"` + strings.Repeat("a", 4096) + `"}`
+	messages := []string{`{"op":10}`, large, `{"op":11}`, large[:100]}
+
+	z := NewZlibStream(1024)
+	defer z.Release()
+
+	for i, frame := range zlibFrames(t, messages...) {
+		data, err := z.Decompress(frame)
+		if len(messages[i]) > 1024 {
+			if !errors.Is(err, ErrMessageTooLarge) {
+				t.Errorf("expected ErrMessageTooLarge for message %d, got %v", i, err)
+			}
+			continue
+		}
+
+		// Later messages refer back to the discarded message so it must
+		// still be part of the window.
+		if err != nil {
+			t.Fatalf("failed to decompress message %d: %v", i, err)
+		}
+		if string(data) != messages[i] {
+			t.Errorf("expected message %d to be %q, got %q", i, messages[i], data)
+		}
+	}
+}
+
+func TestZlibStreamSplitMessage(t *testing.T) {
+	frame := zlibFrames(t, `{"op":10,"d":{"heartbeat_interval":41250}}`)[0]
+
+	z := NewZlibStream(0)
+	defer z.Release()
+
+	if data, err := z.Decompress(frame[:len(frame)/2]); data != nil || err != nil {
+		t.Fatalf("expected an incomplete message to need more data, got %q, %v", data, err)
+	}
+	data, err := z.Decompress(frame[len(frame)/2:])
+	if err != nil {
+		t.Fatalf("failed to decompress: %v", err)
+	}
+	if string(data) != `{"op":10,"d":{"heartbeat_interval":41250}}` {
+		t.Errorf("unexpected message %q", data)
+	}
+}
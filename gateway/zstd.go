@@ -1,7 +1,10 @@
 package gateway
 
 import (
+	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 
 	"github.com/valyala/gozstd"
 )
@@ -12,57 +15,110 @@ type Compressor interface {
 	Decompress([]byte) ([]byte, error)
 }
 
-// Zstd represents a de/compression context. Zero value is not valid.
+// ErrMessageTooLarge is returned when a message decompresses to more than
+// the limit of a Decompressor
+var ErrMessageTooLarge = errors.New("decompressed message is too large")
+
+// ErrIncompleteMessage is returned when a zstd-stream message does not
+// decompress to a complete payload
+var ErrIncompleteMessage = errors.New("decompressed message is incomplete")
+
+// Decompressor is something that can decompress a transport compressed
+// stream. If the data does not complete a message, nil is returned and
+// more data is required. If the message decompresses to more than the
+// limit, ErrMessageTooLarge is returned and the message is discarded.
+// Release frees the context once the stream has ended.
+type Decompressor interface {
+	Decompress([]byte) ([]byte, error)
+	Release()
+}
+
+// Zstd represents a de/compression context. As the context is kept
+// between calls, data must be de/compressed in order such as with
+// Discord's zstd-stream transport. Zero value is not valid.
 type Zstd struct {
-	cw *gozstd.Writer
-	cr *ChanWriter
-	dw io.Writer
-	dr *ChanWriter
+	cw  *gozstd.Writer
+	cb  *bytes.Buffer
+	dr  *gozstd.Reader
+	db  *bytes.Buffer
+	out *bytes.Buffer
+
+	// limit is the most bytes a message can decompress to. If 0, there
+	// is no limit.
+	limit int
 }
 
-// NewZstd creates a valid zstd context
-func NewZstd() *Zstd {
-	cr := &ChanWriter{make(chan []byte)}
-	zw := gozstd.NewWriter(cr)
+// NewZstd creates a valid zstd context. Messages decompressing to more
+// than limit bytes are discarded, if 0 there is no limit.
+func NewZstd(limit int) *Zstd {
+	cb := new(bytes.Buffer)
+	db := new(bytes.Buffer)
 
-	dr, dw := io.Pipe()
-	zr := gozstd.NewReader(dr)
-	dChanWriter := &ChanWriter{make(chan []byte)}
-	go zr.WriteTo(dChanWriter)
-	return &Zstd{zw, cr, dw, dChanWriter}
+	return &Zstd{
+		cw:    gozstd.NewWriter(cb),
+		cb:    cb,
+		dr:    gozstd.NewReader(db),
+		db:    db,
+		out:   new(bytes.Buffer),
+		limit: limit,
+	}
 }
 
 // Compress compresses the given bytes and returns the compressed form
 func (z *Zstd) Compress(d []byte) []byte {
+	z.cb.Reset()
 	z.cw.Write(d)
-	go z.cw.Flush()
-	return <-z.cr.C
+	z.cw.Flush()
+	return append([]byte(nil), z.cb.Bytes()...)
 }
 
-// Decompress decompresses the given bytes and returns the decompressed form
+// Decompress decompresses the given bytes and returns the decompressed
+// form. Discord flushes the stream at the end of every message so the
+// bytes must be an entire message, otherwise ErrIncompleteMessage is
+// returned and the context can no longer be used. The returned bytes are
+// only valid until the next call.
 func (z *Zstd) Decompress(d []byte) ([]byte, error) {
-	println("Write")
-	_, err := z.dw.Write(d)
-	if err != nil {
-		return []byte{}, err
+	z.db.Write(d)
+	z.out.Reset()
+
+	// The reader keeps its state when the buffer runs out so reading until
+	// io.EOF returns everything that can be decompressed so far.
+	var r io.Reader = z.dr
+	if z.limit > 0 {
+		r = io.LimitReader(z.dr, int64(z.limit)+1)
 	}
 
-	println("Waiting :)")
-	return <-z.dr.C, nil
-}
+	_, err := z.out.ReadFrom(r)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
 
-// ChanWriter is a writer than sends all writes to a channel
-type ChanWriter struct {
-	C chan []byte
-}
+	// The rest of the message still has to be read to keep the context in
+	// step with the stream but none of it is kept.
+	if z.limit > 0 && z.out.Len() > z.limit {
+		z.out.Reset()
+		if _, err = io.Copy(ioutil.Discard, z.dr); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, ErrMessageTooLarge
+	}
 
-func (w *ChanWriter) Write(d []byte) (int, error) {
-	w.C <- d
-	return len(d), nil
+	if z.out.Len() == 0 {
+		return nil, nil
+	}
+
+	// Only part of a message is decompressed if the stream was not
+	// flushed, which means we are no longer in step with it.
+	if !json.Valid(z.out.Bytes()) {
+		z.out.Reset()
+		return nil, ErrIncompleteMessage
+	}
+	return z.out.Bytes(), nil
 }
 
-// Close this writer
-func (w *ChanWriter) Close() error {
-	close(w.C)
-	return nil
+// Release frees the resources used by the context. It must not be used
+// afterwards.
+func (z *Zstd) Release() {
+	z.cw.Release()
+	z.dr.Release()
 }
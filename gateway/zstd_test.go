@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestZstdDecompress(t *testing.T) {
+	messages := []string{`{"op":10,"d":{"heartbeat_interval":41250}}`, `{"op":11}`}
+
+	compressor := NewZstd(0)
+	defer compressor.Release()
+	z := NewZstd(0)
+	defer z.Release()
+
+	for _, message := range messages {
+		data, err := z.Decompress(compressor.Compress([]byte(message)))
+		if err != nil {
+			t.Fatalf("failed to decompress: %v", err)
+		}
+		if string(data) != message {
+			t.Errorf("expected %q, got %q", message, data)
+		}
+	}
+}
+
+func TestZstdIncompleteMessage(t *testing.T) {
+	compressor := NewZstd(0)
+	defer compressor.Release()
+	z := NewZstd(0)
+	defer z.Release()
+
+	frame := compressor.Compress([]byte(`{"op":10,"d":{"heartbeat_interval":41250}}`))
+	if data, err := z.Decompress(frame[:len(frame)/2]); !errors.Is(err, ErrIncompleteMessage) {
+		t.Errorf("expected ErrIncompleteMessage for part of a message, got %q, %v", data, err)
+	}
+}
+
+func TestZstdLimit(t *testing.T) {
+	large := `{"op":0,"d":"` + strings.Repeat("a", 4096) + `"}`
+
+	compressor := NewZstd(0)
+	defer compressor.Release()
+	z := NewZstd(1024)
+	defer z.Release()
+
+	if _, err := z.Decompress(compressor.Compress([]byte(large))); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+
+	data, err := z.Decompress(compressor.Compress([]byte(`{"op":11}`)))
+	if err != nil {
+		t.Fatalf("failed to decompress the message after the discarded one: %v", err)
+	}
+	if string(data) != `{"op":11}` {
+		t.Errorf("unexpected message %q", data)
+	}
+}
+
+// benchmarkGuildCreate returns a GUILD_CREATE payload with members and
+// channels similar to one received from Discord
+func benchmarkGuildCreate() []byte {
+	buf := bytes.NewBufferString(`{"op":0,"s":1,"t":"GUILD_CREATE","d":{"id":"41771983423143937","name":"Guild","members":[`)
+	for i := 0; i < 1000; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, `{"user":{"id":"%d","username":"user%d","discriminator":"%04d","avatar":null},"roles":["41771983423143936"],"joined_at":"2020-01-01T00:00:00.000000+00:00","deaf":false,"mute":false}`, 80351110224678912+i, i, i%10000)
+	}
+	buf.WriteString(`],"channels":[`)
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, `{"id":"%d","type":0,"name":"channel-%d","position":%d,"permission_overwrites":[]}`, 41771983423144000+i, i, i)
+	}
+	buf.WriteString(`]}}`)
+	return buf.Bytes()
+}
+
+func BenchmarkZstdDecompress(b *testing.B) {
+	payload := benchmarkGuildCreate()
+	compressor := NewZstd(0)
+	defer compressor.Release()
+	frame := compressor.Compress(payload)
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Every frame continues the stream so each has to be decompressed
+		// with a new context.
+		b.StopTimer()
+		z := NewZstd(0)
+		b.StartTimer()
+
+		if _, err := z.Decompress(frame); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		z.Release()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkZlibStreamDecompress(b *testing.B) {
+	payload := benchmarkGuildCreate()
+	frame := zlibFrames(b, string(payload))[0]
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		z := NewZlibStream(0)
+		b.StartTimer()
+
+		if _, err := z.Decompress(frame); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		z.Release()
+		b.StartTimer()
+	}
+}
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"math/rand"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 
 	"github.com/TheRockettek/Sandwich-Producer/gateway"
@@ -48,6 +46,8 @@ const config = `
 }
 `
 
+var logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout}).With().Timestamp().Logger()
+
 func init() {
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 }
@@ -57,9 +57,6 @@ func main() {
 	configuration := gateway.Configuration{}
 	jsoniter.Unmarshal([]byte(config), &configuration)
 
-	configuration.Nats.ClientID += "-" + strconv.Itoa(rand.Intn(9999))
-	logger.Info().Msgf("Using client id %s", configuration.Nats.ClientID)
-
 	m, err := gateway.NewManager(configuration, gateway.Features{}, logger)
 	if err != nil {
 		panic(err)